@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ShippingAddress is where an order goes. It is also the JSON snapshot
+// stored on orders.shipping_address.
+type ShippingAddress struct {
+	FullName   string `json:"full_name"`
+	Phone      string `json:"phone"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+type Address struct {
+	ID int `json:"id"`
+	ShippingAddress
+	IsDefault bool `json:"is_default"`
+}
+
+func (a ShippingAddress) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+func (a *ShippingAddress) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	}
+	return fmt.Errorf("cannot scan %T into ShippingAddress", src)
+}
+
+func (a *ShippingAddress) validate() error {
+	var missing []string
+	if strings.TrimSpace(a.FullName) == "" {
+		missing = append(missing, "full_name")
+	}
+	if strings.TrimSpace(a.Line1) == "" {
+		missing = append(missing, "line1")
+	}
+	if strings.TrimSpace(a.City) == "" {
+		missing = append(missing, "city")
+	}
+	if strings.TrimSpace(a.Country) == "" {
+		missing = append(missing, "country")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+const addressColumns = "id, full_name, phone, line1, line2, city, region, postal_code, country, is_default"
+
+func scanAddress(row interface{ Scan(...any) error }) (Address, error) {
+	var a Address
+	err := row.Scan(&a.ID, &a.FullName, &a.Phone, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.IsDefault)
+	return a, err
+}
+
+var errNoAddress = errors.New("no shipping address")
+
+// shippingAddressFor resolves the address used at checkout: the given
+// address id, or the user's default one when id is 0.
+func shippingAddressFor(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, userID, addressID int) (ShippingAddress, error) {
+	var row *sql.Row
+	if addressID == 0 {
+		row = q.QueryRowContext(ctx, "select "+addressColumns+" from addresses where user_id = $1 and is_default", userID)
+	} else {
+		row = q.QueryRowContext(ctx, "select "+addressColumns+" from addresses where user_id = $1 and id = $2", userID, addressID)
+	}
+	a, err := scanAddress(row)
+	if err == sql.ErrNoRows {
+		return ShippingAddress{}, errNoAddress
+	}
+	return a.ShippingAddress, err
+}
+
+func getAddresses(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select "+addressColumns+" from addresses where user_id = $1 order by is_default desc, id", userID)
+	if err != nil {
+		http.Error(w, "error while getting addresses", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing addresses", "err", err)
+		return
+	}
+	defer rows.Close()
+	as := []Address{}
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			http.Error(w, "error while getting addresses", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning address", "err", err)
+			return
+		}
+		as = append(as, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(as)
+}
+
+// postAddress adds an address to the book. The first address, or one sent
+// with is_default, becomes the default.
+func postAddress(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var a Address
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := a.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var others int
+	if err := tx.QueryRowContext(r.Context(), "select count(*) from addresses where user_id = $1", userID).Scan(&others); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("counting addresses", "err", err)
+		return
+	}
+	if others == 0 {
+		a.IsDefault = true
+	}
+	if a.IsDefault {
+		if _, err := tx.ExecContext(r.Context(), "update addresses set is_default = false where user_id = $1", userID); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("clearing default address", "err", err)
+			return
+		}
+	}
+	err = tx.QueryRowContext(r.Context(), "insert into addresses (user_id, full_name, phone, line1, line2, city, region, postal_code, country, is_default) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) returning id",
+		userID, a.FullName, a.Phone, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.IsDefault).Scan(&a.ID)
+	if err != nil {
+		http.Error(w, "error while saving address", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("inserting address", "err", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "error while saving address", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func putAddress(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	var a Address
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := a.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	row := db.QueryRowContext(r.Context(), "update addresses set full_name = $1, phone = $2, line1 = $3, line2 = $4, city = $5, region = $6, postal_code = $7, country = $8 where id = $9 and user_id = $10 returning "+addressColumns,
+		a.FullName, a.Phone, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, id, userID)
+	a, err = scanAddress(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "address not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "error while saving address", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("updating address", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// deleteAddress removes an address. If it was the default, the oldest
+// remaining address takes over.
+func deleteAddress(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var wasDefault bool
+	err = tx.QueryRowContext(r.Context(), "delete from addresses where id = $1 and user_id = $2 returning is_default", id, userID).Scan(&wasDefault)
+	if err == sql.ErrNoRows {
+		http.Error(w, "address not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting address", "err", err)
+		return
+	}
+	if wasDefault {
+		_, err := tx.ExecContext(r.Context(), "update addresses set is_default = true where id = (select min(id) from addresses where user_id = $1)", userID)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("promoting default address", "err", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully",
+	})
+}
+
+func setDefaultAddress(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(r.Context(), "update addresses set is_default = false where user_id = $1 and is_default", userID); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("clearing default address", "err", err)
+		return
+	}
+	a, err := scanAddress(tx.QueryRowContext(r.Context(), "update addresses set is_default = true where id = $1 and user_id = $2 returning "+addressColumns, id, userID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "address not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("setting default address", "err", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// ArchivedProduct is a deleted product. Ordered ones are kept for good;
+// the rest can be purged.
+type ArchivedProduct struct {
+	ID         int       `json:"id"`
+	SKU        string    `json:"sku"`
+	Name       string    `json:"name"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Ordered    bool      `json:"ordered"`
+}
+
+// archiveProduct hides a product from the catalog and takes it out of
+// carts. It reports false if there's no such product or it's already
+// archived.
+func archiveProduct(ctx context.Context, id string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "update products set archived_at = now() where id = $1 and archived_at is null", id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "delete from cart where product_id = $1", id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// restoreProduct puts an archived product back in the catalog. Carts it was
+// taken out of stay as they are.
+func restoreProduct(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can restore products", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "update products set archived_at = null where id = $1 and archived_at is not null", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("restoring product", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "archived product not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Restored successfully!",
+	})
+}
+
+func getArchivedProducts(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can see archived products", http.StatusForbidden)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select p.id, coalesce(p.sku, ''), p.name, p.archived_at, exists (select 1 from order_items where order_items.product_id = p.id) from products p where p.archived_at is not null order by p.archived_at desc, p.id")
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing archived products", "err", err)
+		return
+	}
+	defer rows.Close()
+	list := []ArchivedProduct{}
+	for rows.Next() {
+		var p ArchivedProduct
+		if err := rows.Scan(&p.ID, &p.SKU, &p.Name, &p.ArchivedAt, &p.Ordered); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning archived product", "err", err)
+			return
+		}
+		list = append(list, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// purgeProducts deletes products archived before cutoff that no order
+// refers to, with their images. Ordered products are kept whatever their
+// age. A dry run only lists what would go.
+func purgeProducts(ctx context.Context, cutoff time.Time, dryRun bool) ([]ArchivedProduct, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "select p.id, coalesce(p.sku, ''), p.name, p.archived_at from products p where p.archived_at < $1 and not exists (select 1 from order_items where order_items.product_id = p.id) order by p.id for update", cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var purged []ArchivedProduct
+	var ids []int64
+	for rows.Next() {
+		var p ArchivedProduct
+		if err := rows.Scan(&p.ID, &p.SKU, &p.Name, &p.ArchivedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		purged = append(purged, p)
+		ids = append(ids, int64(p.ID))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if dryRun || len(purged) == 0 {
+		return purged, nil
+	}
+
+	var keys []string
+	for _, p := range purged {
+		imgs, err := loadProductImages(ctx, tx, p.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range imgs {
+			keys = append(keys, img.keys()...)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "delete from products where id = any($1)", pq.Array(ids)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	deleteBlobs(ctx, keys)
+	return purged, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPurgeProducts(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	st := localStore{dir: t.TempDir(), baseURL: mediaPrefix}
+	blobs = st
+	ctx := context.Background()
+	for _, key := range []string{"products/4/a/original.png", "products/4/a/160.png"} {
+		if err := st.Put(ctx, key, []byte("png"), "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	candidates := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "sku", "name", "archived_at"}).AddRow(4, "", "Cap", cutoff.Add(-time.Hour))
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("where p.archived_at < \\$1 and not exists \\(select 1 from order_items").WithArgs(cutoff).WillReturnRows(candidates())
+	mock.ExpectRollback()
+	purged, err := purgeProducts(ctx, cutoff, true)
+	if err != nil || len(purged) != 1 || purged[0].Name != "Cap" {
+		t.Fatalf("dry run = %+v, %v", purged, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("where p.archived_at < \\$1").WithArgs(cutoff).WillReturnRows(candidates())
+	mock.ExpectQuery("from product_images where product_id").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "position", "key", "content_type", "width", "height", "thumbnails", "created_at"}).
+			AddRow(1, 4, 0, "products/4/a/original.png", "image/png", 640, 480, []byte(`{"160":"products/4/a/160.png"}`), cutoff))
+	mock.ExpectExec("delete from products where id = any").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if purged, err = purgeProducts(ctx, cutoff, false); err != nil || len(purged) != 1 {
+		t.Fatalf("purge = %+v, %v", purged, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(st.dir, "products/4/a/*")); len(left) > 0 {
+		t.Errorf("images left behind: %v", left)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mediaPrefix is where the local blob store serves files from.
+const mediaPrefix = "/media/"
+
+// BlobStore keeps uploaded files such as product images. Keys are
+// slash-separated paths chosen by the caller. Implementations must be safe
+// for concurrent use.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Delete(ctx context.Context, key string) error
+	// URL is where clients fetch the blob from.
+	URL(key string) string
+}
+
+var blobs BlobStore
+
+var errBadBlobKey = errors.New("invalid blob key")
+
+// newBlobStore picks the store from BLOB_STORE: files under MEDIA_DIR served
+// at MEDIA_URL (the default), or an S3-compatible bucket.
+func newBlobStore() (BlobStore, error) {
+	switch s := os.Getenv("BLOB_STORE"); s {
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "media"
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		base := os.Getenv("MEDIA_URL")
+		if base == "" {
+			base = mediaPrefix
+		}
+		return localStore{dir: dir, baseURL: strings.TrimSuffix(base, "/") + "/"}, nil
+	case "s3":
+		endpoint, err := url.Parse(os.Getenv("S3_ENDPOINT"))
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return nil, fmt.Errorf("S3_ENDPOINT must be an absolute http(s) URL")
+		}
+		st := s3Store{
+			endpoint:  strings.TrimSuffix(endpoint.String(), "/"),
+			bucket:    os.Getenv("S3_BUCKET"),
+			region:    os.Getenv("S3_REGION"),
+			accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			publicURL: os.Getenv("S3_PUBLIC_URL"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		if st.bucket == "" || st.accessKey == "" || st.secretKey == "" {
+			return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+		}
+		if st.region == "" {
+			st.region = "us-east-1"
+		}
+		if st.publicURL == "" {
+			st.publicURL = st.endpoint + "/" + st.bucket
+		}
+		st.publicURL = strings.TrimSuffix(st.publicURL, "/") + "/"
+		return st, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", s)
+	}
+}
+
+// checkBlobKey rejects keys that could escape the store's root.
+func checkBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("%w: %q", errBadBlobKey, key)
+	}
+	return nil
+}
+
+// localStore keeps blobs as files under dir.
+type localStore struct {
+	dir     string
+	baseURL string
+}
+
+func (s localStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// Write then rename, so a file being served is never half written.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s localStore) Delete(ctx context.Context, key string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s localStore) URL(key string) string {
+	return s.baseURL + key
+}
+
+// Handler serves the blobs. Keys are never reused, so responses can be
+// cached for good; directories aren't listed.
+func (s localStore) Handler() http.Handler {
+	files := http.FileServer(http.Dir(s.dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// s3Store keeps blobs in a bucket of an S3-compatible service, addressed
+// path-style (endpoint/bucket/key) so it works with MinIO and friends.
+// Requests are signed with AWS Signature Version 4.
+type s3Store struct {
+	endpoint, bucket, region string
+	accessKey, secretKey     string
+	publicURL                string
+	client                   *http.Client
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as SigV4
+// wants path segments encoded.
+func s3Escape(seg string) string {
+	var b strings.Builder
+	for _, c := range []byte(seg) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s s3Store) objectURL(key string) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	return s.endpoint + "/" + s3Escape(s.bucket) + "/" + strings.Join(segs, "/")
+}
+
+func (s s3Store) do(ctx context.Context, method, key string, data []byte, contentType string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(data)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (s s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.do(ctx, http.MethodPut, key, data, contentType)
+}
+
+func (s s3Store) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, http.MethodDelete, key, nil, "")
+}
+
+func (s s3Store) URL(key string) string {
+	return s.publicURL + key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds SigV4 headers for a request whose body hashes to payloadHash.
+func (s s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type Cart struct {
@@ -12,14 +15,73 @@ type Cart struct {
 	Quantity   int `json:"quantity"`
 }
 type DCart struct {
-	ID            int    `json:"id"`
-	Product_name  string `json:"product_name"`
+	ID           int    `json:"id"`
+	Product_name string `json:"product_name"`
+	// Product_price is Price as a decimal string of minor units, kept for
+	// clients written before prices were typed.
 	Product_price string `json:"product_price"`
+	Price         Money  `json:"price"`
+	Currency      string `json:"currency"`
 	Quantity      int    `json:"quantity"`
 }
 type idjson struct {
 	ID int `json:"id"`
 }
+type CartQuantity struct {
+	Quantity int `json:"quantity"`
+}
+
+// CartLine is a cart line with typed prices and change flags relative to
+// what the customer saw when adding it.
+type CartLine struct {
+	ID           int    `json:"id"`
+	ProductID    int    `json:"product_id"`
+	ProductName  string `json:"product_name"`
+	Price        Money  `json:"price"`
+	AddedPrice   Money  `json:"added_price"`
+	Quantity     int    `json:"quantity"`
+	Subtotal     Money  `json:"subtotal"`
+	Stock        int    `json:"stock"`
+	PriceChanged bool   `json:"price_changed"`
+	StockChanged bool   `json:"stock_changed"`
+	InStock      bool   `json:"in_stock"`
+}
+
+// CartSummary totals the cart. Total is the sum of the lines; GrandTotal
+// is what the customer pays after the coupon's discount.
+type CartSummary struct {
+	Lines        []CartLine `json:"lines"`
+	ItemCount    int        `json:"item_count"`
+	Currency     string     `json:"currency"`
+	Total        Money      `json:"total"`
+	HasChanges   bool       `json:"has_changes"`
+	Weight       int        `json:"weight"`
+	CouponCode   string     `json:"coupon_code,omitempty"`
+	CouponError  string     `json:"coupon_error,omitempty"`
+	Discount     Money      `json:"discount"`
+	FreeShipping bool       `json:"free_shipping"`
+	GrandTotal   Money      `json:"grand_total"`
+}
+
+// loadCart returns the user's cart lines, never nil.
+func loadCart(ctx context.Context, username any) ([]DCart, error) {
+	cartrows, err := db.QueryContext(ctx, "select cart.id, products.name,products.price,cart.quantity from cart join users on users.id = cart.user_id join products on products.id = cart.product_id where users.username = $1 order by cart.id", username)
+	if err != nil {
+		return nil, err
+	}
+	defer cartrows.Close()
+	cs := []DCart{}
+	for cartrows.Next() {
+		var c DCart
+		if err := cartrows.Scan(&c.ID, &c.Product_name, &c.Price, &c.Quantity); err != nil {
+			return nil, err
+		}
+		c.Product_price = strconv.Itoa(c.Price.Amount)
+		c.Currency = c.Price.Currency
+		cs = append(cs, c)
+	}
+	return cs, cartrows.Err()
+}
 
 func clearCart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
@@ -32,11 +94,12 @@ func clearCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.Exec("delete from cart using users where cart.user_id = users.id and users.username = $1", username)
+	_, err := db.ExecContext(r.Context(), "delete from cart using users where cart.user_id = users.id and users.username = $1", username)
 	if err != nil {
 		http.Error(w, "error while clearing table", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Cleared successfully",
 	})
@@ -57,11 +120,12 @@ func removefromCart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "error while parsing json", http.StatusInternalServerError)
 		return
 	}
-	_, err := db.Exec("delete from cart using users where cart.user_id = users.id and users.username = $1 and cart.id = $2", username, idcart.ID)
+	_, err := db.ExecContext(r.Context(), "delete from cart using users where cart.user_id = users.id and users.username = $1 and cart.id = $2", username, idcart.ID)
 	if err != nil {
 		http.Error(w, "error while removing cart", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Deleted successfully",
 	})
@@ -78,7 +142,7 @@ func addCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var ID int
-	row := db.QueryRow("select id from users where username = $1", username)
+	row := db.QueryRowContext(r.Context(), "select id from users where username = $1", username)
 	err := row.Scan(&ID)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -89,7 +153,7 @@ func addCart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid json format", http.StatusNonAuthoritativeInfo)
 		return
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, "Transaction error", http.StatusInternalServerError)
 		return
@@ -97,29 +161,39 @@ func addCart(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	for _, cart := range c {
-		row := db.QueryRow("select stock from products where id = $1", cart.Product_ID)
-		var stock int
-		err := row.Scan(&stock)
+		if cart.Quantity < 1 {
+			http.Error(w, "quantity must be at least 1", http.StatusBadRequest)
+			return
+		}
+		// Lock the product row so two concurrent adds can't both pass the
+		// stock check, and count what is already in the cart.
+		row := tx.QueryRowContext(r.Context(), "select p.price, p.stock, coalesce(c.quantity, 0) from products p left join cart c on c.product_id = p.id and c.user_id = $2 where p.id = $1 and p.archived_at is null for update of p", cart.Product_ID, ID)
+		var price, stock, inCart int
+		err := row.Scan(&price, &stock, &inCart)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Invalid product id", http.StatusInternalServerError)
 			return
 		} else if err != nil {
 			http.Error(w, "internal server error", http.StatusInternalServerError)
-			log.Panic(err)
+			loggerFrom(r.Context()).Error("checking stock", "product_id", cart.Product_ID, "err", err)
 			return
 		}
-		if (stock - cart.Quantity) < 0 {
+		if (stock - inCart - cart.Quantity) < 0 {
 			http.Error(w, "too much quantity", http.StatusInternalServerError)
 			return
 		}
-		_, err = tx.Exec("insert into cart (user_id,product_id,quantity) values ($1,$2,$3)", ID, cart.Product_ID, cart.Quantity)
+		_, err = tx.ExecContext(r.Context(), "insert into cart (user_id,product_id,quantity,added_price,added_stock) values ($1,$2,$3,$4,$5) on conflict (user_id, product_id) do update set quantity = cart.quantity + excluded.quantity, added_price = excluded.added_price, added_stock = excluded.added_stock", ID, cart.Product_ID, cart.Quantity, price, stock)
 		if err != nil {
 			http.Error(w, "failed to insert cart", http.StatusInternalServerError)
-			log.Panic(err)
+			loggerFrom(r.Context()).Error("inserting cart line", "err", err)
 			return
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "failed to insert cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("committing cart", "err", err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -137,32 +211,138 @@ func getCart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no username in context", http.StatusInternalServerError)
 		return
 	}
-	cartrows, err := db.Query("select cart.id, products.name,products.price,cart.quantity from cart join users on users.id = cart.user_id join products on products.id = cart.product_id where users.username = $1", username)
+	cs, err := loadCart(r.Context(), username)
 	if err != nil {
 		http.Error(w, "error while getting cart", http.StatusInternalServerError)
-		log.Panic(err)
+		loggerFrom(r.Context()).Error("loading cart", "err", err)
 		return
 	}
-	var cs []DCart
-	defer cartrows.Close()
-	for cartrows.Next() {
-		var c DCart
-		err := cartrows.Scan(&c.ID, &c.Product_name, &c.Product_price, &c.Quantity)
-		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			log.Panic(err)
-			return
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(cs)
+	if err != nil {
+		loggerFrom(r.Context()).Error("encoding cart", "err", err)
+		return
+	}
+}
+
+// loadCartSummary prices the user's cart at current product prices and
+// applies the cart's coupon.
+func loadCartSummary(ctx context.Context, username any) (CartSummary, error) {
+	sum := CartSummary{Lines: []CartLine{}, Currency: shopCurrency, Total: money(0), Discount: money(0)}
+	rows, err := db.QueryContext(ctx, "select cart.id, products.id, products.name, products.category, products.price, cart.added_price, cart.quantity, products.stock, cart.added_stock, products.weight from cart join users on users.id = cart.user_id join products on products.id = cart.product_id where users.username = $1 order by cart.id", username)
+	if err != nil {
+		return sum, err
+	}
+	defer rows.Close()
+	var lines []couponLine
+	for rows.Next() {
+		var l CartLine
+		var category string
+		var addedStock, weight int
+		if err := rows.Scan(&l.ID, &l.ProductID, &l.ProductName, &category, &l.Price, &l.AddedPrice, &l.Quantity, &l.Stock, &addedStock, &weight); err != nil {
+			return sum, err
+		}
+		lines = append(lines, couponLine{productID: l.ProductID, category: category, price: l.Price.Amount, quantity: l.Quantity})
+		if l.Subtotal, err = l.Price.Mul(l.Quantity); err != nil {
+			return sum, err
+		}
+		if sum.Total, err = sum.Total.Add(l.Subtotal); err != nil {
+			return sum, err
+		}
+		l.PriceChanged = l.Price != l.AddedPrice
+		l.StockChanged = l.Stock != addedStock
+		l.InStock = l.Stock >= l.Quantity
+		sum.Lines = append(sum.Lines, l)
+		sum.ItemCount += l.Quantity
+		sum.Weight += weight * l.Quantity
+		if l.PriceChanged || l.StockChanged || !l.InStock {
+			sum.HasChanges = true
 		}
-		cs = append(cs, c)
 	}
-	if cs == nil {
-		cs = []DCart{}
+	if err := rows.Err(); err != nil {
+		return sum, err
+	}
+	rows.Close()
+	sum.GrandTotal = sum.Total
+	return sum, applyCartCoupon(ctx, &sum, username, lines)
+}
+
+func getCartSummary(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "no username in context", http.StatusInternalServerError)
+		return
+	}
+	sum, err := loadCartSummary(r.Context(), username)
+	if err != nil {
+		http.Error(w, "error while getting cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading cart summary", "err", err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(cs)
+	json.NewEncoder(w).Encode(sum)
+}
+
+// updateCartLine sets the quantity of one of the user's cart lines after
+// re-checking stock, and responds with the whole updated cart.
+func updateCartLine(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "no username in context", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Panic(err)
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	var q CartQuantity
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid json format", http.StatusBadRequest)
+		return
+	}
+	if q.Quantity < 1 {
+		http.Error(w, "quantity must be at least 1", http.StatusBadRequest)
 		return
 	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var stock int
+	err = tx.QueryRowContext(r.Context(), "select products.stock from cart join users on users.id = cart.user_id join products on products.id = cart.product_id where cart.id = $1 and users.username = $2 for update of cart, products", id, username).Scan(&stock)
+	if err == sql.ErrNoRows {
+		http.Error(w, "cart line not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("checking stock", "cart_id", id, "err", err)
+		return
+	}
+	if q.Quantity > stock {
+		http.Error(w, "too much quantity", http.StatusConflict)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), "update cart set quantity = $1 where id = $2", q.Quantity, id); err != nil {
+		http.Error(w, "failed to update cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("updating cart line", "cart_id", id, "err", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "failed to update cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("committing cart update", "err", err)
+		return
+	}
+
+	cs, err := loadCart(r.Context(), username)
+	if err != nil {
+		http.Error(w, "error while getting cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading cart", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs)
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand runs a maintenance command given on the command line, after
+// migrations and the tax and blob store setup, instead of serving:
+//
+//	inetmagaz import-rates [file]   load currency,rate CSV (stdin without file)
+//	inetmagaz import-products [-dry-run] [file.csv|file.json]
+//	                                upsert products, printing the report
+//	inetmagaz export-products [-json]
+//	                                write the catalog to stdout
+//	inetmagaz purge-products [-dry-run] [age]
+//	                                delete products archived longer than age
+//	                                (default 720h) and never ordered
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "purge-products":
+		dryRun := len(args) > 1 && args[1] == "-dry-run"
+		if dryRun {
+			args = args[1:]
+		}
+		age := 30 * 24 * time.Hour
+		if len(args) > 1 {
+			var err error
+			if age, err = time.ParseDuration(args[1]); err != nil || age < 0 {
+				return fmt.Errorf("purge-products: age must be a duration like 720h")
+			}
+		}
+		purged, err := purgeProducts(ctx, time.Now().Add(-age), dryRun)
+		if err != nil {
+			return fmt.Errorf("purge-products: %w", err)
+		}
+		for _, p := range purged {
+			fmt.Printf("%d\t%s\t%s\tarchived %s\n", p.ID, p.SKU, p.Name, p.ArchivedAt.Format(time.DateOnly))
+		}
+		if dryRun {
+			fmt.Printf("would purge %d products\n", len(purged))
+		} else {
+			fmt.Printf("purged %d products\n", len(purged))
+		}
+		return nil
+	case "import-products":
+		dryRun := len(args) > 1 && args[1] == "-dry-run"
+		if dryRun {
+			args = args[1:]
+		}
+		var in io.Reader = os.Stdin
+		name := "-"
+		if len(args) > 1 && args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in, name = f, args[1]
+		}
+		read := readProductsCSV
+		if strings.HasSuffix(name, ".json") {
+			read = readProductsJSON
+		}
+		rows, err := read(in)
+		if err != nil {
+			return fmt.Errorf("import-products: %w", err)
+		}
+		report, err := importProducts(ctx, rows, dryRun)
+		if err != nil {
+			return fmt.Errorf("import-products: %w", err)
+		}
+		for _, row := range report.Rows {
+			fmt.Printf("%d\t%s\t%s %s\t%s\n", row.Row, row.Action, row.SKU, row.Name, strings.Join(row.Errors, "; "))
+		}
+		fmt.Printf("created %d, updated %d, failed %d\n", report.Created, report.Updated, report.Failed)
+		if report.Failed > 0 {
+			return errors.New("import-products: nothing was saved")
+		}
+		if dryRun {
+			fmt.Println("dry run: nothing was saved")
+		}
+		return nil
+	case "export-products":
+		format := "csv"
+		if len(args) > 1 && args[1] == "-json" {
+			format = "json"
+		}
+		return exportProducts(ctx, os.Stdout, format)
+	case "import-rates":
+		var in io.Reader = os.Stdin
+		if len(args) > 1 && args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		n, err := importExchangeRates(ctx, in)
+		if err != nil {
+			return fmt.Errorf("import-rates: %w", err)
+		}
+		fmt.Printf("imported %d exchange rates\n", n)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
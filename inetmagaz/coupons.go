@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Coupon kinds.
+const (
+	couponPercent      = "percent"
+	couponFixed        = "fixed"
+	couponFreeShipping = "free_shipping"
+)
+
+var (
+	errUnknownCoupon = errors.New("unknown coupon code")
+	errCouponInvalid = errors.New("coupon can't be applied")
+)
+
+// Coupon is a discount code. Value is a percentage for percent coupons and
+// an amount for fixed ones. Zero limits mean no limit; empty ProductIDs and
+// Categories mean the whole cart is eligible.
+type Coupon struct {
+	ID             int        `json:"id"`
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int        `json:"value"`
+	MinTotal       int        `json:"min_total"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	MaxUses        int        `json:"max_uses"`
+	MaxUsesPerUser int        `json:"max_uses_per_user"`
+	Uses           int        `json:"uses"`
+	ProductIDs     []int64    `json:"product_ids"`
+	Categories     []string   `json:"categories"`
+	Active         bool       `json:"active"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type CouponInput struct {
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int        `json:"value"`
+	MinTotal       int        `json:"min_total"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	MaxUses        int        `json:"max_uses"`
+	MaxUsesPerUser int        `json:"max_uses_per_user"`
+	ProductIDs     []int64    `json:"product_ids"`
+	Categories     []string   `json:"categories"`
+}
+
+type CouponCode struct {
+	Code string `json:"code"`
+}
+
+// normalizeCouponCode makes codes case-insensitive.
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (in CouponInput) validate() error {
+	if normalizeCouponCode(in.Code) == "" {
+		return fmt.Errorf("code is required")
+	}
+	switch in.Kind {
+	case couponPercent:
+		if in.Value < 1 || in.Value > 100 {
+			return fmt.Errorf("percent value must be between 1 and 100")
+		}
+	case couponFixed:
+		if in.Value < 1 {
+			return fmt.Errorf("fixed value must be positive")
+		}
+	case couponFreeShipping:
+		if in.Value != 0 {
+			return fmt.Errorf("free_shipping coupons have no value")
+		}
+	default:
+		return fmt.Errorf("kind must be %s, %s or %s", couponPercent, couponFixed, couponFreeShipping)
+	}
+	if in.MinTotal < 0 || in.MaxUses < 0 || in.MaxUsesPerUser < 0 {
+		return fmt.Errorf("min_total and limits can't be negative")
+	}
+	if in.StartsAt != nil && in.EndsAt != nil && !in.EndsAt.After(*in.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// couponLine is a cart line as coupon rules see it.
+type couponLine struct {
+	productID int
+	category  string
+	price     int
+	quantity  int
+}
+
+// couponResult is what a coupon takes off a cart. Lines holds each line's
+// share of Discount, in cart order.
+type couponResult struct {
+	Discount     int
+	FreeShipping bool
+	Lines        []int
+}
+
+func (c Coupon) covers(l couponLine) bool {
+	if len(c.ProductIDs) == 0 && len(c.Categories) == 0 {
+		return true
+	}
+	for _, id := range c.ProductIDs {
+		if int(id) == l.productID {
+			return true
+		}
+	}
+	for _, cat := range c.Categories {
+		if cat == l.category {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCoupon checks c against a cart at now and works out the discount.
+// userUses is how many orders the customer already placed with c. The
+// discount never exceeds what the eligible lines cost and is split across
+// them in proportion to their subtotals.
+func applyCoupon(c Coupon, lines []couponLine, userUses int, now time.Time) (couponResult, error) {
+	res := couponResult{Lines: make([]int, len(lines))}
+	switch {
+	case !c.Active:
+		return res, fmt.Errorf("%w: %s is no longer available", errCouponInvalid, c.Code)
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return res, fmt.Errorf("%w: %s is not valid yet", errCouponInvalid, c.Code)
+	case c.EndsAt != nil && !now.Before(*c.EndsAt):
+		return res, fmt.Errorf("%w: %s has expired", errCouponInvalid, c.Code)
+	case c.MaxUses > 0 && c.Uses >= c.MaxUses:
+		return res, fmt.Errorf("%w: %s has been used up", errCouponInvalid, c.Code)
+	case c.MaxUsesPerUser > 0 && userUses >= c.MaxUsesPerUser:
+		return res, fmt.Errorf("%w: you have already used %s", errCouponInvalid, c.Code)
+	}
+
+	total, eligible := 0, 0
+	for _, l := range lines {
+		total += l.price * l.quantity
+		if c.covers(l) {
+			eligible += l.price * l.quantity
+		}
+	}
+	if total < c.MinTotal {
+		return res, fmt.Errorf("%w: %s needs an order of at least %d", errCouponInvalid, c.Code, c.MinTotal)
+	}
+	if eligible == 0 {
+		return res, fmt.Errorf("%w: %s doesn't apply to anything in your cart", errCouponInvalid, c.Code)
+	}
+
+	switch c.Kind {
+	case couponPercent:
+		res.Discount = eligible * c.Value / 100
+	case couponFixed:
+		res.Discount = min(c.Value, eligible)
+	case couponFreeShipping:
+		res.FreeShipping = true
+	}
+	weights := make([]int, len(lines))
+	for i, l := range lines {
+		if c.covers(l) {
+			weights[i] = l.price * l.quantity
+		}
+	}
+	for i, share := range money(res.Discount).Allocate(weights) {
+		res.Lines[i] = share.Amount
+	}
+	return res, nil
+}
+
+const couponColumns = "coupons.id, coupons.code, coupons.kind, coupons.value, coupons.min_total, coupons.starts_at, coupons.ends_at, coupons.max_uses, coupons.max_uses_per_user, coupons.uses, coupons.product_ids, coupons.categories, coupons.active, coupons.created_at"
+
+func (c *Coupon) scanArgs() []any {
+	return []any{&c.ID, &c.Code, &c.Kind, &c.Value, &c.MinTotal, &c.StartsAt, &c.EndsAt, &c.MaxUses, &c.MaxUsesPerUser, &c.Uses, pq.Array(&c.ProductIDs), pq.Array(&c.Categories), &c.Active, &c.CreatedAt}
+}
+
+// cartCouponQuery loads the coupon on a cart and how often its owner has
+// redeemed it; callers add the condition on users.
+const cartCouponQuery = "select " + couponColumns + ", (select count(*) from coupon_redemptions where coupon_redemptions.coupon_id = coupons.id and coupon_redemptions.user_id = users.id) from cart_coupons join users on users.id = cart_coupons.user_id join coupons on coupons.id = cart_coupons.coupon_id where "
+
+// cartCoupon returns the coupon applied to the user's cart, or nil. At
+// checkout the coupon row is locked so its usage limits hold under
+// concurrent orders.
+func cartCoupon(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, userID int, forUpdate bool) (*Coupon, int, error) {
+	query := cartCouponQuery + "users.id = $1"
+	if forUpdate {
+		query += " for update of coupons"
+	}
+	var c Coupon
+	var uses int
+	err := q.QueryRowContext(ctx, query, userID).Scan(append(c.scanArgs(), &uses)...)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return &c, uses, nil
+}
+
+// applyCartCoupon prices the coupon on the cart into sum. A coupon that no
+// longer applies is reported in CouponError and takes nothing off.
+func applyCartCoupon(ctx context.Context, sum *CartSummary, username any, lines []couponLine) error {
+	var c Coupon
+	var uses int
+	err := db.QueryRowContext(ctx, cartCouponQuery+"users.username = $1", username).Scan(append(c.scanArgs(), &uses)...)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sum.CouponCode = c.Code
+	res, err := applyCoupon(c, lines, uses, time.Now())
+	if errors.Is(err, errCouponInvalid) {
+		sum.CouponError = err.Error()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sum.Discount = Money{Amount: res.Discount, Currency: sum.Currency}
+	sum.FreeShipping = res.FreeShipping
+	sum.GrandTotal, err = sum.Total.Sub(sum.Discount)
+	return err
+}
+
+// postCartCoupon applies a discount code to the current user's cart,
+// replacing any other, and responds with the repriced cart.
+func postCartCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var in CouponCode
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || normalizeCouponCode(in.Code) == "" {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	var c Coupon
+	var uses int
+	err = db.QueryRowContext(r.Context(), "select "+couponColumns+", (select count(*) from coupon_redemptions where coupon_id = coupons.id and user_id = $2) from coupons where code = $1", normalizeCouponCode(in.Code), userID).
+		Scan(append(c.scanArgs(), &uses)...)
+	if err == sql.ErrNoRows {
+		http.Error(w, errUnknownCoupon.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading coupon", "err", err)
+		return
+	}
+	lines, err := loadCouponLines(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading cart", "err", err)
+		return
+	}
+	if _, err := applyCoupon(c, lines, uses, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "insert into cart_coupons (user_id, coupon_id) values ($1,$2) on conflict (user_id) do update set coupon_id = excluded.coupon_id", userID, c.ID); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("applying coupon", "err", err)
+		return
+	}
+	getCartSummary(w, r)
+}
+
+func deleteCartCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "delete from cart_coupons where user_id = $1", userID); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("removing coupon", "err", err)
+		return
+	}
+	getCartSummary(w, r)
+}
+
+func loadCouponLines(ctx context.Context, userID int) ([]couponLine, error) {
+	rows, err := db.QueryContext(ctx, "select products.id, products.category, products.price, cart.quantity from cart join products on products.id = cart.product_id where cart.user_id = $1 order by cart.id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []couponLine
+	for rows.Next() {
+		var l couponLine
+		if err := rows.Scan(&l.productID, &l.category, &l.price, &l.quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+func getCoupons(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage coupons", http.StatusForbidden)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select "+couponColumns+" from coupons order by id")
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing coupons", "err", err)
+		return
+	}
+	defer rows.Close()
+	coupons := []Coupon{}
+	for rows.Next() {
+		var c Coupon
+		if err := rows.Scan(c.scanArgs()...); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning coupon", "err", err)
+			return
+		}
+		coupons = append(coupons, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupons)
+}
+
+func postCoupon(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage coupons", http.StatusForbidden)
+		return
+	}
+	var in CouponInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := Coupon{
+		Code: normalizeCouponCode(in.Code), Kind: in.Kind, Value: in.Value, MinTotal: in.MinTotal,
+		StartsAt: in.StartsAt, EndsAt: in.EndsAt, MaxUses: in.MaxUses, MaxUsesPerUser: in.MaxUsesPerUser,
+		ProductIDs: in.ProductIDs, Categories: in.Categories, Active: true,
+	}
+	if c.ProductIDs == nil {
+		c.ProductIDs = []int64{}
+	}
+	if c.Categories == nil {
+		c.Categories = []string{}
+	}
+	err := db.QueryRowContext(r.Context(), "insert into coupons (code, kind, value, min_total, starts_at, ends_at, max_uses, max_uses_per_user, product_ids, categories) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) returning id, created_at",
+		c.Code, c.Kind, c.Value, c.MinTotal, c.StartsAt, c.EndsAt, c.MaxUses, c.MaxUsesPerUser, pq.Array(c.ProductIDs), pq.Array(c.Categories)).Scan(&c.ID, &c.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "coupon code already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("inserting coupon", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteCoupon deactivates a coupon. It stays on record because orders
+// refer to its redemptions.
+func deleteCoupon(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage coupons", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "update coupons set active = false where id = $1", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deactivating coupon", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "coupon not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deactivated successfully!",
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestApplyCoupon(t *testing.T) {
+	now := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	earlier, later := now.Add(-time.Hour), now.Add(time.Hour)
+	cart := []couponLine{
+		{productID: 1, category: "kitchen", price: 500, quantity: 2},
+		{productID: 2, category: "kitchen", price: 333, quantity: 1},
+		{productID: 3, category: "clothes", price: 1500, quantity: 1},
+	}
+	cases := []struct {
+		name     string
+		coupon   Coupon
+		inactive bool
+		userUses int
+		discount int
+		lines    []int
+		free     bool
+		err      string
+	}{
+		{name: "percent of the whole cart", coupon: Coupon{Kind: couponPercent, Value: 10},
+			discount: 283, lines: []int{99, 33, 151}},
+		{name: "percent of a category", coupon: Coupon{Kind: couponPercent, Value: 50, Categories: []string{"kitchen"}},
+			discount: 666, lines: []int{499, 167, 0}},
+		{name: "fixed on one product", coupon: Coupon{Kind: couponFixed, Value: 200, ProductIDs: []int64{3}},
+			discount: 200, lines: []int{0, 0, 200}},
+		{name: "fixed is capped at the eligible lines", coupon: Coupon{Kind: couponFixed, Value: 5000, ProductIDs: []int64{2}},
+			discount: 333, lines: []int{0, 333, 0}},
+		{name: "free shipping", coupon: Coupon{Kind: couponFreeShipping},
+			lines: []int{0, 0, 0}, free: true},
+		{name: "within its window", coupon: Coupon{Kind: couponFixed, Value: 100, StartsAt: &earlier, EndsAt: &later},
+			discount: 100, lines: []int{35, 11, 54}},
+		{name: "not started", coupon: Coupon{Kind: couponFixed, Value: 100, StartsAt: &later},
+			err: "X is not valid yet"},
+		{name: "expired", coupon: Coupon{Kind: couponFixed, Value: 100, EndsAt: &now},
+			err: "X has expired"},
+		{name: "used up", coupon: Coupon{Kind: couponFixed, Value: 100, MaxUses: 5, Uses: 5},
+			err: "X has been used up"},
+		{name: "used by this customer", coupon: Coupon{Kind: couponFixed, Value: 100, MaxUsesPerUser: 1}, userUses: 1,
+			err: "you have already used X"},
+		{name: "below the minimum", coupon: Coupon{Kind: couponFixed, Value: 100, MinTotal: 5000},
+			err: "X needs an order of at least 5000"},
+		{name: "nothing eligible", coupon: Coupon{Kind: couponPercent, Value: 10, Categories: []string{"toys"}},
+			err: "X doesn't apply to anything in your cart"},
+		{name: "deactivated", coupon: Coupon{Kind: couponPercent, Value: 10}, inactive: true,
+			err: "X is no longer available"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.coupon.Code = "X"
+			tc.coupon.Active = !tc.inactive
+			res, err := applyCoupon(tc.coupon, cart, tc.userUses, now)
+			if tc.err != "" {
+				if !errors.Is(err, errCouponInvalid) || err.Error() != errCouponInvalid.Error()+": "+tc.err {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Discount != tc.discount || res.FreeShipping != tc.free || fmt.Sprint(res.Lines) != fmt.Sprint(tc.lines) {
+				t.Errorf("got %+v, want discount %d, lines %v, free shipping %v", res, tc.discount, tc.lines, tc.free)
+			}
+		})
+	}
+}
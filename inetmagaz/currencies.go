@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// acceptCurrencyHeader picks the currency of prices in product responses
+// when there's no currency query parameter.
+const acceptCurrencyHeader = "Accept-Currency"
+
+var errCurrencyUnavailable = errors.New("currency not available")
+
+// ExchangeRate is how many units of Currency one unit of the shop currency
+// buys.
+type ExchangeRate struct {
+	Currency  string    `json:"currency"`
+	Rate      float64   `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ExchangeRateInput struct {
+	Rate float64 `json:"rate"`
+}
+
+// ProductPrice is a product's price set by hand in a currency other than
+// the shop's.
+type ProductPrice struct {
+	Currency string `json:"currency"`
+	Price    Money  `json:"price"`
+}
+
+type ProductPriceInput struct {
+	Price Money `json:"price"`
+}
+
+// parseCurrency normalises an ISO 4217 code; empty means the shop currency.
+func parseCurrency(c string) (string, error) {
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if c == "" {
+		return shopCurrency, nil
+	}
+	if _, ok := currencyDigits[c]; !ok {
+		return "", fmt.Errorf("unsupported currency %q", c)
+	}
+	return c, nil
+}
+
+// foreignCurrency is parseCurrency for things only other currencies have,
+// like exchange rates and price overrides.
+func foreignCurrency(c string) (string, error) {
+	c, err := parseCurrency(c)
+	if err == nil && c == shopCurrency {
+		err = fmt.Errorf("%s is the shop currency", c)
+	}
+	return c, err
+}
+
+// requestCurrency is the currency a client asked for with ?currency= or
+// Accept-Currency, taking the first entry of the header and ignoring
+// weights. With neither it's the shop currency.
+func requestCurrency(r *http.Request) (string, error) {
+	c := r.URL.Query().Get("currency")
+	if c == "" {
+		c, _, _ = strings.Cut(r.Header.Get(acceptCurrencyHeader), ",")
+		c, _, _ = strings.Cut(c, ";")
+	}
+	return parseCurrency(c)
+}
+
+// pricing turns shop prices into the currency a customer sees and pays in.
+type pricing struct {
+	Currency string
+	Rate     float64
+}
+
+func pricingFor(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, currency string) (pricing, error) {
+	p := pricing{Currency: currency, Rate: 1}
+	if currency == shopCurrency {
+		return p, nil
+	}
+	err := q.QueryRowContext(ctx, "select rate from exchange_rates where currency = $1", currency).Scan(&p.Rate)
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("%w: there is no exchange rate for %s", errCurrencyUnavailable, currency)
+	}
+	return p, err
+}
+
+// convert converts an amount in the shop currency at p's rate.
+func (p pricing) convert(m Money) (Money, error) {
+	if m.Currency == p.Currency {
+		return m, nil
+	}
+	return m.Convert(p.Currency, p.Rate)
+}
+
+// price is a product's price: its override in p's currency if it has one,
+// or its shop price converted.
+func (p pricing) price(shop Money, override *int) (Money, error) {
+	if override != nil {
+		return Money{Amount: *override, Currency: p.Currency}, nil
+	}
+	return p.convert(shop)
+}
+
+// toShop converts an amount in p's currency back to the shop currency, for
+// comparing with thresholds set there.
+func (p pricing) toShop(m Money) (Money, error) {
+	if m.Currency == shopCurrency {
+		return m, nil
+	}
+	return m.Convert(shopCurrency, 1/p.Rate)
+}
+
+// coupon converts the amounts of a coupon, which are set in the shop
+// currency.
+func (p pricing) coupon(c Coupon) (Coupon, error) {
+	minTotal, err := p.convert(money(c.MinTotal))
+	if err != nil {
+		return c, err
+	}
+	c.MinTotal = minTotal.Amount
+	if c.Kind == couponFixed {
+		v, err := p.convert(money(c.Value))
+		if err != nil {
+			return c, err
+		}
+		c.Value = v.Amount
+	}
+	return c, nil
+}
+
+// productPricing is the pricing a product request asked for. It writes the
+// error response and returns false when there is none.
+func productPricing(w http.ResponseWriter, r *http.Request) (pricing, bool) {
+	w.Header().Add("Vary", acceptCurrencyHeader)
+	c, err := requestCurrency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return pricing{}, false
+	}
+	p, err := pricingFor(r.Context(), db, c)
+	if errors.Is(err, errCurrencyUnavailable) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return p, false
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading exchange rate", "currency", c, "err", err)
+		return p, false
+	}
+	return p, true
+}
+
+func validRate(rate float64) error {
+	if math.IsNaN(rate) || rate <= 0 || rate >= 1e12 {
+		return fmt.Errorf("rate must be a positive number below 1e12")
+	}
+	return nil
+}
+
+func saveExchangeRate(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, currency string, rate float64) (ExchangeRate, error) {
+	e := ExchangeRate{Currency: currency}
+	err := q.QueryRowContext(ctx, "insert into exchange_rates (currency, rate) values ($1,$2) on conflict (currency) do update set rate = excluded.rate, updated_at = now() returning rate, updated_at",
+		currency, rate).Scan(&e.Rate, &e.UpdatedAt)
+	return e, err
+}
+
+// importExchangeRates saves currency,rate CSV records from in, all or none.
+// A header line and # comments are skipped. It returns how many rates it
+// saved.
+func importExchangeRates(ctx context.Context, in io.Reader) (int, error) {
+	cr := csv.NewReader(in)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n := 0
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		if n == 0 && strings.EqualFold(rec[0], "currency") {
+			continue
+		}
+		currency, err := foreignCurrency(rec[0])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err == nil {
+			err = validRate(rate)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		if _, err := saveExchangeRate(ctx, tx, currency, rate); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, tx.Commit()
+}
+
+// getExchangeRates lists the currencies besides the shop's that products
+// can be shown and bought in.
+func getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "select currency, rate, updated_at from exchange_rates order by currency")
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing exchange rates", "err", err)
+		return
+	}
+	defer rows.Close()
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var e ExchangeRate
+		if err := rows.Scan(&e.Currency, &e.Rate, &e.UpdatedAt); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning exchange rate", "err", err)
+			return
+		}
+		rates = append(rates, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// putExchangeRate sets a currency's rate. Orders already placed keep the
+// rate they were converted at.
+func putExchangeRate(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage exchange rates", http.StatusForbidden)
+		return
+	}
+	currency, err := foreignCurrency(chi.URLParam(r, "currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var in ExchangeRateInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validRate(in.Rate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e, err := saveExchangeRate(r.Context(), db, currency, in.Rate)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("saving exchange rate", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// deleteExchangeRate stops selling in a currency.
+func deleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage exchange rates", http.StatusForbidden)
+		return
+	}
+	currency, err := foreignCurrency(chi.URLParam(r, "currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "delete from exchange_rates where currency = $1", currency)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting exchange rate", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "exchange rate not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully!",
+	})
+}
+
+func getProductPrices(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage prices", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select currency, price from product_prices where product_id = $1 order by currency", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing product prices", "err", err)
+		return
+	}
+	defer rows.Close()
+	prices := []ProductPrice{}
+	for rows.Next() {
+		var p ProductPrice
+		if err := rows.Scan(&p.Currency, &p.Price); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning product price", "err", err)
+			return
+		}
+		inCurrency(p.Currency, &p.Price)
+		prices = append(prices, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prices)
+}
+
+// putProductPrice sets a product's price in a currency instead of
+// converting its shop price.
+func putProductPrice(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage prices", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	currency, err := foreignCurrency(chi.URLParam(r, "currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var in ProductPriceInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if in.Price.Amount < 0 {
+		http.Error(w, "price can't be negative", http.StatusBadRequest)
+		return
+	}
+	_, err = db.ExecContext(r.Context(), "insert into product_prices (product_id, currency, price) values ($1,$2,$3) on conflict (product_id, currency) do update set price = excluded.price",
+		id, currency, in.Price)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("saving product price", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProductPrice{Currency: currency, Price: Money{Amount: in.Price.Amount, Currency: currency}})
+}
+
+// deleteProductPrice goes back to converting the shop price.
+func deleteProductPrice(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage prices", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	currency, err := foreignCurrency(chi.URLParam(r, "currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "delete from product_prices where product_id = $1 and currency = $2", id, currency)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting product price", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "price not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully!",
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const readyTimeout = 2 * time.Second
+
+// healthz reports that the process is up. It does not touch the database so
+// a slow PostgreSQL doesn't get the pod restarted.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// readyz reports whether the service can take traffic: the database answers
+// within readyTimeout and its schema is at the version this binary expects.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	resp := map[string]any{"status": "ok"}
+	status := http.StatusOK
+	if err := db.PingContext(ctx); err != nil {
+		resp["status"] = "unavailable"
+		resp["database"] = err.Error()
+		status = http.StatusServiceUnavailable
+	} else if v, err := schemaVersion(ctx, db); err != nil {
+		resp["status"] = "unavailable"
+		resp["database"] = err.Error()
+		status = http.StatusServiceUnavailable
+	} else {
+		want := latestMigration()
+		resp["schema_version"] = v
+		if v != want {
+			resp["status"] = "unavailable"
+			resp["expected_schema_version"] = want
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
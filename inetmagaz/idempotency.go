@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+	// idempotencyWindow is how long a key is remembered. A retry after
+	// that runs the request again.
+	idempotencyWindow = 24 * time.Hour
+	// maxIdempotentBody is the largest body that is buffered and hashed.
+	// Larger requests are refused rather than hashed by their prefix.
+	maxIdempotentBody = 1 << 20
+)
+
+// idempotencyRecorder passes a response through and keeps a copy so it can
+// be replayed.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Idempotency makes mutating requests that carry an Idempotency-Key safe to
+// retry. The first request with a key runs and its response is stored;
+// retries with the same key and body within idempotencyWindow get that
+// response back instead of running again. Reusing a key for a different
+// request is a 422, and retrying while the first is still running a 409.
+// Keys are scoped to the user, so it must run after AuthMiddleware.
+// Server errors aren't stored, so those can be retried with the same key.
+func Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		username, _ := r.Context().Value(usernameKey).(string)
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			http.Error(w, "requests with an Idempotency-Key are limited to 1 MiB", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		claimed, err := claimIdempotencyKey(r.Context(), username, key, hash)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("claiming idempotency key", "err", err)
+			return
+		}
+		if !claimed {
+			replayIdempotent(w, r, username, key, hash)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		stored := false
+		defer func() {
+			// Give the key back if the handler panicked or failed, so a retry
+			// runs the request instead of waiting on a response that never
+			// comes.
+			if !stored {
+				ctx := context.WithoutCancel(r.Context())
+				if _, err := db.ExecContext(ctx, "delete from idempotency_keys where username = $1 and key = $2", username, key); err != nil {
+					loggerFrom(ctx).Error("releasing idempotency key", "err", err)
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= 500 {
+			return
+		}
+		// The client may be gone by now, but what the handler did stands and
+		// a retry must get its response back.
+		ctx := context.WithoutCancel(r.Context())
+		_, err = db.ExecContext(ctx, "update idempotency_keys set status = $1, content_type = $2, body = $3 where username = $4 and key = $5",
+			rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), username, key)
+		if err != nil {
+			loggerFrom(ctx).Error("storing idempotent response", "err", err)
+			return
+		}
+		stored = true
+	})
+}
+
+// claimIdempotencyKey records key as in progress. It reports false if the
+// key is already taken within the window.
+func claimIdempotencyKey(ctx context.Context, username, key, hash string) (bool, error) {
+	_, err := db.ExecContext(ctx, "delete from idempotency_keys where username = $1 and key = $2 and created_at < $3", username, key, time.Now().Add(-idempotencyWindow))
+	if err != nil {
+		return false, err
+	}
+	res, err := db.ExecContext(ctx, "insert into idempotency_keys (username, key, request_hash) values ($1,$2,$3) on conflict do nothing", username, key, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func replayIdempotent(w http.ResponseWriter, r *http.Request, username, key, hash string) {
+	var storedHash, contentType string
+	var status sql.NullInt64
+	var body []byte
+	err := db.QueryRowContext(r.Context(), "select request_hash, status, content_type, body from idempotency_keys where username = $1 and key = $2", username, key).
+		Scan(&storedHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// The first request failed and released the key in between.
+		http.Error(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading idempotent response", "err", err)
+		return
+	}
+	if storedHash != hash {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		http.Error(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set(replayedHeader, "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+// sweepIdempotencyKeys deletes expired keys every hour until ctx is done.
+func sweepIdempotencyKeys(ctx context.Context) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := db.ExecContext(ctx, "delete from idempotency_keys where created_at < $1", time.Now().Add(-idempotencyWindow)); err != nil {
+				loggerFrom(ctx).Error("sweeping idempotency keys", "err", err)
+			}
+		}
+	}
+}
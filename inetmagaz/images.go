@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxImageBytes      = 10 << 20
+	maxImagePixels     = 24_000_000
+	maxImagesPerUpload = 10
+)
+
+// thumbnailSizes are the longest sides, in pixels, thumbnails are made at.
+var thumbnailSizes = []int{160, 480, 1200}
+
+// imageTypes are the upload types accepted, by sniffed content type, with
+// the extension they're stored under.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var (
+	errUnsupportedImage = errors.New("images must be JPEG, PNG or GIF")
+	errImageTooLarge    = errors.New("image is too large")
+)
+
+// ProductImage is an uploaded image. URL is the original; Thumbnails maps
+// a size from thumbnailSizes to the URL of a copy no larger than that.
+type ProductImage struct {
+	ID          int               `json:"id"`
+	ProductID   int               `json:"product_id"`
+	Position    int               `json:"position"`
+	URL         string            `json:"url"`
+	ContentType string            `json:"content_type"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+	CreatedAt   time.Time         `json:"created_at"`
+
+	key       string
+	thumbKeys blobKeys
+}
+
+type ImageOrder struct {
+	IDs []int `json:"ids"`
+}
+
+// blobKeys maps thumbnail sizes to blob keys, stored as jsonb.
+type blobKeys map[string]string
+
+func (k blobKeys) Value() (driver.Value, error) {
+	if k == nil {
+		k = blobKeys{}
+	}
+	return json.Marshal(k)
+}
+
+func (k *blobKeys) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, k)
+	case string:
+		return json.Unmarshal([]byte(v), k)
+	}
+	return fmt.Errorf("cannot scan %T into blobKeys", src)
+}
+
+// resolve fills in the URLs from the blob keys.
+func (img *ProductImage) resolve() {
+	img.URL = blobs.URL(img.key)
+	img.Thumbnails = make(map[string]string, len(img.thumbKeys))
+	for size, key := range img.thumbKeys {
+		img.Thumbnails[size] = blobs.URL(key)
+	}
+}
+
+// keys are every blob the image is stored as.
+func (img ProductImage) keys() []string {
+	keys := []string{img.key}
+	for _, k := range img.thumbKeys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// upload is an image checked and thumbnailed, ready to store.
+type upload struct {
+	contentType   string
+	ext           string
+	width, height int
+	data          []byte
+	thumbType     string
+	thumbExt      string
+	thumbs        map[int][]byte
+}
+
+// processImage sniffs data's type rather than trusting the client's, checks
+// its dimensions before decoding it in full, and makes the thumbnails.
+func processImage(data []byte) (upload, error) {
+	u := upload{contentType: http.DetectContentType(data), data: data, thumbs: map[int][]byte{}}
+	ext, ok := imageTypes[u.contentType]
+	if !ok {
+		return u, errUnsupportedImage
+	}
+	u.ext = ext
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return u, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return u, fmt.Errorf("%w: %dx%d is over %d megapixels", errImageTooLarge, cfg.Width, cfg.Height, maxImagePixels/1_000_000)
+	}
+	u.width, u.height = cfg.Width, cfg.Height
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return u, err
+	}
+
+	// Photos stay JPEG; anything that may be transparent becomes PNG.
+	u.thumbType, u.thumbExt = "image/png", ".png"
+	if u.contentType == "image/jpeg" {
+		u.thumbType, u.thumbExt = "image/jpeg", ".jpg"
+	}
+	src := image.NewRGBA(image.Rect(0, 0, u.width, u.height))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, size := range thumbnailSizes {
+		var buf bytes.Buffer
+		thumb := fitWithin(src, size)
+		if u.thumbType == "image/jpeg" {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return u, err
+		}
+		u.thumbs[size] = buf.Bytes()
+	}
+	return u, nil
+}
+
+// fitWithin scales src down, keeping its aspect ratio, so neither side is
+// over size pixels. Each pixel is the average of the source pixels it
+// covers. Images that already fit are returned as they are.
+func fitWithin(src *image.RGBA, size int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, max(1, h*size/w)
+	if h > w {
+		dw, dh = max(1, w*size/h), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				d[i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// deleteBlobs removes blobs no longer referred to. Failures only leave
+// garbage behind, so they're logged rather than returned.
+func deleteBlobs(ctx context.Context, keys []string) {
+	for _, k := range keys {
+		if err := blobs.Delete(ctx, k); err != nil {
+			loggerFrom(ctx).Warn("deleting blob", "key", k, "err", err)
+		}
+	}
+}
+
+// saveProductImages stores uploads after the product's existing images.
+// The blobs are written first and removed again if the rows can't be; the
+// first image a product gets becomes its products.image. It returns
+// sql.ErrNoRows if the product doesn't exist.
+func saveProductImages(ctx context.Context, productID int, uploads []upload) ([]ProductImage, error) {
+	imgs := make([]ProductImage, len(uploads))
+	var written []string
+	saved := false
+	defer func() {
+		if !saved {
+			deleteBlobs(context.WithoutCancel(ctx), written)
+		}
+	}()
+	for i, u := range uploads {
+		dir := fmt.Sprintf("products/%d/%s", productID, randomID(""))
+		img := ProductImage{ProductID: productID, ContentType: u.contentType, Width: u.width, Height: u.height,
+			key: dir + "/original" + u.ext, thumbKeys: blobKeys{}}
+		if err := blobs.Put(ctx, img.key, u.data, u.contentType); err != nil {
+			return nil, err
+		}
+		written = append(written, img.key)
+		for _, size := range thumbnailSizes {
+			key := fmt.Sprintf("%s/%d%s", dir, size, u.thumbExt)
+			if err := blobs.Put(ctx, key, u.thumbs[size], u.thumbType); err != nil {
+				return nil, err
+			}
+			written = append(written, key)
+			img.thumbKeys[strconv.Itoa(size)] = key
+		}
+		imgs[i] = img
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRowContext(ctx, "select id from products where id = $1 for update", productID).Scan(&productID); err != nil {
+		return nil, err
+	}
+	var next int
+	if err := tx.QueryRowContext(ctx, "select coalesce(max(position) + 1, 0) from product_images where product_id = $1", productID).Scan(&next); err != nil {
+		return nil, err
+	}
+	for i := range imgs {
+		img := &imgs[i]
+		img.Position = next + i
+		err := tx.QueryRowContext(ctx, "insert into product_images (product_id, position, key, content_type, width, height, thumbnails) values ($1,$2,$3,$4,$5,$6,$7) returning id, created_at",
+			productID, img.Position, img.key, img.ContentType, img.Width, img.Height, img.thumbKeys).Scan(&img.ID, &img.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		img.resolve()
+	}
+	if next == 0 {
+		if _, err := tx.ExecContext(ctx, "update products set image = $2 where id = $1", productID, imgs[0].URL); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	saved = true
+	return imgs, nil
+}
+
+func loadProductImages(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}, productID int) ([]ProductImage, error) {
+	rows, err := q.QueryContext(ctx, "select id, product_id, position, key, content_type, width, height, thumbnails, created_at from product_images where product_id = $1 order by position, id", productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imgs := []ProductImage{}
+	for rows.Next() {
+		var img ProductImage
+		if err := rows.Scan(&img.ID, &img.ProductID, &img.Position, &img.key, &img.ContentType, &img.Width, &img.Height, &img.thumbKeys, &img.CreatedAt); err != nil {
+			return nil, err
+		}
+		img.resolve()
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
+
+// postProductImages takes one or more files in the image field of a
+// multipart form.
+func postProductImages(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can upload images", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	// Up to 100 MiB doesn't arrive within the server's ReadTimeout on a
+	// slow connection.
+	allowLongTransfer(w, r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxImagesPerUpload*maxImageBytes+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+	var uploads []upload
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var data []byte
+		if err == nil {
+			if part.FormName() != "image" {
+				part.Close()
+				continue
+			}
+			if len(uploads) == maxImagesPerUpload {
+				http.Error(w, fmt.Sprintf("at most %d images per upload", maxImagesPerUpload), http.StatusBadRequest)
+				return
+			}
+			data, err = io.ReadAll(io.LimitReader(part, maxImageBytes+1))
+		}
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) || len(data) > maxImageBytes {
+			http.Error(w, fmt.Sprintf("images must be at most %d MiB", maxImageBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		u, err := processImage(data)
+		if errors.Is(err, errUnsupportedImage) {
+			http.Error(w, part.FileName()+": "+err.Error(), http.StatusUnsupportedMediaType)
+			return
+		} else if errors.Is(err, errImageTooLarge) {
+			http.Error(w, part.FileName()+": "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, part.FileName()+": can't read the image", http.StatusBadRequest)
+			return
+		}
+		uploads = append(uploads, u)
+	}
+	if len(uploads) == 0 {
+		http.Error(w, "no files in the image field", http.StatusBadRequest)
+		return
+	}
+	imgs, err := saveProductImages(r.Context(), id, uploads)
+	if err == sql.ErrNoRows {
+		http.Error(w, "product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("saving product images", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(imgs)
+}
+
+func getProductImages(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	imgs, err := loadProductImages(r.Context(), db, id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing product images", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imgs)
+}
+
+// putProductImageOrder reorders a product's images. ids must list every
+// image once; the first becomes products.image.
+func putProductImageOrder(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage images", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	var in ImageOrder
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRowContext(r.Context(), "select id from products where id = $1 for update", id).Scan(&id); err == sql.ErrNoRows {
+		http.Error(w, "product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("locking product", "err", err)
+		return
+	}
+	imgs, err := loadProductImages(r.Context(), tx, id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing product images", "err", err)
+		return
+	}
+	byID := map[int]ProductImage{}
+	for _, img := range imgs {
+		byID[img.ID] = img
+	}
+	ordered := make([]ProductImage, 0, len(in.IDs))
+	for _, imageID := range in.IDs {
+		img, ok := byID[imageID]
+		if !ok {
+			http.Error(w, "ids must list each of the product's images once", http.StatusBadRequest)
+			return
+		}
+		delete(byID, imageID)
+		ordered = append(ordered, img)
+	}
+	if len(byID) > 0 {
+		http.Error(w, "ids must list each of the product's images once", http.StatusBadRequest)
+		return
+	}
+	for i := range ordered {
+		ordered[i].Position = i
+		if _, err := tx.ExecContext(r.Context(), "update product_images set position = $1 where id = $2", i, ordered[i].ID); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("reordering product images", "err", err)
+			return
+		}
+	}
+	if len(ordered) > 0 {
+		if _, err := tx.ExecContext(r.Context(), "update products set image = $2 where id = $1", id, ordered[0].URL); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("updating product image", "err", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ordered)
+}
+
+// deleteProductImage removes an image and its blobs. If it was the one in
+// products.image, the next image takes its place there.
+func deleteProductImage(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage images", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var img ProductImage
+	err = tx.QueryRowContext(r.Context(), "delete from product_images where id = $1 and product_id = $2 returning key, thumbnails", imageID, id).Scan(&img.key, &img.thumbKeys)
+	if err == sql.ErrNoRows {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting product image", "err", err)
+		return
+	}
+	rest, err := loadProductImages(r.Context(), tx, id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing product images", "err", err)
+		return
+	}
+	next := ""
+	if len(rest) > 0 {
+		next = rest[0].URL
+	}
+	if _, err := tx.ExecContext(r.Context(), "update products set image = $2 where id = $1 and image = $3", id, next, blobs.URL(img.key)); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("updating product image", "err", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	deleteBlobs(r.Context(), img.keys())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully!",
+	})
+}
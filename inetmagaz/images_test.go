@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testPNG encodes a w×h image that's red on the left and blue on the right.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFitWithin(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		src.SetRGBA(x, 0, color.RGBA{uint8(x * 60), 0, 0, 255})
+		src.SetRGBA(x, 1, color.RGBA{uint8(x*60 + 20), 0, 0, 255})
+	}
+	got := fitWithin(src, 2)
+	if b := got.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("size = %v, want 2x1", b)
+	}
+	// Each pixel averages a 2x2 block: (0+60+20+80)/4 and (120+180+140+200)/4.
+	if r := got.RGBAAt(0, 0).R; r != 40 {
+		t.Errorf("left = %d, want 40", r)
+	}
+	if r := got.RGBAAt(1, 0).R; r != 160 {
+		t.Errorf("right = %d, want 160", r)
+	}
+	if fitWithin(src, 10) != src {
+		t.Error("an image that fits was scaled")
+	}
+	tall := fitWithin(image.NewRGBA(image.Rect(0, 0, 30, 3000)), 100)
+	if b := tall.Bounds(); b.Dx() != 1 || b.Dy() != 100 {
+		t.Errorf("tall size = %v, want 1x100", b)
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	u, err := processImage(testPNG(t, 2000, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.contentType != "image/png" || u.width != 2000 || u.height != 1000 || u.thumbType != "image/png" {
+		t.Errorf("upload = %s %dx%d, thumbnails %s", u.contentType, u.width, u.height, u.thumbType)
+	}
+	for _, size := range thumbnailSizes {
+		cfg, err := png.DecodeConfig(bytes.NewReader(u.thumbs[size]))
+		if err != nil {
+			t.Fatalf("thumbnail %d: %v", size, err)
+		}
+		if cfg.Width != size || cfg.Height != size/2 {
+			t.Errorf("thumbnail %d is %dx%d", size, cfg.Width, cfg.Height)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200)), nil); err != nil {
+		t.Fatal(err)
+	}
+	u, err = processImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ext != ".jpg" || u.thumbType != "image/jpeg" {
+		t.Errorf("jpeg upload = %s, thumbnails %s", u.ext, u.thumbType)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(u.thumbs[160])); err != nil || cfg.Width != 160 || cfg.Height != 106 {
+		t.Errorf("jpeg thumbnail = %+v, %v", cfg, err)
+	}
+
+	if _, err := processImage([]byte("<svg xmlns='http://www.w3.org/2000/svg'/>")); !errors.Is(err, errUnsupportedImage) {
+		t.Errorf("svg: %v", err)
+	}
+	// A header claiming 100000x100000 is refused before any pixels are read.
+	huge := testPNG(t, 1, 1)
+	copy(huge[16:24], []byte{0, 1, 0x86, 0xa0, 0, 1, 0x86, 0xa0})
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := processImage(huge); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("huge: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const (
+	requestIDKey contextKey = "request_id"
+	loggerKey    contextKey = "logger"
+	logUserKey   contextKey = "log_user"
+)
+
+// setupLogging installs a JSON slog handler as the default, so plain
+// log.Print calls end up in the same structured stream. LOG_LEVEL accepts
+// debug, info, warn or error.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+// loggerFrom returns the request-scoped logger stored by RequestLogger, or
+// the default logger outside a request.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID takes X-Request-ID from the client (or generates one), echoes it
+// in the response and stores it in the request context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// logUser lets AuthMiddleware, which runs further down the chain, report the
+// authenticated username back to RequestLogger.
+type logUser struct {
+	name string
+}
+
+// setLogUser records the authenticated user for the access log and returns a
+// context whose logger carries the username.
+func setLogUser(ctx context.Context, username string) context.Context {
+	if u, ok := ctx.Value(logUserKey).(*logUser); ok {
+		u.name = username
+	}
+	return withLogger(ctx, loggerFrom(ctx).With("username", username))
+}
+
+// RequestLogger writes one JSON access log line per request and makes a
+// logger tagged with the request id available through loggerFrom.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := slog.Default().With("request_id", requestIDFrom(r.Context()))
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = l.With("trace_id", sc.TraceID().String())
+		}
+		user := &logUser{}
+		ctx := withLogger(r.Context(), l)
+		ctx = context.WithValue(ctx, logUserKey, user)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				l.Error("panic", "panic", p)
+				if rec.status == 0 {
+					http.Error(rec, "Internal server error", http.StatusInternalServerError)
+				}
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			attrs := []any{
+				"method", r.Method,
+				"route", routePattern(r),
+				"path", r.URL.Path,
+				"status", rec.status,
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"bytes", rec.bytes,
+			}
+			if user.name != "" {
+				attrs = append(attrs, "username", user.name)
+			}
+			l.Info("request", attrs...)
+		}()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
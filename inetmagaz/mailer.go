@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, m Email) error
+}
+
+var mailer Mailer
+
+// newMailer picks the transport from MAILER: "file" (the default) drops
+// messages into MAIL_DIR, "smtp" sends through SMTP_ADDR with optional
+// SMTP_USERNAME/SMTP_PASSWORD. MAIL_FROM is the sender.
+func newMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "shop@localhost"
+	}
+	switch t := os.Getenv("MAILER"); t {
+	case "", "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return fileMailer{dir: dir, from: from}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR: %w", err)
+		}
+		m := smtpMailer{addr: addr, from: from}
+		if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", t)
+	}
+}
+
+// buildMessage renders m as a multipart/alternative RFC 5322 message.
+func buildMessage(from string, m Email) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		if part.content == "" {
+			continue
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte(part.content))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (s smtpMailer) Send(ctx context.Context, m Email) error {
+	msg, err := buildMessage(s.from, m)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, msg)
+}
+
+// fileMailer writes each message to dir as an .eml file, for development
+// and tests.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (f fileMailer) Send(ctx context.Context, m Email) error {
+	msg, err := buildMessage(f.from, m)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomID(""))
+	return os.WriteFile(filepath.Join(f.dir, name), msg, 0o644)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -24,6 +25,10 @@ type contextKey string
 
 const usernameKey contextKey = "username"
 
+// tokenExpiresKey holds when the request's token expires, for responses
+// that outlive the request, like event streams.
+const tokenExpiresKey contextKey = "token_expires"
+
 type RegistrationRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -65,11 +70,11 @@ func getProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var user ProfileRequest
-	row := db.QueryRow("select username, email, role from users where username = $1", username)
+	row := db.QueryRowContext(r.Context(), "select username, email, role from users where username = $1", username)
 	err := row.Scan(&user.Username, &user.Email, &user.Role)
 	if err != nil {
 		http.Error(w, "invalid data", http.StatusInternalServerError)
-		log.Panic(err)
+		loggerFrom(r.Context()).Error("loading profile", "err", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -88,17 +93,19 @@ func Registration(w http.ResponseWriter, r *http.Request) {
 	}
 	hashed, err := HashPassword(req.Password)
 	if err != nil {
-		log.Panic(err)
-		log.Print("something with hash")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("hashing password", "err", err)
+		return
 	}
-	_, err = db.Exec("insert into users (username,password_hash,email, role) values ($1,$2,$3,$4)", req.Username, hashed, req.Email, req.Role)
+	_, err = db.ExecContext(r.Context(), "insert into users (username,password_hash,email, role) values ($1,$2,$3,$4)", req.Username, hashed, req.Email, req.Role)
 	if err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
 			http.Error(w, "Username or email already exists", http.StatusConflict)
 			return
 		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Panic(err)
+		loggerFrom(r.Context()).Error("inserting user", "err", err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -118,7 +125,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid RequestBody", http.StatusBadRequest)
 		return
 	}
-	row := db.QueryRow("select username, password_hash from users where username = $1 or email = $1", req.NameorEmail)
+	row := db.QueryRowContext(r.Context(), "select username, password_hash from users where username = $1 or email = $1", req.NameorEmail)
 
 	var password string
 	var username string
@@ -145,6 +152,26 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// currentUserID looks up the id of the user authenticated by AuthMiddleware.
+func currentUserID(r *http.Request) (int, error) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		return 0, errors.New("no username in context")
+	}
+	var id int
+	err := db.QueryRowContext(r.Context(), "select id from users where username = $1", username).Scan(&id)
+	return id, err
+}
+
+// isAdmin reports whether the user authenticated by AuthMiddleware is an
+// admin.
+func isAdmin(r *http.Request) (bool, error) {
+	var role string
+	err := db.QueryRowContext(r.Context(), "select role from users where username = $1", r.Context().Value(usernameKey)).Scan(&role)
+	return role == "admin", err
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -168,6 +195,10 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		ctx := context.WithValue(r.Context(), usernameKey, username)
+		if exp, ok := claims["exp"].(float64); ok {
+			ctx = context.WithValue(ctx, tokenExpiresKey, time.Unix(int64(exp), 0))
+		}
+		ctx = setLogUser(ctx, username)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -175,12 +206,17 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 func main() {
 	godotenv.Load()
+	setupLogging()
 
 	jwt_key = []byte(os.Getenv("JWT"))
 	var err error
 
 	connStr := os.Getenv("DATABASE_URL")
-	db, err = sql.Open("postgres", connStr)
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal("tracing setup failed ", err)
+	}
+	db, err = openDB(connStr)
 	if err != nil {
 		log.Panic(err)
 		log.Print("Something with db")
@@ -188,41 +224,85 @@ func main() {
 	if err = db.Ping(); err != nil {
 		log.Fatal("DB is unreachable ", err)
 	}
-	defer db.Close()
+	if err = setupCurrency(); err != nil {
+		log.Fatal("currency setup failed ", err)
+	}
+	if err = migrate(context.Background(), db); err != nil {
+		log.Fatal("migrations failed ", err)
+	}
+	registerDBMetrics()
+	// Commands import, export and purge products, which need these.
+	if err = setupTax(); err != nil {
+		log.Fatal("tax setup failed ", err)
+	}
+	if blobs, err = newBlobStore(); err != nil {
+		log.Fatal("blob store setup failed ", err)
+	}
+	if len(os.Args) > 1 {
+		if err = runCommand(context.Background(), os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if payments, err = newPaymentProvider(); err != nil {
+		log.Fatal("payment provider setup failed ", err)
+	}
+	if mailer, err = newMailer(); err != nil {
+		log.Fatal("mailer setup failed ", err)
+	}
+	if err = setupShippingProviders(); err != nil {
+		log.Fatal("shipping rate provider setup failed ", err)
+	}
+	goWorker(sweepIdempotencyKeys)
+	goWorker(runOutboxDispatcher)
+	goWorker(runWebhookDispatcher)
+	goWorker(runEmailDispatcher)
+	goWorker(runUnpaidOrderExpiry)
+	goWorker(func(ctx context.Context) { orderStreams.listen(ctx, connStr) })
+
+	srv := newServer(":8080", newRouter())
+	srv.RegisterOnShutdown(orderStreams.shutdown)
+	err = runServer(srv)
+	if cerr := db.Close(); cerr != nil {
+		log.Print("closing db: ", cerr)
+	}
+	if terr := shutdownTracing(context.Background()); terr != nil {
+		log.Print("flushing traces: ", terr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newRouter() chi.Router {
 	r := chi.NewRouter()
+	r.Use(RequestID)
+	r.Use(Tracing)
+	r.Use(RequestLogger)
+	r.Use(MetricsMiddleware)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", requestIDHeader, "traceparent", "tracestate", idempotencyHeader, acceptCurrencyHeader},
+		ExposedHeaders:   []string{"Link", requestIDHeader, "Deprecation", "Sunset", replayedHeader},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
+	r.Route(apiV1Prefix, v1Routes)
 	r.Group(func(r chi.Router) {
-		r.Use(AuthMiddleware)
-		r.Get("/profile", getProfile)
-		r.Post("/products", postProducts)
-		r.Put("/products/{id}", putProduct)
-		r.Delete("/products/{id}", deleteProduct)
-		r.Route("/cart", func(r chi.Router) {
-			r.Get("/", getCart)
-			r.Post("/add", addCart)
-			r.Post("/remove", removefromCart)
-			r.Delete("/clear", clearCart)
-		})
-		r.Route("/orders", func(r chi.Router) {
-			r.Post("/", postOrders)
-			r.Get("/", getOrders)
-			r.Post("/update", updateStatus)
-			r.Get("/{id}", getOrderbyID)
-			r.Get("/getall", getAllOrders)
-		})
-
+		r.Use(Deprecated(apiV1Prefix, legacySunset))
+		v1Routes(r)
 	})
 
-	r.Get("/products", getProducts)
-	r.Get("/products/{id}", getProductByID)
-	r.Post("/login", Login)
-	r.Post("/registration", Registration)
-	http.ListenAndServe(":8080", r)
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+	r.Method(http.MethodGet, "/metrics", metricsHandler())
+	r.Get("/openapi.json", getOpenAPI)
+	r.Get("/docs", getDocs)
+	// Uploads in the local store are served by us; an S3 bucket serves
+	// its own.
+	if h, ok := blobs.(interface{ Handler() http.Handler }); ok {
+		r.Handle(mediaPrefix+"*", http.StripPrefix(mediaPrefix, h.Handler()))
+	}
+	return r
 }
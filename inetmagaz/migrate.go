@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations returns the embedded migrations ordered by version.
+// Files are named NNNN_description.sql.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var ms []migration
+	for _, e := range entries {
+		name := e.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: missing version prefix", name)
+		}
+		v, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", name, err)
+		}
+		body, err := migrationsFS.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{Version: v, Name: name, SQL: string(body)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// latestMigration is the schema version this binary expects.
+func latestMigration() int {
+	ms, err := loadMigrations()
+	if err != nil || len(ms) == 0 {
+		return 0
+	}
+	return ms[len(ms)-1].Version
+}
+
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var v sql.NullInt64
+	err := db.QueryRowContext(ctx, "select max(version) from schema_migrations").Scan(&v)
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// migrationLockID is the pg_advisory_lock key that serialises migrations
+// when several instances start at once.
+const migrationLockID = 7240150
+
+// migrate applies every embedded migration newer than the recorded schema
+// version, each in its own transaction. Migrations can read the shop
+// currency and its number of minor digits as current_setting('shop.currency')
+// and current_setting('shop.currency_digits'), and when this run started as
+// current_setting('migrate.started_at').
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, "create table if not exists schema_migrations (version integer primary key, applied_at timestamptz not null default now())")
+	if err != nil {
+		return err
+	}
+	var current sql.NullInt64
+	var started string
+	if err := conn.QueryRowContext(ctx, "select max(version), now()::text from schema_migrations").Scan(&current, &started); err != nil {
+		return err
+	}
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if int64(m.Version) <= current.Int64 {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "select set_config('shop.currency', $1, true), set_config('shop.currency_digits', $2, true), set_config('migrate.started_at', $3, true)",
+			shopCurrency, strconv.Itoa(currencyDigits[shopCurrency]), started)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "insert into schema_migrations (version) values ($1)", m.Version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Print("applied migration ", m.Name)
+	}
+	return nil
+}
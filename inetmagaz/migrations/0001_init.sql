@@ -0,0 +1,39 @@
+create table if not exists users (
+    id            serial primary key,
+    username      text not null unique,
+    password_hash text not null,
+    email         text not null unique,
+    role          text not null default 'user'
+);
+
+create table if not exists products (
+    id          serial primary key,
+    name        text not null unique,
+    description text not null default '',
+    price       integer not null,
+    stock       integer not null default 0,
+    image       text not null default ''
+);
+
+create table if not exists cart (
+    id         serial primary key,
+    user_id    integer not null references users(id) on delete cascade,
+    product_id integer not null references products(id),
+    quantity   integer not null
+);
+
+create table if not exists orders (
+    id          serial primary key,
+    user_id     integer not null references users(id),
+    status      text not null,
+    total_price integer not null,
+    created_at  timestamptz not null default now()
+);
+
+create table if not exists order_items (
+    id         serial primary key,
+    order_id   integer not null references orders(id) on delete cascade,
+    product_id integer not null references products(id),
+    quantity   integer not null,
+    price      integer not null
+);
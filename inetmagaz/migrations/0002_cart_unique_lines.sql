@@ -0,0 +1,19 @@
+-- Merge duplicate cart lines into the oldest one before enforcing a single
+-- line per (user, product).
+update cart c
+set quantity = d.total
+from (
+    select min(id) as keep_id, sum(quantity) as total
+    from cart
+    group by user_id, product_id
+    having count(*) > 1
+) d
+where c.id = d.keep_id;
+
+delete from cart c
+using cart k
+where c.user_id = k.user_id
+  and c.product_id = k.product_id
+  and c.id > k.id;
+
+alter table cart add constraint cart_user_product_key unique (user_id, product_id);
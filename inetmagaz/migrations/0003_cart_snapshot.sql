@@ -0,0 +1,13 @@
+-- Price and stock as the customer saw them when the line was added, so the
+-- cart can flag lines that changed since.
+alter table cart add column added_price integer;
+alter table cart add column added_stock integer;
+
+update cart
+set added_price = products.price,
+    added_stock = products.stock
+from products
+where products.id = cart.product_id;
+
+alter table cart alter column added_price set not null;
+alter table cart alter column added_stock set not null;
@@ -0,0 +1,21 @@
+create table addresses (
+    id          serial primary key,
+    user_id     integer not null references users(id) on delete cascade,
+    full_name   text not null,
+    phone       text not null default '',
+    line1       text not null,
+    line2       text not null default '',
+    city        text not null,
+    region      text not null default '',
+    postal_code text not null default '',
+    country     text not null,
+    is_default  boolean not null default false,
+    created_at  timestamptz not null default now()
+);
+
+create index addresses_user_id_idx on addresses (user_id);
+create unique index addresses_one_default_idx on addresses (user_id) where is_default;
+
+-- Copy of the address at checkout time; editing the address book later
+-- must not rewrite where past orders were shipped.
+alter table orders add column shipping_address jsonb;
@@ -0,0 +1,15 @@
+create table payments (
+    id         serial primary key,
+    order_id   integer not null references orders(id) on delete cascade,
+    provider   text not null,
+    intent_id  text not null,
+    amount     integer not null,
+    status     text not null,
+    created_at timestamptz not null default now(),
+    updated_at timestamptz not null default now(),
+    unique (provider, intent_id)
+);
+
+create index payments_order_id_idx on payments (order_id);
+
+alter table orders alter column created_at set default now();
@@ -0,0 +1,22 @@
+alter table orders add column refunded_amount integer not null default 0;
+alter table order_items add column refunded_quantity integer not null default 0;
+
+create table refunds (
+    id                 serial primary key,
+    order_id           integer not null references orders(id) on delete cascade,
+    payment_id         integer not null references payments(id),
+    provider_refund_id text not null,
+    amount             integer not null,
+    reason             text not null default '',
+    restocked          boolean not null default false,
+    created_at         timestamptz not null default now()
+);
+
+create index refunds_order_id_idx on refunds (order_id);
+
+create table refund_items (
+    refund_id     integer not null references refunds(id) on delete cascade,
+    order_item_id integer not null references order_items(id),
+    quantity      integer not null,
+    primary key (refund_id, order_item_id)
+);
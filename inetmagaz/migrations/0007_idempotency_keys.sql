@@ -0,0 +1,12 @@
+create table idempotency_keys (
+    username     text not null,
+    key          text not null,
+    request_hash text not null,
+    status       integer,
+    content_type text not null default '',
+    body         bytea,
+    created_at   timestamptz not null default now(),
+    primary key (username, key)
+);
+
+create index idempotency_keys_created_at_idx on idempotency_keys (created_at);
@@ -0,0 +1,26 @@
+create table webhook_subscriptions (
+    id         serial primary key,
+    url        text not null,
+    secret     text not null,
+    events     text[] not null,
+    active     boolean not null default true,
+    created_at timestamptz not null default now()
+);
+
+create table webhook_deliveries (
+    id               serial primary key,
+    subscription_id  integer not null references webhook_subscriptions(id) on delete cascade,
+    event_id         text not null,
+    event_type       text not null,
+    payload          jsonb not null,
+    status           text not null default 'pending',
+    attempts         integer not null default 0,
+    next_attempt_at  timestamptz not null default now(),
+    last_status_code integer,
+    last_error       text not null default '',
+    created_at       timestamptz not null default now(),
+    delivered_at     timestamptz
+);
+
+create index webhook_deliveries_due_idx on webhook_deliveries (next_attempt_at) where status = 'pending';
+create index webhook_deliveries_subscription_id_idx on webhook_deliveries (subscription_id);
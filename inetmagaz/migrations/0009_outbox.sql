@@ -0,0 +1,19 @@
+create table outbox (
+    id              bigserial primary key,
+    aggregate_type  text not null,
+    aggregate_id    integer not null,
+    event_id        text not null unique,
+    event_type      text not null,
+    payload         jsonb not null,
+    attempts        integer not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error      text not null default '',
+    created_at      timestamptz not null default now(),
+    published_at    timestamptz
+);
+
+create index outbox_unpublished_idx on outbox (aggregate_type, aggregate_id, id) where published_at is null;
+create index outbox_published_at_idx on outbox (published_at) where published_at is not null;
+
+-- A redelivered outbox event must not queue a second webhook delivery.
+alter table webhook_deliveries add constraint webhook_deliveries_event_subscription_key unique (event_id, subscription_id);
@@ -0,0 +1,21 @@
+-- Every new order and status change is announced on the order_changes
+-- channel once its transaction commits, for the SSE streams of every
+-- instance.
+create function notify_order_change() returns trigger as $$
+begin
+    perform pg_notify('order_changes', json_build_object(
+        'order_id', new.id,
+        'user_id', new.user_id,
+        'status', new.status,
+        'total_price', new.total_price,
+        'created', tg_op = 'INSERT')::text);
+    return null;
+end;
+$$ language plpgsql;
+
+create trigger orders_notify_insert after insert on orders
+    for each row execute function notify_order_change();
+
+create trigger orders_notify_status after update of status on orders
+    for each row when (old.status is distinct from new.status)
+    execute function notify_order_change();
@@ -0,0 +1,36 @@
+create table email_queue (
+    id              serial primary key,
+    user_id         integer references users(id) on delete cascade,
+    event_id        text,
+    template        text not null,
+    to_address      text not null,
+    subject         text not null,
+    text_body       text not null,
+    html_body       text not null,
+    status          text not null default 'pending',
+    attempts        integer not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error      text not null default '',
+    created_at      timestamptz not null default now(),
+    sent_at         timestamptz,
+    unique (event_id, template)
+);
+
+create index email_queue_due_idx on email_queue (next_attempt_at) where status = 'pending';
+
+create table notification_preferences (
+    user_id            integer primary key references users(id) on delete cascade,
+    order_confirmation boolean not null default true,
+    order_status       boolean not null default true,
+    updated_at         timestamptz not null default now()
+);
+
+create table password_resets (
+    token_hash text primary key,
+    user_id    integer not null references users(id) on delete cascade,
+    expires_at timestamptz not null,
+    used_at    timestamptz,
+    created_at timestamptz not null default now()
+);
+
+create index password_resets_user_id_idx on password_resets (user_id);
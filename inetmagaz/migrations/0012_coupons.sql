@@ -0,0 +1,39 @@
+alter table products add column category text not null default '';
+
+create table coupons (
+    id                serial primary key,
+    code              text not null unique,
+    kind              text not null,
+    value             integer not null default 0,
+    min_total         integer not null default 0,
+    starts_at         timestamptz,
+    ends_at           timestamptz,
+    max_uses          integer not null default 0,
+    max_uses_per_user integer not null default 0,
+    uses              integer not null default 0,
+    product_ids       integer[] not null default '{}',
+    categories        text[] not null default '{}',
+    active            boolean not null default true,
+    created_at        timestamptz not null default now()
+);
+
+create table coupon_redemptions (
+    id         serial primary key,
+    coupon_id  integer not null references coupons(id),
+    user_id    integer not null references users(id) on delete cascade,
+    order_id   integer not null references orders(id) on delete cascade,
+    amount     integer not null,
+    created_at timestamptz not null default now()
+);
+
+create index coupon_redemptions_coupon_user_idx on coupon_redemptions (coupon_id, user_id);
+
+create table cart_coupons (
+    user_id   integer primary key references users(id) on delete cascade,
+    coupon_id integer not null references coupons(id) on delete cascade
+);
+
+alter table orders add column discount integer not null default 0;
+alter table orders add column coupon_code text;
+alter table orders add column free_shipping boolean not null default false;
+alter table order_items add column discount integer not null default 0;
@@ -0,0 +1,29 @@
+alter table products add column weight integer not null default 0;
+
+create table shipping_methods (
+    id         serial primary key,
+    name       text not null,
+    provider   text not null default 'table',
+    active     boolean not null default true,
+    created_at timestamptz not null default now()
+);
+
+-- Rate rules for table-priced methods. Empty country/region match any; a
+-- max_weight of 0 means no upper bound; free_above of 0 means never free.
+create table shipping_rates (
+    id         serial primary key,
+    method_id  integer not null references shipping_methods(id) on delete cascade,
+    country    text not null default '',
+    region     text not null default '',
+    min_weight integer not null default 0,
+    max_weight integer not null default 0,
+    price      integer not null default 0,
+    per_kg     integer not null default 0,
+    free_above integer not null default 0
+);
+
+create index shipping_rates_method_id_idx on shipping_rates (method_id);
+
+alter table orders add column shipping_method_id integer references shipping_methods(id);
+alter table orders add column shipping_method text;
+alter table orders add column shipping_price integer not null default 0;
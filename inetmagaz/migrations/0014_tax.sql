@@ -0,0 +1,21 @@
+alter table products add column tax_class text not null default 'standard';
+
+-- Rates per tax class and place, in basis points (2000 = 20%). Empty
+-- country/region match any; the most specific match wins. A class with no
+-- matching rate is untaxed there.
+create table tax_rates (
+    id         serial primary key,
+    tax_class  text not null,
+    country    text not null default '',
+    region     text not null default '',
+    name       text not null,
+    rate       integer not null check (rate >= 0),
+    created_at timestamptz not null default now(),
+    unique (tax_class, country, region)
+);
+
+alter table orders add column tax integer not null default 0;
+alter table orders add column tax_inclusive boolean not null default false;
+alter table orders add column tax_breakdown jsonb not null default '[]';
+alter table order_items add column tax integer not null default 0;
+alter table order_items add column tax_rate integer not null default 0;
@@ -0,0 +1,4 @@
+-- Amounts everywhere are integer minor units (kopecks for RUB). Orders
+-- record the currency they were placed in; earlier ones were in the
+-- default shop currency.
+alter table orders add column currency char(3) not null default 'RUB';
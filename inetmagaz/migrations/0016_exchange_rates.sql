@@ -0,0 +1,19 @@
+-- How many units of a currency one unit of the shop currency buys. The shop
+-- currency itself has no row; a currency without a rate can't be sold in.
+create table exchange_rates (
+    currency   char(3) primary key,
+    rate       numeric(18,6) not null check (rate > 0),
+    updated_at timestamptz not null default now()
+);
+
+-- Prices set by hand for a product in another currency, in its minor
+-- units. They win over converting the shop price at the exchange rate.
+create table product_prices (
+    product_id integer not null references products(id) on delete cascade,
+    currency   char(3) not null,
+    price      integer not null check (price >= 0),
+    primary key (product_id, currency)
+);
+
+-- The rate an order was converted at when it was placed.
+alter table orders add column exchange_rate numeric(18,6) not null default 1;
@@ -0,0 +1,16 @@
+-- Uploaded product images, shown in position order. key is the original in
+-- the blob store and thumbnails maps a size in pixels to its key. The first
+-- image's URL is also kept in products.image for older clients.
+create table product_images (
+    id           serial primary key,
+    product_id   integer not null references products(id) on delete cascade,
+    position     integer not null,
+    key          text not null,
+    content_type text not null,
+    width        integer not null,
+    height       integer not null,
+    thumbnails   jsonb not null default '{}',
+    created_at   timestamptz not null default now()
+);
+
+create index product_images_product_id_idx on product_images (product_id, position);
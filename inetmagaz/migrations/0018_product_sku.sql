@@ -0,0 +1,5 @@
+-- Optional stock keeping unit, used with the name to match rows on import.
+-- Unique when set; products without one keep it null.
+alter table products add column sku text;
+
+create unique index products_sku_key on products (sku);
@@ -0,0 +1,4 @@
+-- Deleting a product archives it: order_items and carts refer to products,
+-- so rows stay for order history and are only hidden from the catalog.
+-- Archived products never ordered can be purged for good.
+alter table products add column archived_at timestamptz;
@@ -0,0 +1,8 @@
+-- A refund is recorded as pending before the provider is asked for the
+-- money and completed once it answers, so a failure in between leaves a
+-- row to finish with the same idempotency key instead of an untracked
+-- payout. provider_refund_id is only known once the provider has answered.
+alter table refunds add column status text not null default 'succeeded';
+alter table refunds alter column provider_refund_id drop not null;
+
+create index refunds_pending_idx on refunds (order_id) where status = 'pending';
@@ -0,0 +1,54 @@
+-- 0015 made amounts minor units of their currency (kopecks for RUB) but
+-- didn't convert what was already stored in whole units of the shop
+-- currency. Scale what predates 0015: everything when 0015 ran in this
+-- same upgrade, otherwise the rows dated before it. Products and cart
+-- lines carry no date, so after an earlier 0015 they are left alone.
+-- migrate passes in the shop currency and when the upgrade started.
+do $$
+declare
+    shop char(3) := current_setting('shop.currency');
+    f integer := power(10, current_setting('shop.currency_digits')::integer);
+    cutoff timestamptz := (select applied_at from schema_migrations where version = 15);
+    same_run boolean := cutoff >= current_setting('migrate.started_at')::timestamptz;
+begin
+    if same_run then
+        cutoff := 'infinity';
+    end if;
+
+    -- Orders before 0015 were in the shop currency, whatever it defaulted.
+    update orders set currency = shop where created_at < cutoff;
+    update orders set total_price = total_price * f,
+        refunded_amount = refunded_amount * f,
+        shipping_price = shipping_price * f,
+        discount = discount * f,
+        tax = tax * f,
+        tax_breakdown = (
+            select coalesce(jsonb_agg(line || jsonb_build_object(
+                'taxable', (line->>'taxable')::bigint * f,
+                'amount', (line->>'amount')::bigint * f)), '[]')
+            from jsonb_array_elements(tax_breakdown) as t(line))
+    where created_at < cutoff and currency = shop;
+    update order_items set price = price * f, discount = discount * f, tax = tax * f
+    where order_id in (select id from orders where created_at < cutoff and currency = shop);
+    update payments set amount = amount * f
+    where order_id in (select id from orders where created_at < cutoff and currency = shop);
+    update refunds set amount = amount * f
+    where order_id in (select id from orders where created_at < cutoff and currency = shop);
+    update coupon_redemptions set amount = amount * f
+    where order_id in (select id from orders where created_at < cutoff and currency = shop);
+
+    update coupons set value = value * f where kind = 'fixed' and created_at < cutoff;
+    update coupons set min_total = min_total * f where created_at < cutoff;
+    update shipping_rates set price = price * f, per_kg = per_kg * f, free_above = free_above * f
+    where method_id in (select id from shipping_methods where created_at < cutoff);
+
+    if same_run then
+        update products set price = price * f;
+        update cart set added_price = added_price * f;
+    else
+        raise notice 'product and cart prices set before migration 15 are still in whole units; check them by hand';
+    end if;
+end $$;
+
+-- Every order names its currency; new ones get it from the checkout.
+alter table orders alter column currency drop default;
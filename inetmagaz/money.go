@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// currencyDigits are the ISO 4217 currencies the shop can price in, with
+// the number of minor units in one major unit as a power of ten.
+var currencyDigits = map[string]int{
+	"RUB": 2, "KZT": 2, "BYN": 2, "UZS": 2, "KGS": 2, "AMD": 2, "GEL": 2,
+	"USD": 2, "EUR": 2, "CNY": 2, "TRY": 2, "JPY": 0,
+}
+
+// shopCurrency is what catalog prices are in, from SHOP_CURRENCY.
+var shopCurrency = "RUB"
+
+var (
+	errCurrencyMismatch = errors.New("currency mismatch")
+	errMoneyOverflow    = errors.New("money amount overflows")
+)
+
+// Money is an amount in minor units (kopecks, tiyn, cents) of Currency.
+//
+// In JSON and in the database a Money is just its amount, so API shapes
+// that predate it are unchanged; resources carry the currency in a
+// separate currency field and columns scan with the shop currency until
+// told otherwise.
+type Money struct {
+	Amount   int
+	Currency string
+}
+
+// setupCurrency reads the shop currency from SHOP_CURRENCY.
+func setupCurrency() error {
+	c := strings.ToUpper(strings.TrimSpace(os.Getenv("SHOP_CURRENCY")))
+	if c == "" {
+		return nil
+	}
+	if _, ok := currencyDigits[c]; !ok {
+		return fmt.Errorf("SHOP_CURRENCY %q is not a supported ISO 4217 currency", c)
+	}
+	shopCurrency = c
+	return nil
+}
+
+// money is amount minor units of the shop currency.
+func money(amount int) Money {
+	return Money{Amount: amount, Currency: shopCurrency}
+}
+
+// inCurrency sets the currency of amounts scanned from a row priced in c.
+func inCurrency(c string, ms ...*Money) {
+	for _, m := range ms {
+		m.Currency = c
+	}
+}
+
+func (m Money) sameCurrency(o Money) error {
+	if m.Currency != o.Currency {
+		return fmt.Errorf("%w: %s and %s", errCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return nil
+}
+
+// Add returns m+o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	if (o.Amount > 0 && m.Amount > math.MaxInt-o.Amount) || (o.Amount < 0 && m.Amount < math.MinInt-o.Amount) {
+		return Money{}, errMoneyOverflow
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m-o. Both must be in the same currency.
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt {
+		return Money{}, errMoneyOverflow
+	}
+	return m.Add(Money{Amount: -o.Amount, Currency: o.Currency})
+}
+
+// Mul returns m times n, as for a unit price times a quantity.
+func (m Money) Mul(n int) (Money, error) {
+	if m.Amount != 0 && n != 0 {
+		p := m.Amount * n
+		if p/n != m.Amount || (m.Amount == -1 && n == math.MinInt) || (n == -1 && m.Amount == math.MinInt) {
+			return Money{}, errMoneyOverflow
+		}
+		return Money{Amount: p, Currency: m.Currency}, nil
+	}
+	return Money{Currency: m.Currency}, nil
+}
+
+// MulRate returns m times rate basis points (100 = 1%), rounded half away
+// from zero to a whole minor unit.
+func (m Money) MulRate(rate int) (Money, error) {
+	p, err := m.Mul(rate)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: divRound(p.Amount, 10000), Currency: m.Currency}, nil
+}
+
+// Convert returns m in currency at rate units of currency per unit of
+// m's currency, rounded half away from zero to a whole minor unit.
+func (m Money) Convert(currency string, rate float64) (Money, error) {
+	scale := math.Pow10(currencyDigits[currency] - currencyDigits[m.Currency])
+	v := math.Round(float64(m.Amount) * rate * scale)
+	if math.IsNaN(v) || v >= math.MaxInt || v <= math.MinInt {
+		return Money{}, errMoneyOverflow
+	}
+	return Money{Amount: int(v), Currency: currency}, nil
+}
+
+// Allocate splits m in proportion to weights without losing a minor unit:
+// each share is rounded down and the remainder goes to the last non-zero
+// weight. Zero weights get nothing; all-zero weights get nothing at all.
+func (m Money) Allocate(weights []int) []Money {
+	shares := make([]Money, len(weights))
+	total, last := 0, -1
+	for i, w := range weights {
+		shares[i] = Money{Currency: m.Currency}
+		total += w
+		if w != 0 {
+			last = i
+		}
+	}
+	if last < 0 || total == 0 {
+		return shares
+	}
+	left := m.Amount
+	for i, w := range weights {
+		if i == last {
+			break
+		}
+		shares[i].Amount = m.Amount * w / total
+		left -= shares[i].Amount
+	}
+	shares[last].Amount = left
+	return shares
+}
+
+// divRound divides a by positive b, rounding half away from zero.
+func divRound(a, b int) int {
+	if a < 0 {
+		return -((-a*2 + b) / (2 * b))
+	}
+	return (a*2 + b) / (2 * b)
+}
+
+// String formats m in major units, e.g. "12.50 RUB".
+func (m Money) String() string {
+	digits, ok := currencyDigits[m.Currency]
+	if !ok || digits == 0 {
+		return strconv.Itoa(m.Amount) + " " + m.Currency
+	}
+	sign, a := "", m.Amount
+	if a < 0 {
+		sign, a = "-", -a
+	}
+	unit := int(math.Pow10(digits))
+	return fmt.Sprintf("%s%d.%0*d %s", sign, a/unit, digits, a%unit, m.Currency)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Amount)
+}
+
+// UnmarshalJSON reads an amount in minor units. The currency is left as
+// it was, or the shop currency if unset.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &m.Amount); err != nil {
+		return fmt.Errorf("money must be an integer number of minor units: %w", err)
+	}
+	if m.Currency == "" {
+		m.Currency = shopCurrency
+	}
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return int64(m.Amount), nil
+}
+
+// Scan reads an integer amount column in the shop currency. Rows priced in
+// another currency set it after scanning.
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		m.Amount = int(v)
+	case []byte:
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
+		}
+		m.Amount = n
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		m.Amount = n
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	m.Currency = shopCurrency
+	return nil
+}
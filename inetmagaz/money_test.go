@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMoneyArithmetic(t *testing.T) {
+	rub := Money{1050, "RUB"}
+	if got, err := rub.Add(Money{25, "RUB"}); err != nil || got != (Money{1075, "RUB"}) {
+		t.Errorf("Add = %v, %v", got, err)
+	}
+	if got, err := rub.Sub(Money{2000, "RUB"}); err != nil || got != (Money{-950, "RUB"}) {
+		t.Errorf("Sub = %v, %v", got, err)
+	}
+	if got, err := rub.Mul(3); err != nil || got != (Money{3150, "RUB"}) {
+		t.Errorf("Mul = %v, %v", got, err)
+	}
+	if _, err := rub.Add(Money{1, "KZT"}); !errors.Is(err, errCurrencyMismatch) {
+		t.Errorf("adding KZT to RUB: %v", err)
+	}
+	if _, err := (Money{math.MaxInt, "RUB"}).Add(Money{1, "RUB"}); !errors.Is(err, errMoneyOverflow) {
+		t.Errorf("Add overflow: %v", err)
+	}
+	if _, err := (Money{math.MinInt, "RUB"}).Sub(Money{1, "RUB"}); !errors.Is(err, errMoneyOverflow) {
+		t.Errorf("Sub overflow: %v", err)
+	}
+	if _, err := (Money{math.MaxInt / 2, "RUB"}).Mul(3); !errors.Is(err, errMoneyOverflow) {
+		t.Errorf("Mul overflow: %v", err)
+	}
+	if _, err := (Money{math.MinInt, "RUB"}).Mul(-1); !errors.Is(err, errMoneyOverflow) {
+		t.Errorf("Mul overflow: %v", err)
+	}
+}
+
+func TestMoneyRounding(t *testing.T) {
+	for _, tc := range []struct {
+		amount, rate, want int
+	}{
+		{1000, 1200, 120},
+		{1005, 1000, 101}, // 100.5 rounds up
+		{1004, 1000, 100},
+		{-1005, 1000, -101}, // and away from zero when negative
+		{333, 3333, 111},
+	} {
+		got, err := (Money{tc.amount, "RUB"}).MulRate(tc.rate)
+		if err != nil || got.Amount != tc.want {
+			t.Errorf("%d × %d bp = %v, %v; want %d", tc.amount, tc.rate, got, err, tc.want)
+		}
+	}
+
+	shares := (Money{100, "RUB"}).Allocate([]int{1, 0, 1, 1})
+	if fmt.Sprint(shares) != "[0.33 RUB 0.00 RUB 0.33 RUB 0.34 RUB]" {
+		t.Errorf("Allocate = %v", shares)
+	}
+	if shares := (Money{100, "RUB"}).Allocate([]int{0, 0}); shares[0].Amount != 0 || shares[1].Amount != 0 {
+		t.Errorf("Allocate with no weight = %v", shares)
+	}
+}
+
+func TestMoneyConvert(t *testing.T) {
+	for _, tc := range []struct {
+		from     Money
+		currency string
+		rate     float64
+		want     Money
+	}{
+		{Money{500, "RUB"}, "KZT", 5.5, Money{2750, "KZT"}},
+		{Money{999, "RUB"}, "USD", 0.0123, Money{12, "USD"}}, // 12.2877 cents
+		{Money{1050, "RUB"}, "JPY", 1.8, Money{19, "JPY"}},   // no minor units: 18.9 yen
+		{Money{19, "JPY"}, "RUB", 1 / 1.8, Money{1056, "RUB"}},
+	} {
+		got, err := tc.from.Convert(tc.currency, tc.rate)
+		if err != nil || got != tc.want {
+			t.Errorf("%v at %v = %v, %v; want %v", tc.from, tc.rate, got, err, tc.want)
+		}
+	}
+	if _, err := (Money{math.MaxInt / 2, "RUB"}).Convert("UZS", 150); !errors.Is(err, errMoneyOverflow) {
+		t.Errorf("Convert overflow: %v", err)
+	}
+}
+
+func TestMoneyEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		m    Money
+		want string
+	}{
+		{Money{123456, "RUB"}, "1234.56 RUB"},
+		{Money{-5, "USD"}, "-0.05 USD"},
+		{Money{500, "JPY"}, "500 JPY"},
+	} {
+		if got := tc.m.String(); got != tc.want {
+			t.Errorf("String() = %q, want %q", got, tc.want)
+		}
+	}
+
+	var p Product
+	if err := json.Unmarshal([]byte(`{"price":1999}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Price != (Money{1999, shopCurrency}) {
+		t.Errorf("decoded %v", p.Price)
+	}
+	if err := json.Unmarshal([]byte(`{"price":19.99}`), &p); err == nil {
+		t.Error("decoded a fractional amount")
+	}
+	b, err := json.Marshal(CartLine{Price: Money{1999, "RUB"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"price":1999,`; !strings.Contains(string(b), want) {
+		t.Errorf("encoded %s, want %s in it", b, want)
+	}
+
+	var m Money
+	if err := m.Scan(int64(250)); err != nil || m != (Money{250, shopCurrency}) {
+		t.Errorf("Scan = %v, %v", m, err)
+	}
+	if v, err := (Money{250, "RUB"}).Value(); err != nil || v != int64(250) {
+		t.Errorf("Value = %v, %v", v, err)
+	}
+}
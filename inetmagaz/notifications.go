@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	texttemplate "text/template"
+	"time"
+)
+
+// Each email has a <name>.txt and a <name>.html template; the subject is
+// the "<name>.subject" template defined in the .txt file.
+//
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+var (
+	textEmails = texttemplate.Must(texttemplate.ParseFS(emailTemplateFS, "templates/email/*.txt"))
+	htmlEmails = htmltemplate.Must(htmltemplate.ParseFS(emailTemplateFS, "templates/email/*.html"))
+)
+
+const (
+	emailOrderConfirmation = "order_confirmation"
+	emailStatusChanged     = "status_changed"
+	emailPasswordReset     = "password_reset"
+)
+
+const (
+	emailMaxAttempts = 6
+	emailBackoff     = time.Minute
+)
+
+// Email statuses as stored in email_queue.status.
+const (
+	emailPending = "pending"
+	emailSent    = "sent"
+	emailFailed  = "failed"
+)
+
+// renderEmail fills in the templates called name.
+func renderEmail(name, to string, data any) (Email, error) {
+	m := Email{To: to}
+	var b bytes.Buffer
+	if err := textEmails.ExecuteTemplate(&b, name+".subject", data); err != nil {
+		return m, err
+	}
+	m.Subject = b.String()
+	b.Reset()
+	if err := textEmails.ExecuteTemplate(&b, name+".txt", data); err != nil {
+		return m, err
+	}
+	m.Text = b.String()
+	b.Reset()
+	if err := htmlEmails.ExecuteTemplate(&b, name+".html", data); err != nil {
+		return m, err
+	}
+	m.HTML = b.String()
+	return m, nil
+}
+
+// queueEmail renders an email and adds it to the send queue. eventID, when
+// set, makes queueing the same event twice a no-op.
+func queueEmail(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, userID int, eventID, name, to string, data any) error {
+	m, err := renderEmail(name, to, data)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "insert into email_queue (user_id, event_id, template, to_address, subject, text_body, html_body) values ($1, nullif($2, ''), $3, $4, $5, $6, $7) on conflict (event_id, template) do nothing",
+		userID, eventID, name, m.To, m.Subject, m.Text, m.HTML)
+	return err
+}
+
+// OrderEmailLine and OrderEmail amounts print in major units with their
+// currency, e.g. "12.50 RUB".
+type OrderEmailLine struct {
+	Name     string
+	Quantity int
+	Price    Money
+	Total    Money
+}
+
+type OrderEmail struct {
+	Username   string
+	OrderID    int
+	Status     string
+	TotalPrice Money
+	Items      []OrderEmailLine
+	ShipTo     *ShippingAddress
+}
+
+// emailSink emails customers about their orders, as their notification
+// preferences allow.
+type emailSink struct{}
+
+func (emailSink) Name() string { return "email" }
+
+func (emailSink) Publish(ctx context.Context, ev OutboxEvent) error {
+	var name string
+	switch ev.Type {
+	case eventOrderCreated:
+		name = emailOrderConfirmation
+	case eventOrderStatusChanged:
+		name = emailStatusChanged
+	default:
+		return nil
+	}
+	var envelope struct {
+		Data OrderEventData `json:"data"`
+	}
+	if err := json.Unmarshal(ev.Payload, &envelope); err != nil {
+		return err
+	}
+
+	var userID int
+	var to, currency string
+	p := NotificationPreferences{}
+	data := OrderEmail{OrderID: envelope.Data.OrderID, Status: envelope.Data.Status}
+	err := db.QueryRowContext(ctx, "select users.id, users.username, users.email, orders.total_price, orders.currency, orders.shipping_address, coalesce(notification_preferences.order_confirmation, true), coalesce(notification_preferences.order_status, true) from orders join users on users.id = orders.user_id left join notification_preferences on notification_preferences.user_id = users.id where orders.id = $1", data.OrderID).
+		Scan(&userID, &data.Username, &to, &data.TotalPrice, &currency, &data.ShipTo, &p.OrderConfirmation, &p.OrderStatus)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	inCurrency(currency, &data.TotalPrice)
+	if (name == emailOrderConfirmation && !p.OrderConfirmation) || (name == emailStatusChanged && !p.OrderStatus) {
+		return nil
+	}
+	if name == emailOrderConfirmation {
+		rows, err := db.QueryContext(ctx, "select products.name, order_items.quantity, order_items.price from order_items join products on products.id = order_items.product_id where order_items.order_id = $1 order by order_items.id", data.OrderID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l OrderEmailLine
+			if err := rows.Scan(&l.Name, &l.Quantity, &l.Price); err != nil {
+				return err
+			}
+			inCurrency(currency, &l.Price)
+			if l.Total, err = l.Price.Mul(l.Quantity); err != nil {
+				return err
+			}
+			data.Items = append(data.Items, l)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return queueEmail(ctx, db, userID, ev.EventID, name, to, data)
+}
+
+// sendDueEmails sends up to limit queued emails whose next attempt is due
+// and returns how many it tried. Once an email is sent or given up on its
+// body is cleared, so links in it, like password resets, don't stay in the
+// database.
+func sendDueEmails(ctx context.Context, limit int) (int, error) {
+	rows, err := db.QueryContext(ctx, "update email_queue set next_attempt_at = now() + interval '1 minute' where id in (select id from email_queue where status = $1 and next_attempt_at <= now() order by id limit $2 for update skip locked) returning id, to_address, subject, text_body, html_body, attempts", emailPending, limit)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		id, attempts int
+		m            Email
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.m.To, &d.m.Subject, &d.m.Text, &d.m.HTML, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		serr := mailer.Send(ctx, d.m)
+		attempts := d.attempts + 1
+		if serr == nil {
+			_, err = db.ExecContext(ctx, "update email_queue set status = $1, attempts = $2, last_error = '', sent_at = now(), text_body = '', html_body = '' where id = $3", emailSent, attempts, d.id)
+		} else if attempts >= emailMaxAttempts {
+			_, err = db.ExecContext(ctx, "update email_queue set status = $1, attempts = $2, last_error = $3, text_body = '', html_body = '' where id = $4", emailFailed, attempts, serr.Error(), d.id)
+		} else {
+			next := time.Now().Add(emailBackoff << (attempts - 1))
+			_, err = db.ExecContext(ctx, "update email_queue set attempts = $1, last_error = $2, next_attempt_at = $3 where id = $4", attempts, serr.Error(), next, d.id)
+		}
+		if err != nil {
+			return len(batch), err
+		}
+		if serr != nil {
+			loggerFrom(ctx).Warn("sending email failed", "email_id", d.id, "attempt", attempts, "err", serr)
+		}
+	}
+	return len(batch), nil
+}
+
+// runEmailDispatcher sends queued email until ctx is cancelled.
+func runEmailDispatcher(ctx context.Context) {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for {
+			n, err := sendDueEmails(ctx, 20)
+			if err != nil {
+				if ctx.Err() == nil {
+					loggerFrom(ctx).Error("sending email", "err", err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// NotificationPreferences are the emails a user wants. Password resets are
+// always sent.
+type NotificationPreferences struct {
+	OrderConfirmation bool `json:"order_confirmation"`
+	OrderStatus       bool `json:"order_status"`
+}
+
+func getNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	p := NotificationPreferences{OrderConfirmation: true, OrderStatus: true}
+	err = db.QueryRowContext(r.Context(), "select order_confirmation, order_status from notification_preferences where user_id = $1", userID).
+		Scan(&p.OrderConfirmation, &p.OrderStatus)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading notification preferences", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func putNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var p NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	_, err = db.ExecContext(r.Context(), "insert into notification_preferences (user_id, order_confirmation, order_status) values ($1,$2,$3) on conflict (user_id) do update set order_confirmation = excluded.order_confirmation, order_status = excluded.order_status, updated_at = now()",
+		userID, p.OrderConfirmation, p.OrderStatus)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("saving notification preferences", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+type recordingMailer struct {
+	err  error
+	sent []Email
+}
+
+func (m *recordingMailer) Send(ctx context.Context, e Email) error {
+	m.sent = append(m.sent, e)
+	return m.err
+}
+
+func TestRenderOrderConfirmation(t *testing.T) {
+	m, err := renderEmail(emailOrderConfirmation, "ann@example.com", OrderEmail{
+		Username:   "ann",
+		OrderID:    3,
+		TotalPrice: Money{110050, "RUB"},
+		Items: []OrderEmailLine{
+			{Name: "Mug", Quantity: 2, Price: Money{50000, "RUB"}, Total: Money{100000, "RUB"}},
+			{Name: "<Spoon>", Quantity: 1, Price: Money{10050, "RUB"}, Total: Money{10050, "RUB"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Order #3 received" {
+		t.Errorf("subject = %q", m.Subject)
+	}
+	for _, want := range []string{"Mug x 2", "<Spoon> x 1", "500.00 RUB each", "Total: 1100.50 RUB"} {
+		if !strings.Contains(m.Text, want) {
+			t.Errorf("text is missing %q:\n%s", want, m.Text)
+		}
+	}
+	if !strings.Contains(m.HTML, "&lt;Spoon&gt;") || strings.Contains(m.HTML, "<Spoon>") {
+		t.Errorf("html does not escape product names:\n%s", m.HTML)
+	}
+}
+
+func TestFileMailerWritesMessage(t *testing.T) {
+	dir := t.TempDir()
+	f := fileMailer{dir: dir, from: "shop@example.com"}
+	if err := f.Send(context.Background(), Email{To: "ann@example.com", Subject: "Заказ", Text: "plain", HTML: "<p>html</p>"}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files = %v, %v", files, err)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: ann@example.com", "Subject: =?utf-8?q?", "multipart/alternative", "plain", "<p>html</p>"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("message is missing %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestSendDueEmailsRetriesWithBackoff(t *testing.T) {
+	cols := []string{"id", "to_address", "subject", "text_body", "html_body", "attempts"}
+	cases := []struct {
+		name     string
+		err      error
+		attempts int
+		expect   func(m sqlmock.Sqlmock)
+	}{
+		{name: "failure is retried later", err: errors.New("connection refused"), attempts: 1, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update email_queue set attempts").
+				WithArgs(2, "connection refused", sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "last attempt gives up", err: errors.New("connection refused"), attempts: emailMaxAttempts - 1, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update email_queue set status .* text_body = '', html_body = ''").
+				WithArgs(emailFailed, emailMaxAttempts, "connection refused", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "success is recorded", attempts: 0, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update email_queue set status .* text_body = '', html_body = ''").
+				WithArgs(emailSent, 1, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			db = mockDB
+			rec := &recordingMailer{err: tc.err}
+			mailer = rec
+
+			mock.ExpectQuery("update email_queue set next_attempt_at").
+				WillReturnRows(sqlmock.NewRows(cols).AddRow(1, "ann@example.com", "Hi", "text", "<p>html</p>", tc.attempts))
+			tc.expect(mock)
+			n, err := sendDueEmails(context.Background(), 10)
+			if err != nil || n != 1 {
+				t.Fatalf("sendDueEmails = %d, %v", n, err)
+			}
+			if len(rec.sent) != 1 || rec.sent[0].To != "ann@example.com" {
+				t.Errorf("sent = %v", rec.sent)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/chi/v5"
+)
+
+func loadSpec(t *testing.T) (*openapi3.T, routers.Router) {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		t.Fatalf("loading openapi.json: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+	// gorillamux carries a path-level servers override over to every path
+	// matched after it, so route on bare paths and let checkResponse strip
+	// the version prefix instead.
+	bare := *doc
+	bare.Servers = nil
+	bare.Paths = openapi3.NewPaths()
+	for path, item := range doc.Paths.Map() {
+		it := *item
+		it.Servers = nil
+		bare.Paths.Set(path, &it)
+	}
+	router, err := gorillamux.NewRouter(&bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc, router
+}
+
+// checkResponse validates a recorded response against the operation the
+// request maps to in openapi.json.
+func checkResponse(t *testing.T, router routers.Router, req *http.Request, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	req.URL.Path = strings.TrimPrefix(req.URL.Path, apiV1Prefix)
+	route, params, err := router.FindRoute(req)
+	if err != nil {
+		t.Fatalf("%s %s not in spec: %v", req.Method, req.URL.Path, err)
+	}
+	in := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: params,
+		Route:      route,
+		Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+	}
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: in,
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+	})
+	if err != nil {
+		t.Errorf("%s %s: response does not match spec: %v\nbody: %s", req.Method, req.URL.Path, err, rec.Body.String())
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	doc, _ := loadSpec(t)
+	// The fake gateway's routes are only there when it is the provider.
+	payments = newFakeProvider("test-secret")
+
+	registered := map[string]bool{}
+	err := chi.Walk(newRouter(), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		// Legacy aliases at the root share their spec entry with /api/v1.
+		route = strings.TrimPrefix(route, apiV1Prefix)
+		// Uploaded files aren't part of the API.
+		if strings.HasPrefix(route, mediaPrefix) {
+			return nil
+		}
+		key := method + " " + route
+		registered[key] = true
+		item := doc.Paths.Find(route)
+		if item == nil || item.GetOperation(method) == nil {
+			t.Errorf("%s is registered but missing from openapi.json", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !registered[method+" "+path] {
+				t.Errorf("%s %s is in openapi.json but not registered", method, path)
+			}
+		}
+	}
+}
+
+type contractCase struct {
+	name   string
+	method string
+	path   string
+	body   string
+	user   string
+	expect func(m sqlmock.Sqlmock)
+	status int
+	// contentType defaults to application/json when there's a body.
+	contentType string
+}
+
+// multipartImages builds a form with each file in the image field.
+func multipartImages(t *testing.T, files ...[]byte) (body, contentType string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i, data := range files {
+		fw, err := mw.CreateFormFile("image", fmt.Sprintf("photo%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	_, specRouter := loadSpec(t)
+
+	jwt_key = []byte("test-key")
+	fake := newFakeProvider("test-secret")
+	payments = fake
+	paid, err := fake.CreateIntent(context.Background(), money(1000), "order-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fake.confirm(paid.ID, eventPaymentSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs = localStore{dir: t.TempDir(), baseURL: mediaPrefix}
+	imageForm, imageFormType := multipartImages(t, testPNG(t, 640, 480))
+	textForm, textFormType := multipartImages(t, []byte("not an image"))
+	imageCols := []string{"id", "product_id", "position", "key", "content_type", "width", "height", "thumbnails", "created_at"}
+	imageRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(imageCols).
+			AddRow(1, 1, 0, "products/1/a/original.png", "image/png", 640, 480, []byte(`{"160":"products/1/a/160.png"}`), created).
+			AddRow(2, 1, 1, "products/1/b/original.jpg", "image/jpeg", 800, 600, []byte(`{"160":"products/1/b/160.jpg"}`), created)
+	}
+	shipTo := []byte(`{"full_name":"Ann Lee","phone":"","line1":"1 Main St","line2":"","city":"Almaty","region":"","postal_code":"050000","country":"KZ"}`)
+	addressCols := []string{"id", "full_name", "phone", "line1", "line2", "city", "region", "postal_code", "country", "is_default"}
+	userID := func(m sqlmock.Sqlmock) {
+		m.ExpectQuery("select id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	}
+	cartSummaryCols := []string{"id", "product_id", "name", "category", "price", "added_price", "quantity", "stock", "added_stock", "weight"}
+	orderLineCols := []string{"id", "name", "category", "quantity", "price", "stock", "weight", "tax_class", "override"}
+	couponCols := []string{"id", "code", "kind", "value", "min_total", "starts_at", "ends_at", "max_uses", "max_uses_per_user", "uses", "product_ids", "categories", "active", "created_at", "user_uses"}
+	admin := func(m sqlmock.Sqlmock) {
+		m.ExpectQuery("select role from users").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	}
+	taxRateCols := []string{"id", "tax_class", "country", "region", "name", "rate", "created_at"}
+	lockedItemCols := []string{"id", "product_id", "quantity", "price", "discount", "tax", "tax_rate", "refunded_quantity", "tax_added"}
+	shippingMethodRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "provider", "active", "created_at"}).AddRow(1, "Courier", "table", true, created)
+	}
+	shippingRateRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"method_id", "country", "region", "min_weight", "max_weight", "price", "per_kg", "free_above"}).
+			AddRow(1, "KZ", "", 0, 0, 500, 100, 0).
+			AddRow(1, "", "", 0, 0, 900, 0, 0)
+	}
+
+	cases := []contractCase{
+		{name: "list products", method: "GET", path: apiV1Prefix + "/products", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select products.id, products.name, products.price, products.image").WithArgs("RUB").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "image", "override"}).AddRow(1, "Mug", 500, "mug.png", nil))
+		}},
+		{name: "get product", method: "GET", path: apiV1Prefix + "/products/1", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select .* from products left join product_prices .* where products.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "name", "description", "price", "stock", "image", "category", "weight", "tax_class", "archived_at", "override"}).AddRow(1, "MUG-1", "Mug", "Big", 500, 3, "mug.png", "kitchen", 300, "standard", nil, nil))
+			m.ExpectQuery("from product_images where product_id").WithArgs(1).WillReturnRows(imageRows())
+		}},
+		{name: "product not found", method: "GET", path: apiV1Prefix + "/products/9", status: 404, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select .* from products left join product_prices .* where products.id").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		}},
+		{name: "create products", method: "POST", path: apiV1Prefix + "/products", user: "root", status: 200,
+			body: `[{"id":0,"name":"Mug","description":"Big","price":500,"stock":3,"image":""}]`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectExec("insert into products").WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectCommit()
+			}},
+		{name: "update product", method: "PUT", path: apiV1Prefix + "/products/1", user: "root", status: 200,
+			body: `{"id":1,"name":"Mug","description":"","price":600,"stock":0,"image":""}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectExec("UPDATE products SET").WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "delete product", method: "DELETE", path: apiV1Prefix + "/products/1", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectExec("update products set archived_at = now\\(\\) where id = \\$1 and archived_at is null").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("delete from cart where product_id").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 2))
+			m.ExpectCommit()
+		}},
+		{name: "delete archived product", method: "DELETE", path: apiV1Prefix + "/products/1", user: "root", status: 404, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectExec("update products set archived_at").WithArgs("1").WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectRollback()
+		}},
+		{name: "get archived product", method: "GET", path: apiV1Prefix + "/products/1", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select .* from products left join product_prices .* where products.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "name", "description", "price", "stock", "image", "category", "weight", "tax_class", "archived_at", "override"}).AddRow(1, "", "Mug", "Big", 500, 0, "", "kitchen", 300, "standard", created, nil))
+			m.ExpectQuery("from product_images where product_id").WithArgs(1).WillReturnRows(sqlmock.NewRows(imageCols))
+		}},
+		{name: "list archived products", method: "GET", path: apiV1Prefix + "/products/archived", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from products p where p.archived_at is not null").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "name", "archived_at", "ordered"}).AddRow(1, "MUG-1", "Mug", created, true).AddRow(4, "", "Cap", created, false))
+		}},
+		{name: "restore product", method: "POST", path: apiV1Prefix + "/products/1/restore", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("update products set archived_at = null where id = \\$1 and archived_at is not null").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "restore product that isn't archived", method: "POST", path: apiV1Prefix + "/products/2/restore", user: "root", status: 404, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("update products set archived_at = null").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+		}},
+		{name: "upload product images", method: "POST", path: apiV1Prefix + "/products/1/images", user: "root", status: 201,
+			body: imageForm, contentType: imageFormType,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("select id from products where id = \\$1 for update").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("select coalesce\\(max\\(position\\) \\+ 1, 0\\) from product_images").WillReturnRows(sqlmock.NewRows([]string{"next"}).AddRow(0))
+				m.ExpectQuery("insert into product_images").WithArgs(1, 0, sqlmock.AnyArg(), "image/png", 640, 480, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+				m.ExpectExec("update products set image").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			}},
+		{name: "upload images to missing product", method: "POST", path: apiV1Prefix + "/products/9/images", user: "root", status: 404,
+			body: imageForm, contentType: imageFormType,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("select id from products where id = \\$1 for update").WithArgs(9).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				m.ExpectRollback()
+			}},
+		{name: "upload something that isn't an image", method: "POST", path: apiV1Prefix + "/products/1/images", user: "root", status: 415,
+			body: textForm, contentType: textFormType, expect: admin},
+		{name: "list product images", method: "GET", path: apiV1Prefix + "/products/1/images", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("from product_images where product_id").WithArgs(1).WillReturnRows(imageRows())
+		}},
+		{name: "reorder product images", method: "PUT", path: apiV1Prefix + "/products/1/images/order", user: "root", status: 200,
+			body: `{"ids":[2,1]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("select id from products where id = \\$1 for update").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("from product_images where product_id").WithArgs(1).WillReturnRows(imageRows())
+				m.ExpectExec("update product_images set position").WithArgs(0, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("update product_images set position").WithArgs(1, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("update products set image").WithArgs(1, "/media/products/1/b/original.jpg").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			}},
+		{name: "reorder product images leaving one out", method: "PUT", path: apiV1Prefix + "/products/1/images/order", user: "root", status: 400,
+			body: `{"ids":[2]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("select id from products where id = \\$1 for update").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				m.ExpectQuery("from product_images where product_id").WithArgs(1).WillReturnRows(imageRows())
+				m.ExpectRollback()
+			}},
+		{name: "delete product image", method: "DELETE", path: apiV1Prefix + "/products/1/images/1", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectQuery("delete from product_images").WithArgs(1, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"key", "thumbnails"}).AddRow("products/1/a/original.png", []byte(`{"160":"products/1/a/160.png"}`)))
+			m.ExpectQuery("from product_images where product_id").WithArgs(1).
+				WillReturnRows(sqlmock.NewRows(imageCols).AddRow(2, 1, 1, "products/1/b/original.jpg", "image/jpeg", 800, 600, []byte(`{}`), created))
+			m.ExpectExec("update products set image").WithArgs(1, "/media/products/1/b/original.jpg", "/media/products/1/a/original.png").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+		}},
+		{name: "dry-run a product import", method: "POST", path: apiV1Prefix + "/products/import?dry_run=true", user: "root", status: 200,
+			body: "sku,name,price,stock\nMUG-1,Mug,600,5\n,Tee,1500,2\n", contentType: "text/csv",
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectExec("savepoint import_row").WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectQuery("select id, archived_at is not null from products where sku").WithArgs("MUG-1").WillReturnRows(sqlmock.NewRows([]string{"id", "archived"}).AddRow(1, false))
+				m.ExpectExec("update products set sku = nullif\\(\\$2, ''\\), name = \\$3, price = \\$4, stock = \\$5 where id = \\$1").
+					WithArgs(1, "MUG-1", "Mug", 600, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("savepoint import_row").WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectQuery("from products where name").WithArgs("Tee").WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "archived"}))
+				m.ExpectQuery("insert into products").WithArgs("", "Tee", "", 1500, 2, "", "", 0, defaultTaxClass).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				m.ExpectRollback()
+			}},
+		{name: "import products with a bad row", method: "POST", path: apiV1Prefix + "/products/import", user: "root", status: 422,
+			body: `[{"name":"Mug","stock":-1},{"name":"Tee","price":1500}]`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectExec("savepoint import_row").WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectQuery("from products where name").WithArgs("Tee").WillReturnRows(sqlmock.NewRows([]string{"id", "sku", "archived"}))
+				m.ExpectQuery("insert into products").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				m.ExpectRollback()
+			}},
+		{name: "import products from an unknown format", method: "POST", path: apiV1Prefix + "/products/import", user: "root", status: 415,
+			body: "<products/>", contentType: "application/xml", expect: admin},
+		{name: "import products with an unknown column", method: "POST", path: apiV1Prefix + "/products/import", user: "root", status: 400,
+			body: "name,colour\nMug,red\n", contentType: "text/csv", expect: admin},
+		{name: "export products as csv", method: "GET", path: apiV1Prefix + "/products/export", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("select coalesce\\(sku, ''\\), name, description, price, stock, image, category, weight, tax_class from products where archived_at is null order by id").
+				WillReturnRows(sqlmock.NewRows([]string{"sku", "name", "description", "price", "stock", "image", "category", "weight", "tax_class"}).
+					AddRow("MUG-1", "Mug", "Big, white", 500, 3, "mug.png", "kitchen", 300, "standard"))
+		}},
+		{name: "export products as json", method: "GET", path: apiV1Prefix + "/products/export?format=json", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from products where archived_at is null order by id").
+				WillReturnRows(sqlmock.NewRows([]string{"sku", "name", "description", "price", "stock", "image", "category", "weight", "tax_class"}).
+					AddRow("MUG-1", "Mug", "Big", 500, 3, "mug.png", "kitchen", 300, "standard").
+					AddRow("", "Tee", "", 1500, 2, "", "", 0, "standard"))
+		}},
+		{name: "delete missing product image", method: "DELETE", path: apiV1Prefix + "/products/1/images/9", user: "root", status: 404, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectQuery("delete from product_images").WithArgs(9, 1).WillReturnRows(sqlmock.NewRows([]string{"key", "thumbnails"}))
+			m.ExpectRollback()
+		}},
+		{name: "register", method: "POST", path: apiV1Prefix + "/registration", status: 200,
+			body: `{"username":"ann","password":"secret","email":"ann@example.com","role":"user"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectExec("insert into users").WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "login", method: "POST", path: apiV1Prefix + "/login", status: 200, body: `{"nameoremail":"ann","password":"secret"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select username, password_hash from users").
+				WillReturnRows(sqlmock.NewRows([]string{"username", "password_hash"}).AddRow("ann", hashed))
+		}},
+		{name: "profile", method: "GET", path: apiV1Prefix + "/profile", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select username, email, role from users").
+				WillReturnRows(sqlmock.NewRows([]string{"username", "email", "role"}).AddRow("ann", "ann@example.com", "user"))
+		}},
+		{name: "notification preferences", method: "GET", path: apiV1Prefix + "/profile/notifications", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from notification_preferences").WillReturnRows(sqlmock.NewRows([]string{"order_confirmation", "order_status"}))
+		}},
+		{name: "update notification preferences", method: "PUT", path: apiV1Prefix + "/profile/notifications", user: "ann", status: 200,
+			body: `{"order_confirmation":true,"order_status":false}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectExec("insert into notification_preferences").WithArgs(7, true, false).WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "forgot password", method: "POST", path: apiV1Prefix + "/password/forgot", status: 200, body: `{"email":"ann@example.com"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select id, username, email from users").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(7, "ann", "ann@example.com"))
+			m.ExpectBegin()
+			m.ExpectExec("insert into password_resets").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("insert into email_queue").WithArgs(7, "", emailPasswordReset, "ann@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+		}},
+		{name: "forgot password for unknown email", method: "POST", path: apiV1Prefix + "/password/forgot", status: 200, body: `{"email":"nobody@example.com"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select id, username, email from users").WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}))
+		}},
+		{name: "reset password", method: "POST", path: apiV1Prefix + "/password/reset", status: 200, body: `{"token":"abc","password":"new-secret"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery("update password_resets set used_at").WithArgs(hashResetToken("abc")).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+			m.ExpectExec("update users set password_hash").WithArgs(sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+		}},
+		{name: "reset password with used token", method: "POST", path: apiV1Prefix + "/password/reset", status: 400, body: `{"token":"abc","password":"new-secret"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery("update password_resets set used_at").WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+			m.ExpectRollback()
+		}},
+		{name: "get cart", method: "GET", path: apiV1Prefix + "/cart/", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select cart.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "quantity"}).AddRow(4, "Mug", "500", 2))
+		}},
+		{name: "cart summary", method: "GET", path: apiV1Prefix + "/cart/summary", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select cart.id, products.id").
+				WillReturnRows(sqlmock.NewRows(cartSummaryCols).AddRow(4, 1, "Mug", "kitchen", 550, 500, 2, 5, 5, 300))
+			m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+		}},
+		{name: "cart summary with coupon", method: "GET", path: apiV1Prefix + "/cart/summary", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select cart.id, products.id").
+				WillReturnRows(sqlmock.NewRows(cartSummaryCols).AddRow(4, 1, "Mug", "kitchen", 500, 500, 2, 5, 5, 300))
+			m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols).
+				AddRow(1, "SAVE10", couponPercent, 10, 0, nil, nil, 0, 1, 0, "{}", "{}", true, created, 0))
+		}},
+		{name: "apply coupon", method: "POST", path: apiV1Prefix + "/cart/coupon", user: "ann", status: 200, body: `{"code":"save10"}`, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from coupons where code").WithArgs("SAVE10", 7).WillReturnRows(sqlmock.NewRows(couponCols).
+				AddRow(1, "SAVE10", couponPercent, 10, 0, nil, nil, 0, 1, 0, "{}", "{}", true, created, 0))
+			m.ExpectQuery("select products.id, products.category").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "category", "price", "quantity"}).AddRow(1, "kitchen", 500, 2))
+			m.ExpectExec("insert into cart_coupons").WithArgs(7, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectQuery("select cart.id, products.id").
+				WillReturnRows(sqlmock.NewRows(cartSummaryCols).AddRow(4, 1, "Mug", "kitchen", 500, 500, 2, 5, 5, 300))
+			m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols).
+				AddRow(1, "SAVE10", couponPercent, 10, 0, nil, nil, 0, 1, 0, "{}", "{}", true, created, 0))
+		}},
+		{name: "apply coupon below minimum", method: "POST", path: apiV1Prefix + "/cart/coupon", user: "ann", status: 400, body: `{"code":"BIG"}`, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from coupons where code").WillReturnRows(sqlmock.NewRows(couponCols).
+				AddRow(2, "BIG", couponFixed, 500, 5000, nil, nil, 0, 0, 0, "{}", "{}", true, created, 0))
+			m.ExpectQuery("select products.id, products.category").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "category", "price", "quantity"}).AddRow(1, "kitchen", 500, 2))
+		}},
+		{name: "apply unknown coupon", method: "POST", path: apiV1Prefix + "/cart/coupon", user: "ann", status: 404, body: `{"code":"NOPE"}`, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from coupons where code").WillReturnRows(sqlmock.NewRows(couponCols))
+		}},
+		{name: "remove coupon", method: "DELETE", path: apiV1Prefix + "/cart/coupon", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectExec("delete from cart_coupons").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectQuery("select cart.id, products.id").
+				WillReturnRows(sqlmock.NewRows(cartSummaryCols).AddRow(4, 1, "Mug", "kitchen", 500, 500, 2, 5, 5, 300))
+			m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+		}},
+		{name: "add to cart", method: "POST", path: apiV1Prefix + "/cart/add", user: "ann", status: 200, body: `[{"product_id":1,"quantity":2}]`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+			m.ExpectBegin()
+			m.ExpectQuery("select p.price, p.stock").WillReturnRows(sqlmock.NewRows([]string{"price", "stock", "quantity"}).AddRow(500, 5, 0))
+			m.ExpectExec("insert into cart").WillReturnResult(sqlmock.NewResult(1, 1))
+			m.ExpectCommit()
+		}},
+		{name: "add to cart with negative quantity", method: "POST", path: apiV1Prefix + "/cart/add", user: "ann", status: 400, body: `[{"product_id":1,"quantity":-2}]`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+			m.ExpectBegin()
+			m.ExpectRollback()
+		}},
+		{name: "update cart line", method: "PATCH", path: apiV1Prefix + "/cart/4", user: "ann", status: 200, body: `{"quantity":3}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery("select products.stock from cart").WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(5))
+			m.ExpectExec("update cart set quantity").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+			m.ExpectQuery("select cart.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "quantity"}).AddRow(4, "Mug", "500", 3))
+		}},
+		{name: "update cart line over stock", method: "PATCH", path: apiV1Prefix + "/cart/4", user: "ann", status: 409, body: `{"quantity":9}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery("select products.stock from cart").WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(5))
+			m.ExpectRollback()
+		}},
+		{name: "remove from cart", method: "POST", path: apiV1Prefix + "/cart/remove", user: "ann", status: 200, body: `{"id":4}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "clear cart", method: "DELETE", path: apiV1Prefix + "/cart/clear", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "create order", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 200,
+			body: `{"user_id":0,"status":"new","total_price":1000,"created_at":"2025-08-01T12:00:00Z"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols))
+				m.ExpectQuery("insert into orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				m.ExpectExec("insert into payments").WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "create order from empty cart", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 400, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols))
+				m.ExpectRollback()
+			}},
+		{name: "order payments", method: "GET", path: apiV1Prefix + "/orders/3/payments", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("from payments join orders").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "provider", "intent_id", "amount", "status", "created_at", "updated_at"}).
+					AddRow(1, 3, "fake", "fake_pi_1", 1000, "succeeded", created, created))
+		}},
+		{name: "order items", method: "GET", path: apiV1Prefix + "/orders/3/items", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("from order_items join orders").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "quantity", "price", "discount", "tax", "tax_rate", "refunded_quantity"}).AddRow(5, 1, 2, 500, 0, 0, 0, 1))
+		}},
+		{name: "order refunds", method: "GET", path: apiV1Prefix + "/orders/3/refunds", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("from refunds join orders").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "provider_refund_id", "amount", "reason", "restocked", "created_at", "order_item_id", "quantity"}).
+					AddRow(1, 3, "fake_re_1", 500, "broken", true, created, 5, 1).
+					AddRow(2, 3, "fake_re_2", 100, "late", false, created, nil, nil))
+		}},
+		{name: "partial refund", method: "POST", path: apiV1Prefix + "/orders/3/refunds", user: "root", status: 201,
+			body: `{"items":[{"item_id":5,"quantity":1}],"restock":true,"reason":"broken"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("from refunds join payments").WithArgs(3, refundPending).WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id", "amount"}))
+				m.ExpectBegin()
+				m.ExpectQuery("select status, total_price, refunded_amount, .* from orders").
+					WillReturnRows(sqlmock.NewRows([]string{"status", "total_price", "refunded_amount", "pending"}).AddRow("paid", 1000, 0, 0))
+				m.ExpectQuery("select id, intent_id from payments").WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id"}).AddRow(1, paid.ID))
+				m.ExpectQuery("from order_items join orders .* for update of order_items").
+					WillReturnRows(sqlmock.NewRows(lockedItemCols).AddRow(5, 1, 2, 500, 0, 0, 0, 0, true))
+				m.ExpectQuery("insert into refunds").WithArgs(3, 1, 500, "broken", true, refundPending).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+				m.ExpectExec("insert into refund_items").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				// The provider has paid out; the refund is applied to the order.
+				m.ExpectBegin()
+				m.ExpectQuery("from orders join refunds .* for update of orders").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "status", "total_price", "refunded_amount"}).AddRow(3, "paid", 1000, 0))
+				m.ExpectQuery("update refunds set status").WithArgs(refundSucceeded, sqlmock.AnyArg(), 1, refundPending).
+					WillReturnRows(sqlmock.NewRows([]string{"amount", "restocked"}).AddRow(500, true))
+				m.ExpectExec("update order_items set refunded_quantity").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("update products set stock = products.stock \\+ refund_items.quantity").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("update orders set refunded_amount").WithArgs(500, orderPartiallyRefunded, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderStatusChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			}},
+		{name: "refund more than paid", method: "POST", path: apiV1Prefix + "/orders/3/refunds", user: "root", status: 400, body: `{"amount":5000}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("from refunds join payments").WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id", "amount"}))
+				m.ExpectBegin()
+				m.ExpectQuery("select status, total_price, refunded_amount, .* from orders").
+					WillReturnRows(sqlmock.NewRows([]string{"status", "total_price", "refunded_amount", "pending"}).AddRow("paid", 1000, 500, 0))
+				m.ExpectQuery("select id, intent_id from payments").WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id"}).AddRow(1, paid.ID))
+				m.ExpectQuery("from order_items join orders .* for update of order_items").
+					WillReturnRows(sqlmock.NewRows(lockedItemCols).AddRow(5, 1, 2, 500, 0, 0, 0, 1, true))
+				m.ExpectRollback()
+			}},
+		{name: "refund unpaid order", method: "POST", path: apiV1Prefix + "/orders/3/refunds", user: "root", status: 409, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("from refunds join payments").WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id", "amount"}))
+				m.ExpectBegin()
+				m.ExpectQuery("select status, total_price, refunded_amount, .* from orders").
+					WillReturnRows(sqlmock.NewRows([]string{"status", "total_price", "refunded_amount", "pending"}).AddRow("pending_payment", 1000, 0, 0))
+				m.ExpectQuery("select id, intent_id from payments").WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id"}))
+				m.ExpectRollback()
+			}},
+		{name: "create coupon", method: "POST", path: apiV1Prefix + "/coupons/", user: "root", status: 201,
+			body: `{"code":"save10","kind":"percent","value":10,"max_uses_per_user":1,"categories":["kitchen"]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("insert into coupons").WithArgs("SAVE10", couponPercent, 10, 0, nil, nil, 0, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+			}},
+		{name: "create coupon with bad percentage", method: "POST", path: apiV1Prefix + "/coupons/", user: "root", status: 400,
+			body: `{"code":"half","kind":"percent","value":150}`, expect: admin},
+		{name: "list coupons", method: "GET", path: apiV1Prefix + "/coupons/", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from coupons order by id").WillReturnRows(sqlmock.NewRows(couponCols[:len(couponCols)-1]).
+				AddRow(1, "SAVE10", couponPercent, 10, 0, created, nil, 100, 1, 3, "{2,5}", `{kitchen,"home decor"}`, true, created))
+		}},
+		{name: "deactivate coupon", method: "DELETE", path: apiV1Prefix + "/coupons/1", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("update coupons set active = false").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "create order with coupon", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 200, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil).AddRow(2, "Tee", "clothes", 1, 1500, 5, 200, "standard", nil))
+				m.ExpectQuery("from cart_coupons .* for update of coupons").WillReturnRows(sqlmock.NewRows(couponCols).
+					AddRow(1, "SAVE10", couponPercent, 10, 0, nil, nil, 0, 1, 0, "{}", "{kitchen}", true, created, 0))
+				m.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols))
+				m.ExpectQuery("insert into orders").WithArgs(7, orderPendingPayment, 2400, sqlmock.AnyArg(), 100, "SAVE10", false, nil, nil, 0, 0, false, sqlmock.AnyArg(), "RUB", 1.0).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				m.ExpectExec("insert into coupon_redemptions").WithArgs(1, 7, 3, 100).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update coupons set uses").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart_coupons").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WithArgs(3, 1, 2, 500, 100, 0, 0).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WithArgs(3, 2, 1, 1500, 0, 0, 0).WillReturnResult(sqlmock.NewResult(2, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				m.ExpectExec("insert into payments").WithArgs(3, "fake", sqlmock.AnyArg(), 2400, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "create order with expired coupon", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 409, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols).
+					AddRow(1, "SAVE10", couponPercent, 10, 0, nil, created, 0, 1, 0, "{}", "{}", true, created, 0))
+				m.ExpectRollback()
+			}},
+		{name: "shipping quote", method: "GET", path: apiV1Prefix + "/shipping/quote", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+				AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+			m.ExpectQuery("select cart.id, products.id").
+				WillReturnRows(sqlmock.NewRows(cartSummaryCols).AddRow(4, 1, "Mug", "kitchen", 500, 500, 2, 5, 5, 300))
+			m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+			m.ExpectQuery("from shipping_methods").WithArgs(true, 0).WillReturnRows(shippingMethodRows())
+			m.ExpectQuery("from shipping_rates").WillReturnRows(shippingRateRows())
+		}},
+		{name: "create shipping method", method: "POST", path: apiV1Prefix + "/shipping/methods", user: "root", status: 201,
+			body: `{"name":"Courier","rates":[{"country":"kz","price":500,"per_kg":100},{"price":900}]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("insert into shipping_methods").WithArgs("Courier", "table").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+				m.ExpectExec("delete from shipping_rates").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectExec("insert into shipping_rates").WithArgs(1, "KZ", "", 0, 0, 500, 100, 0).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("insert into shipping_rates").WithArgs(1, "", "", 0, 0, 900, 0, 0).WillReturnResult(sqlmock.NewResult(2, 1))
+				m.ExpectCommit()
+			}},
+		{name: "create table shipping method without rates", method: "POST", path: apiV1Prefix + "/shipping/methods", user: "root", status: 400,
+			body: `{"name":"Courier"}`, expect: admin},
+		{name: "list shipping methods", method: "GET", path: apiV1Prefix + "/shipping/methods", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from shipping_methods").WithArgs(false, 0).WillReturnRows(shippingMethodRows())
+			m.ExpectQuery("from shipping_rates").WillReturnRows(shippingRateRows())
+		}},
+		{name: "update missing shipping method", method: "PUT", path: apiV1Prefix + "/shipping/methods/9", user: "root", status: 404,
+			body: `{"name":"Courier","rates":[{"price":900}]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectBegin()
+				m.ExpectQuery("update shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"active", "created_at"}))
+				m.ExpectRollback()
+			}},
+		{name: "deactivate shipping method", method: "DELETE", path: apiV1Prefix + "/shipping/methods/1", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("update shipping_methods set active = false").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "create order with shipping", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 200, body: `{"shipping_method_id":1}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				// Shipping is quoted before the transaction locks the cart.
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("from shipping_methods").WithArgs(true, 1).WillReturnRows(shippingMethodRows())
+				m.ExpectQuery("from shipping_rates").WillReturnRows(shippingRateRows())
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category.* for update of cart, products").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons .* for update of coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols))
+				m.ExpectQuery("insert into orders").WithArgs(7, orderPendingPayment, 1600, sqlmock.AnyArg(), 0, nil, false, 1, "Courier", 600, 0, false, sqlmock.AnyArg(), "RUB", 1.0).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				m.ExpectExec("insert into payments").WithArgs(3, "fake", sqlmock.AnyArg(), 1600, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "create order when the cart changes while shipping is quoted", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 409, body: `{"shipping_method_id":1}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("from shipping_methods").WithArgs(true, 1).WillReturnRows(shippingMethodRows())
+				m.ExpectQuery("from shipping_rates").WillReturnRows(shippingRateRows())
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 3, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectRollback()
+			}},
+		{name: "create order without choosing shipping", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 400, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				m.ExpectRollback()
+			}},
+		{name: "create tax rate", method: "POST", path: apiV1Prefix + "/tax/rates/", user: "root", status: 201,
+			body: `{"country":"kz","name":"VAT","rate":1200}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("insert into tax_rates").WithArgs(defaultTaxClass, "KZ", "", "VAT", 1200).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+			}},
+		{name: "create tax rate over 100%", method: "POST", path: apiV1Prefix + "/tax/rates/", user: "root", status: 400,
+			body: `{"name":"VAT","rate":12000}`, expect: admin},
+		{name: "list tax rates", method: "GET", path: apiV1Prefix + "/tax/rates/", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols).
+				AddRow(1, "standard", "KZ", "", "VAT", 1200, created).
+				AddRow(2, "reduced", "KZ", "", "VAT reduced", 500, created))
+		}},
+		{name: "delete tax rate", method: "DELETE", path: apiV1Prefix + "/tax/rates/1", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("delete from tax_rates").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "create order with tax", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 200, body: `{}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select products.id, products.name, products.category").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols).AddRow(1, "standard", "KZ", "", "VAT", 1200, created))
+				m.ExpectQuery("insert into orders").WithArgs(7, orderPendingPayment, 1120, sqlmock.AnyArg(), 0, nil, false, nil, nil, 0, 120, false, sqlmock.AnyArg(), "RUB", 1.0).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WithArgs(3, 1, 2, 500, 0, 120, 1200).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				m.ExpectExec("insert into payments").WithArgs(3, "fake", sqlmock.AnyArg(), 1120, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "list products in another currency", method: "GET", path: apiV1Prefix + "/products?currency=kzt", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select rate from exchange_rates").WithArgs("KZT").WillReturnRows(sqlmock.NewRows([]string{"rate"}).AddRow(5.5))
+			m.ExpectQuery("select products.id, products.name, products.price, products.image").WithArgs("KZT").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "image", "override"}).
+					AddRow(1, "Mug", 500, "mug.png", nil).
+					AddRow(2, "Tee", 1500, "tee.png", 7990))
+		}},
+		{name: "list products in a currency without a rate", method: "GET", path: apiV1Prefix + "/products?currency=USD", status: 400, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select rate from exchange_rates").WithArgs("USD").WillReturnRows(sqlmock.NewRows([]string{"rate"}))
+		}},
+		{name: "get product in an unknown currency", method: "GET", path: apiV1Prefix + "/products/1?currency=XYZ", status: 400},
+		{name: "list exchange rates", method: "GET", path: apiV1Prefix + "/exchange-rates", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("from exchange_rates").WillReturnRows(sqlmock.NewRows([]string{"currency", "rate", "updated_at"}).AddRow("KZT", 5.5, created))
+		}},
+		{name: "set exchange rate", method: "PUT", path: apiV1Prefix + "/exchange-rates/kzt", user: "root", status: 200, body: `{"rate":5.5}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("insert into exchange_rates").WithArgs("KZT", 5.5).
+					WillReturnRows(sqlmock.NewRows([]string{"rate", "updated_at"}).AddRow(5.5, created))
+			}},
+		{name: "set exchange rate for the shop currency", method: "PUT", path: apiV1Prefix + "/exchange-rates/RUB", user: "root", status: 400,
+			body: `{"rate":1}`, expect: admin},
+		{name: "set product price", method: "PUT", path: apiV1Prefix + "/products/2/prices/KZT", user: "root", status: 200, body: `{"price":7990}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectExec("insert into product_prices").WithArgs(2, "KZT", 7990).WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "list product prices", method: "GET", path: apiV1Prefix + "/products/2/prices", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from product_prices").WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"currency", "price"}).AddRow("KZT", 7990))
+		}},
+		{name: "delete missing product price", method: "DELETE", path: apiV1Prefix + "/products/2/prices/USD", user: "root", status: 404, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectExec("delete from product_prices").WithArgs(2, "USD").WillReturnResult(sqlmock.NewResult(0, 0))
+		}},
+		{name: "create order in another currency", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 200, body: `{"currency":"KZT"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+				m.ExpectBegin()
+				m.ExpectQuery("select rate from exchange_rates").WithArgs("KZT").WillReturnRows(sqlmock.NewRows([]string{"rate"}).AddRow(5.5))
+				m.ExpectQuery("select products.id, products.name, products.category").WithArgs(7, "KZT").
+					WillReturnRows(sqlmock.NewRows(orderLineCols).
+						AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil).
+						AddRow(2, "Tee", "clothes", 1, 1500, 5, 200, "standard", 7990))
+				m.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(couponCols))
+				m.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(taxRateCols))
+				m.ExpectQuery("insert into orders").WithArgs(7, orderPendingPayment, 13490, sqlmock.AnyArg(), 0, nil, false, nil, nil, 0, 0, false, sqlmock.AnyArg(), "KZT", 5.5).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WithArgs(3, 1, 2, 2750, 0, 0, 0).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("insert into order_items").WithArgs(3, 2, 1, 7990, 0, 0, 0).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+				m.ExpectExec("insert into payments").WithArgs(3, "fake", sqlmock.AnyArg(), 13490, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}},
+		{name: "create webhook", method: "POST", path: apiV1Prefix + "/webhooks/", user: "root", status: 201,
+			body: `{"url":"https://warehouse.example.com/hooks","events":["order.created","product.stock_low"]}`,
+			expect: func(m sqlmock.Sqlmock) {
+				admin(m)
+				m.ExpectQuery("insert into webhook_subscriptions").WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, created))
+			}},
+		{name: "create webhook with unknown event", method: "POST", path: apiV1Prefix + "/webhooks/", user: "root", status: 400,
+			body: `{"url":"https://warehouse.example.com/hooks","events":["order.eaten"]}`, expect: admin},
+		{name: "webhook deliveries", method: "GET", path: apiV1Prefix + "/webhooks/1/deliveries", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("from webhook_deliveries where subscription_id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event_id", "event_type", "payload", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "created_at", "delivered_at"}).
+					AddRow(2, 1, "evt_2", "order.created", []byte(`{"id":"evt_2","type":"order.created","created_at":"2025-08-01T12:00:00Z","data":{"order_id":3,"status":"pending_payment","total_price":100000,"currency":"RUB"}}`), "pending", 1, created, 503, "subscriber responded 503 Service Unavailable", created, nil).
+					AddRow(1, 1, "evt_1", "order.created", []byte(`{"id":"evt_1","type":"order.created","created_at":"2025-08-01T12:00:00Z","data":{"order_id":2,"status":"pending_payment","total_price":100000,"currency":"RUB"}}`), "succeeded", 1, created, 200, "", created, created))
+		}},
+		{name: "webhooks are admin only", method: "GET", path: apiV1Prefix + "/webhooks/", user: "ann", status: 403, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select role from users").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+		}},
+		{name: "fake payments are confirmed by admins only", method: "POST", path: apiV1Prefix + "/payments/fake/fake_pi_1/confirm", user: "ann", status: 403, body: `{"outcome":"payment.succeeded"}`, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select role from users").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+		}},
+		{name: "webhook with bad signature", method: "POST", path: apiV1Prefix + "/payments/webhook", status: 401,
+			body: `{"type":"payment.succeeded","intent_id":"fake_pi_1","amount":1000}`},
+		{name: "admin cannot mark paid", method: "POST", path: apiV1Prefix + "/orders/update", user: "root", status: 400, body: `{"id":3,"status":"paid"}`, expect: admin},
+		{name: "list orders", method: "GET", path: apiV1Prefix + "/orders/", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select orders.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "status", "total_price", "created_at", "shipping_address", "discount", "coupon_code", "shipping_method", "shipping_price", "tax", "tax_inclusive", "tax_breakdown", "currency", "exchange_rate"}).AddRow(3, "new", 1000, created, shipTo, 100, "SAVE10", "Courier", 300, 100, false, `[{"name":"VAT","rate":1200,"taxable":600,"amount":72}]`, "RUB", 1.0))
+		}},
+		{name: "get order", method: "GET", path: apiV1Prefix + "/orders/3", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select orders.id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "status", "total_price", "created_at", "shipping_address", "discount", "coupon_code", "shipping_method", "shipping_price", "tax", "tax_inclusive", "tax_breakdown", "currency", "exchange_rate"}).AddRow(3, "new", 1000, created, nil, 0, nil, nil, 0, 0, false, "[]", "RUB", 1.0))
+		}},
+		{name: "all orders", method: "GET", path: apiV1Prefix + "/orders/getall", user: "root", status: 200, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectQuery("select .* from orders").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "status", "total_price", "created_at", "shipping_address", "discount", "coupon_code", "shipping_method", "shipping_price", "tax", "tax_inclusive", "tax_breakdown", "currency", "exchange_rate"}).AddRow(3, 7, "new", 1000, created, shipTo, 0, nil, "Courier", 300, 0, false, "[]", "RUB", 1.0))
+		}},
+		{name: "update order status", method: "POST", path: apiV1Prefix + "/orders/update", user: "root", status: 200, body: `{"id":3,"status":"shipped"}`, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectQuery("select status from orders where id = .* for update").WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(orderPaid))
+			m.ExpectExec("update orders set status").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderStatusChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+		}},
+		{name: "admin cannot ship an unpaid order", method: "POST", path: apiV1Prefix + "/orders/update", user: "root", status: 409, body: `{"id":3,"status":"shipped"}`, expect: func(m sqlmock.Sqlmock) {
+			admin(m)
+			m.ExpectBegin()
+			m.ExpectQuery("select status from orders where id = .* for update").WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(orderPendingPayment))
+			m.ExpectRollback()
+		}},
+		{name: "list addresses", method: "GET", path: apiV1Prefix + "/addresses/", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols).
+				AddRow(2, "Ann Lee", "", "1 Main St", "", "Almaty", "", "050000", "KZ", true))
+		}},
+		{name: "create address", method: "POST", path: apiV1Prefix + "/addresses/", user: "ann", status: 201,
+			body: `{"full_name":"Ann Lee","line1":"1 Main St","city":"Almaty","country":"KZ"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectBegin()
+				m.ExpectQuery("select count").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				m.ExpectExec("update addresses set is_default = false").WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectQuery("insert into addresses").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				m.ExpectCommit()
+			}},
+		{name: "create address missing fields", method: "POST", path: apiV1Prefix + "/addresses/", user: "ann", status: 400,
+			body: `{"full_name":"Ann Lee"}`, expect: userID},
+		{name: "update address", method: "PUT", path: apiV1Prefix + "/addresses/2", user: "ann", status: 200,
+			body: `{"full_name":"Ann Lee","line1":"2 Main St","city":"Almaty","country":"KZ"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("update addresses set full_name").WillReturnRows(sqlmock.NewRows(addressCols).
+					AddRow(2, "Ann Lee", "", "2 Main St", "", "Almaty", "", "", "KZ", true))
+			}},
+		{name: "delete address", method: "DELETE", path: apiV1Prefix + "/addresses/2", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectBegin()
+			m.ExpectQuery("delete from addresses").WillReturnRows(sqlmock.NewRows([]string{"is_default"}).AddRow(false))
+			m.ExpectCommit()
+		}},
+		{name: "set default address", method: "POST", path: apiV1Prefix + "/addresses/3/default", user: "ann", status: 200, expect: func(m sqlmock.Sqlmock) {
+			userID(m)
+			m.ExpectBegin()
+			m.ExpectExec("update addresses set is_default = false").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectQuery("update addresses set is_default = true").WillReturnRows(sqlmock.NewRows(addressCols).
+				AddRow(3, "Ann Lee", "", "9 Side St", "", "Astana", "", "", "KZ", true))
+			m.ExpectCommit()
+		}},
+		{name: "create order without address", method: "POST", path: apiV1Prefix + "/orders/", user: "ann", status: 400,
+			body: `{"status":"new","total_price":1000,"created_at":"2025-08-01T12:00:00Z"}`,
+			expect: func(m sqlmock.Sqlmock) {
+				userID(m)
+				m.ExpectQuery("from addresses where user_id").WillReturnRows(sqlmock.NewRows(addressCols))
+			}},
+		{name: "healthz", method: "GET", path: "/healthz", status: 200},
+		{name: "readyz", method: "GET", path: "/readyz", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery("select max").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(latestMigration()))
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			db = mockDB
+			if tc.expect != nil {
+				tc.expect(mock)
+			}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			} else if tc.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tc.user != "" {
+				token, err := generateJWT(tc.user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			specReq := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			specReq.Header = req.Header
+			checkResponse(t, specRouter, specReq, rec)
+		})
+	}
+}
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("select products.id, products.name, products.price, products.image").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "price", "image", "override"}))
+	}
+
+	router := newRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/products", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("legacy status = %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") == "" || rec.Header().Get("Sunset") == "" {
+		t.Errorf("legacy route missing Deprecation/Sunset headers: %v", rec.Header())
+	}
+	if got, want := rec.Header().Get("Link"), `</api/v1/products>; rel="successor-version"`; got != want {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", apiV1Prefix+"/products", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("v1 status = %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") != "" {
+		t.Errorf("v1 route should not be deprecated")
+	}
+}
+
+func TestPaymentWebhookMarksOrderPaid(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	fake := newFakeProvider("test-secret")
+	payments = fake
+
+	intent, err := fake.CreateIntent(context.Background(), money(1000), "order-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, header, err := fake.confirm(intent.ID, eventPaymentSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select order_id, status from payments").
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "status"}).AddRow(3, paymentRequiresConfirmation))
+	mock.ExpectExec("update payments set status").WithArgs(paymentSucceeded, "fake", intent.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update orders set status").WithArgs(orderPaid, 3, orderPendingPayment).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderStatusChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", apiV1Prefix+"/payments/webhook", bytes.NewReader(payload))
+	req.Header = header
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdempotentResponseIsStoredAfterClientLeaves(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	body := []byte(`{"message":"Order created"}`)
+	sum := sha256.Sum256([]byte("POST /orders/\n"))
+	hash := hex.EncodeToString(sum[:])
+
+	mock.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into idempotency_keys").WithArgs("ann", "k1", hash).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update idempotency_keys set status").WithArgs(201, "application/json", body, "ann", "k1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select request_hash, status, content_type, body from idempotency_keys").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body"}).AddRow(hash, 201, "application/json", body))
+
+	runs := 0
+	h := Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	send := func(cancelAfter bool) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), usernameKey, "ann"))
+		defer cancel()
+		req := httptest.NewRequest("POST", "/orders/", nil).WithContext(ctx)
+		req.Header.Set(idempotencyHeader, "k1")
+		rec := httptest.NewRecorder()
+		var w http.ResponseWriter = rec
+		if cancelAfter {
+			// The client hangs up once the order is committed.
+			w = &cancelOnWrite{ResponseWriter: rec, cancel: cancel}
+		}
+		h.ServeHTTP(w, req)
+		return rec
+	}
+	send(true)
+	rec := send(false)
+	if runs != 1 {
+		t.Errorf("handler ran %d times, want 1", runs)
+	}
+	if rec.Code != http.StatusCreated || rec.Header().Get(replayedHeader) != "true" {
+		t.Errorf("retry: status %d, replayed %q", rec.Code, rec.Header().Get(replayedHeader))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// cancelOnWrite cancels the request context after the response is written.
+type cancelOnWrite struct {
+	http.ResponseWriter
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnWrite) Write(b []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseWriter.Write(b)
+}
+
+func TestIdempotencyKeyBodyTooLarge(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	jwt_key = []byte("test-key")
+	token, err := generateJWT("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"note":"` + strings.Repeat("x", maxIdempotentBody) + `"}`
+	req := httptest.NewRequest("POST", apiV1Prefix+"/orders/", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(idempotencyHeader, "k1")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413: %s", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	jwt_key = []byte("test-key")
+	token, err := generateJWT("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := apiV1Prefix + "/cart/clear"
+	sum := sha256.Sum256([]byte("DELETE " + path + "\n"))
+	hash := hex.EncodeToString(sum[:])
+	stored := func(hash string, status any) func(m sqlmock.Sqlmock) {
+		return func(m sqlmock.Sqlmock) {
+			m.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectExec("insert into idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectQuery("select request_hash, status, content_type, body from idempotency_keys").
+				WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body"}).
+					AddRow(hash, status, "application/json", []byte(`{"message":"Cleared successfully"}`)))
+		}
+	}
+	cases := []struct {
+		name     string
+		expect   func(m sqlmock.Sqlmock)
+		status   int
+		replayed bool
+	}{
+		{name: "first request runs and is stored", status: 200, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectExec("insert into idempotency_keys").WithArgs("ann", "k1", hash).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 2))
+			m.ExpectExec("update idempotency_keys set status").WithArgs(200, "application/json", sqlmock.AnyArg(), "ann", "k1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "retry replays the stored response", status: 200, replayed: true, expect: stored(hash, 200)},
+		{name: "key reused for another request", status: 422, expect: stored("other", 200)},
+		{name: "first request still running", status: 409, expect: stored(hash, nil)},
+		{name: "server error releases the key", status: 500, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("delete from idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+			m.ExpectExec("insert into idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("delete from cart").WillReturnError(io.ErrUnexpectedEOF)
+			m.ExpectExec("delete from idempotency_keys where username").WithArgs("ann", "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			db = mockDB
+			tc.expect(mock)
+
+			req := httptest.NewRequest("DELETE", path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(idempotencyHeader, "k1")
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			if got := rec.Header().Get(replayedHeader) == "true"; got != tc.replayed {
+				t.Errorf("replayed = %v, want %v", got, tc.replayed)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,30 +13,95 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
+// Order is the checkout request. Items and total come from the cart and the
+// status from the payment flow; the client's status, total_price and
+// created_at are ignored. Currency is what to pay in, defaulting to the one
+// asked for with Accept-Currency.
 type Order struct {
-	User_id    int       `json:"user_id"`
-	Status     string    `json:"status"`
-	TotalPrice int       `json:"total_price"`
-	CreatedAt  time.Time `json:"created_at"`
+	User_id          int       `json:"user_id"`
+	Status           string    `json:"status"`
+	TotalPrice       Money     `json:"total_price"`
+	CreatedAt        time.Time `json:"created_at"`
+	AddressID        int       `json:"address_id"`
+	ShippingMethodID int       `json:"shipping_method_id"`
+	Currency         string    `json:"currency"`
 }
 type OrderforA struct {
-	User_id    int       `json:"user_id"`
-	ID         int       `json:"id"`
-	Status     string    `json:"status"`
-	TotalPrice int       `json:"total_price"`
-	CreatedAt  time.Time `json:"created_at"`
+	User_id         int              `json:"user_id"`
+	ID              int              `json:"id"`
+	Status          string           `json:"status"`
+	Currency        string           `json:"currency"`
+	ExchangeRate    float64          `json:"exchange_rate"`
+	TotalPrice      Money            `json:"total_price"`
+	CreatedAt       time.Time        `json:"created_at"`
+	ShippingAddress *ShippingAddress `json:"shipping_address"`
+	Discount        Money            `json:"discount"`
+	CouponCode      *string          `json:"coupon_code"`
+	ShippingMethod  *string          `json:"shipping_method"`
+	ShippingPrice   Money            `json:"shipping_price"`
+	Tax             Money            `json:"tax"`
+	TaxInclusive    bool             `json:"tax_inclusive"`
+	TaxBreakdown    TaxBreakdown     `json:"tax_breakdown"`
 }
 type OrderDisplay struct {
-	ID         int       `json:"id"`
-	Status     string    `json:"status"`
-	TotalPrice int       `json:"total_price"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID              int              `json:"id"`
+	Status          string           `json:"status"`
+	Currency        string           `json:"currency"`
+	ExchangeRate    float64          `json:"exchange_rate"`
+	TotalPrice      Money            `json:"total_price"`
+	CreatedAt       time.Time        `json:"created_at"`
+	ShippingAddress *ShippingAddress `json:"shipping_address"`
+	Discount        Money            `json:"discount"`
+	CouponCode      *string          `json:"coupon_code"`
+	ShippingMethod  *string          `json:"shipping_method"`
+	ShippingPrice   Money            `json:"shipping_price"`
+	Tax             Money            `json:"tax"`
+	TaxInclusive    bool             `json:"tax_inclusive"`
+	TaxBreakdown    TaxBreakdown     `json:"tax_breakdown"`
+}
+type OrderCreated struct {
+	Message       string        `json:"message"`
+	OrderID       int           `json:"order_id"`
+	Currency      string        `json:"currency"`
+	ExchangeRate  float64       `json:"exchange_rate"`
+	TotalPrice    Money         `json:"total_price"`
+	Discount      Money         `json:"discount"`
+	ShippingPrice Money         `json:"shipping_price"`
+	Tax           Money         `json:"tax"`
+	Payment       PaymentIntent `json:"payment"`
 }
 type UpdateStatus struct {
 	ID     int    `json:"id"`
 	Status string `json:"status"`
 }
 
+// Fulfilment statuses an admin sets by hand.
+const (
+	orderShipped   = "shipped"
+	orderDelivered = "delivered"
+)
+
+// statusChangeConflict says why an admin can't move an order from one status
+// to another, or returns "" if they can. An order awaiting payment holds
+// stock and an open payment intent, so only the payment flow and the
+// expiry job settle it; only paid orders go out.
+func statusChangeConflict(from, to string) string {
+	if from == orderPendingPayment {
+		return "order is awaiting payment; its status is set by the payment flow"
+	}
+	switch to {
+	case orderShipped:
+		if from != orderPaid && from != orderPartiallyRefunded && from != orderShipped {
+			return "only paid orders can be shipped, this one is " + from
+		}
+	case orderDelivered:
+		if from != orderPaid && from != orderPartiallyRefunded && from != orderShipped && from != orderDelivered {
+			return "only paid orders can be delivered, this one is " + from
+		}
+	}
+	return ""
+}
+
 func updateStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -44,7 +113,7 @@ func updateStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var role string
-	err := db.QueryRow("select role from users where username = $1", username).Scan(&role)
+	err := db.QueryRowContext(r.Context(), "select role from users where username = $1", username).Scan(&role)
 	if err != nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -56,11 +125,48 @@ func updateStatus(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-		_, err = db.Exec("update orders set status = $1 where id = $2", u.Status, u.ID)
+		switch u.Status {
+		case orderPaid, orderPaymentFailed, orderPaymentExpired:
+			http.Error(w, "status "+u.Status+" is set by the payment provider", http.StatusBadRequest)
+			return
+		case orderPartiallyRefunded, orderRefunded:
+			http.Error(w, "status "+u.Status+" is set by refunds", http.StatusBadRequest)
+			return
+		}
+		// The status change and its event commit together, so subscribers
+		// can't miss it if the process dies right after the update.
+		tx, err := db.BeginTx(r.Context(), nil)
 		if err != nil {
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
+		var current string
+		err = tx.QueryRowContext(r.Context(), "select status from orders where id = $1 for update", u.ID).Scan(&current)
+		if err == sql.ErrNoRows {
+			http.Error(w, "order not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("loading order status", "order_id", u.ID, "err", err)
+			return
+		}
+		if msg := statusChangeConflict(current, u.Status); msg != "" {
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+		_, err = tx.ExecContext(r.Context(), "update orders set status = $1 where id = $2", u.Status, u.ID)
+		if err == nil {
+			err = emitEvent(r.Context(), tx, eventOrderStatusChanged, u.ID, OrderEventData{OrderID: u.ID, Status: u.Status})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("updating order status", "order_id", u.ID, "err", err)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{
 			"message": "updated!",
@@ -84,25 +190,396 @@ func postOrders(w http.ResponseWriter, r *http.Request) {
 	var o Order
 	err := json.NewDecoder(r.Body).Decode(&o)
 	if err != nil {
+		checkoutFailures.WithLabelValues("bad_request").Inc()
 		http.Error(w, "error while decoding json", http.StatusInternalServerError)
 		return
 	}
-	err = db.QueryRow("select id from users where username = $1", username).Scan(&o.User_id)
+	err = db.QueryRowContext(r.Context(), "select id from users where username = $1", username).Scan(&o.User_id)
 	if err != nil {
+		checkoutFailures.WithLabelValues("user_lookup").Inc()
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The address is copied onto the order so later edits to the address
+	// book don't change where past orders were shipped.
+	addr, err := shippingAddressFor(r.Context(), db, o.User_id, o.AddressID)
+	if err == errNoAddress {
+		checkoutFailures.WithLabelValues("no_address").Inc()
+		http.Error(w, "shipping address required", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		checkoutFailures.WithLabelValues("db").Inc()
 		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading shipping address", "err", err)
 		return
 	}
 
-	_, err = db.Exec("insert into orders (user_id, status, total_price, created_at) values ($1,$2,$3,$4)", o.User_id, o.Status, o.TotalPrice, o.CreatedAt)
+	currency, err := parseCurrency(o.Currency)
+	if o.Currency == "" {
+		currency, err = requestCurrency(r)
+	}
 	if err != nil {
+		checkoutFailures.WithLabelValues("currency").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := placeOrder(r.Context(), o.User_id, addr, o.ShippingMethodID, currency)
+	if errors.Is(err, errEmptyCart) {
+		checkoutFailures.WithLabelValues("empty_cart").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errOutOfStock) {
+		checkoutFailures.WithLabelValues("out_of_stock").Inc()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errNoShippingMethod) || errors.Is(err, errShippingUnavailable) {
+		checkoutFailures.WithLabelValues("shipping").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errCurrencyUnavailable) {
+		checkoutFailures.WithLabelValues("currency").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errCartChanged) {
+		checkoutFailures.WithLabelValues("cart_changed").Inc()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errCouponInvalid) {
+		checkoutFailures.WithLabelValues("coupon").Inc()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errPaymentProvider) {
+		checkoutFailures.WithLabelValues("payment").Inc()
+		http.Error(w, "payment provider unavailable", http.StatusBadGateway)
+		loggerFrom(r.Context()).Error("creating payment intent", "err", err)
+		return
+	} else if err != nil {
+		checkoutFailures.WithLabelValues("db").Inc()
 		http.Error(w, "error while inserting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("placing order", "err", err)
 		return
 	}
+	ordersCreated.Inc()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "order created!",
-	})
+	json.NewEncoder(w).Encode(created)
 }
+
+var (
+	errEmptyCart       = errors.New("cart is empty")
+	errOutOfStock      = errors.New("not enough stock")
+	errCartChanged     = errors.New("cart changed during checkout, please try again")
+	errPaymentProvider = errors.New("payment provider error")
+)
+
+// checkoutLine is a cart line priced for checkout.
+type checkoutLine struct {
+	productID, quantity, stock, weight int
+	price                              Money
+	name, category, taxClass           string
+}
+
+// checkoutCart is the user's cart priced in the order currency with its
+// coupon applied; total is after the discount.
+type checkoutCart struct {
+	pr        pricing
+	lines     []checkoutLine
+	subtotals []Money
+	total     Money
+	weight    int
+	coupon    *Coupon
+	discount  couponResult
+}
+
+// priceCheckout prices the user's cart for an order in currency. With lock
+// set, as inside the checkout transaction, the cart lines, their products
+// and the coupon stay locked until the order is placed.
+func priceCheckout(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, userID int, currency string, lock bool) (checkoutCart, error) {
+	c := checkoutCart{total: Money{Currency: currency}}
+	var err error
+	if c.pr, err = pricingFor(ctx, q, currency); err != nil {
+		return c, err
+	}
+	query := "select products.id, products.name, products.category, cart.quantity, products.price, products.stock, products.weight, products.tax_class, product_prices.price from cart join products on products.id = cart.product_id left join product_prices on product_prices.product_id = products.id and product_prices.currency = $2 where cart.user_id = $1 order by cart.id"
+	if lock {
+		query += " for update of cart, products"
+	}
+	rows, err := q.QueryContext(ctx, query, userID, currency)
+	if err != nil {
+		return c, err
+	}
+	var clines []couponLine
+	for rows.Next() {
+		var l checkoutLine
+		var override *int
+		err := rows.Scan(&l.productID, &l.name, &l.category, &l.quantity, &l.price, &l.stock, &l.weight, &l.taxClass, &override)
+		if err == nil {
+			l.price, err = c.pr.price(l.price, override)
+		}
+		if err != nil {
+			rows.Close()
+			return c, err
+		}
+		c.lines = append(c.lines, l)
+		clines = append(clines, couponLine{productID: l.productID, category: l.category, price: l.price.Amount, quantity: l.quantity})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+	if len(c.lines) == 0 {
+		return c, errEmptyCart
+	}
+	c.subtotals = make([]Money, len(c.lines))
+	for i, l := range c.lines {
+		if l.quantity > l.stock {
+			return c, fmt.Errorf("%w for %s", errOutOfStock, l.name)
+		}
+		if c.subtotals[i], err = l.price.Mul(l.quantity); err != nil {
+			return c, err
+		}
+		if c.total, err = c.total.Add(c.subtotals[i]); err != nil {
+			return c, err
+		}
+		c.weight += l.weight * l.quantity
+	}
+
+	// A coupon that stopped applying since it was added to the cart fails
+	// the checkout rather than silently charging more.
+	coupon, uses, err := cartCoupon(ctx, q, userID, lock)
+	if err != nil {
+		return c, err
+	}
+	c.discount = couponResult{Lines: make([]int, len(c.lines))}
+	if coupon != nil {
+		cp, err := c.pr.coupon(*coupon)
+		if err != nil {
+			return c, err
+		}
+		if c.discount, err = applyCoupon(cp, clines, uses, time.Now()); err != nil {
+			return c, err
+		}
+		c.coupon = coupon
+		if c.total, err = c.total.Sub(Money{Amount: c.discount.Discount, Currency: currency}); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// sameShipment reports whether c ships like o: what shipping was quoted
+// for o holds for c.
+func (c checkoutCart) sameShipment(o checkoutCart) bool {
+	return c.weight == o.weight && c.total == o.total && c.discount.FreeShipping == o.discount.FreeShipping
+}
+
+// quoteCheckout prices shipping c with the active method shippingMethodID,
+// in the shop currency.
+func quoteCheckout(ctx context.Context, c checkoutCart, addr ShippingAddress, shippingMethodID int) (ShippingMethod, int, error) {
+	methods, err := loadShippingMethods(ctx, db, true, shippingMethodID)
+	if err != nil {
+		return ShippingMethod{}, 0, err
+	}
+	if len(methods) == 0 {
+		return ShippingMethod{}, 0, fmt.Errorf("%w: method %d is not available", errNoShippingMethod, shippingMethodID)
+	}
+	m := methods[0]
+	subtotal, err := c.pr.toShop(c.total)
+	if err != nil {
+		return m, 0, err
+	}
+	price, ok, err := quoteShipping(ctx, m, Shipment{To: addr, Weight: c.weight, Subtotal: subtotal.Amount}, c.discount.FreeShipping)
+	if err != nil {
+		return m, 0, err
+	}
+	if !ok {
+		return m, 0, errShippingUnavailable
+	}
+	return m, price, nil
+}
+
+// placeOrder turns the user's cart into an order awaiting payment: prices
+// come from the catalog, the cart's coupon is redeemed, shipping is priced,
+// tax is charged, stock is reserved and the cart is emptied in one
+// transaction, then a payment intent is opened with the provider.
+// shippingMethodID may be 0 only while no shipping methods are configured.
+// Outside the shop currency, prices are the product's override or its shop
+// price at the current exchange rate, which the order keeps.
+//
+// The shipping provider and the payment gateway may be remote services, so
+// neither is called while the transaction holds its locks: shipping is
+// quoted on an unlocked read of the cart first, and the order fails with
+// errCartChanged if the locked cart no longer ships the same.
+func placeOrder(ctx context.Context, userID int, addr ShippingAddress, shippingMethodID int, currency string) (OrderCreated, error) {
+	zero := Money{Currency: currency}
+	created := OrderCreated{Currency: currency, ExchangeRate: 1, TotalPrice: zero, Discount: zero, ShippingPrice: zero, Tax: zero}
+
+	var quoted checkoutCart
+	var method ShippingMethod
+	var shippingPrice int
+	if shippingMethodID != 0 {
+		var err error
+		if quoted, err = priceCheckout(ctx, db, userID, currency, false); err != nil {
+			return created, err
+		}
+		if method, shippingPrice, err = quoteCheckout(ctx, quoted, addr, shippingMethodID); err != nil {
+			return created, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return created, err
+	}
+	defer tx.Rollback()
+
+	cart, err := priceCheckout(ctx, tx, userID, currency, true)
+	if err != nil {
+		return created, err
+	}
+	created.ExchangeRate = cart.pr.Rate
+	created.TotalPrice = cart.total
+	var couponCode *string
+	if cart.coupon != nil {
+		couponCode = &cart.coupon.Code
+		created.Discount = Money{Amount: cart.discount.Discount, Currency: currency}
+	}
+
+	var methodID *int
+	var methodName *string
+	if shippingMethodID == 0 {
+		var configured bool
+		if err := tx.QueryRowContext(ctx, "select exists (select 1 from shipping_methods where active)").Scan(&configured); err != nil {
+			return created, err
+		}
+		if configured {
+			return created, errNoShippingMethod
+		}
+	} else {
+		if !cart.sameShipment(quoted) {
+			return created, errCartChanged
+		}
+		methodID, methodName = &method.ID, &method.Name
+		if created.ShippingPrice, err = cart.pr.convert(money(shippingPrice)); err != nil {
+			return created, err
+		}
+		if created.TotalPrice, err = created.TotalPrice.Add(created.ShippingPrice); err != nil {
+			return created, err
+		}
+	}
+
+	// Tax is on the goods after discounts; shipping isn't taxed.
+	rates, err := loadTaxRates(ctx, tx)
+	if err != nil {
+		return created, err
+	}
+	tlines := make([]taxLine, len(cart.lines))
+	for i, l := range cart.lines {
+		tlines[i] = taxLine{class: l.taxClass, amount: cart.subtotals[i].Amount - cart.discount.Lines[i]}
+	}
+	tax := computeTax(rates, addr, tlines, taxInclusive)
+	created.Tax = Money{Amount: tax.Tax, Currency: currency}
+	if !taxInclusive {
+		if created.TotalPrice, err = created.TotalPrice.Add(created.Tax); err != nil {
+			return created, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, "insert into orders (user_id, status, total_price, shipping_address, discount, coupon_code, free_shipping, shipping_method_id, shipping_method, shipping_price, tax, tax_inclusive, tax_breakdown, currency, exchange_rate) values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15) returning id",
+		userID, orderPendingPayment, created.TotalPrice, addr, created.Discount, couponCode, cart.discount.FreeShipping, methodID, methodName, created.ShippingPrice, created.Tax, taxInclusive, tax.Breakdown, created.Currency, created.ExchangeRate).Scan(&created.OrderID)
+	if err != nil {
+		return created, err
+	}
+	if cart.coupon != nil {
+		if _, err := tx.ExecContext(ctx, "insert into coupon_redemptions (coupon_id, user_id, order_id, amount) values ($1,$2,$3,$4)", cart.coupon.ID, userID, created.OrderID, created.Discount); err != nil {
+			return created, err
+		}
+		if _, err := tx.ExecContext(ctx, "update coupons set uses = uses + 1 where id = $1", cart.coupon.ID); err != nil {
+			return created, err
+		}
+		if _, err := tx.ExecContext(ctx, "delete from cart_coupons where user_id = $1", userID); err != nil {
+			return created, err
+		}
+	}
+	err = emitEvent(ctx, tx, eventOrderCreated, created.OrderID, OrderEventData{OrderID: created.OrderID, Status: orderPendingPayment, TotalPrice: created.TotalPrice.Amount, Currency: created.Currency})
+	if err != nil {
+		return created, err
+	}
+	for i, l := range cart.lines {
+		if _, err := tx.ExecContext(ctx, "insert into order_items (order_id, product_id, quantity, price, discount, tax, tax_rate) values ($1,$2,$3,$4,$5,$6,$7)",
+			created.OrderID, l.productID, l.quantity, l.price, cart.discount.Lines[i], tax.Lines[i].Tax, tax.Lines[i].Rate); err != nil {
+			return created, err
+		}
+		if _, err := tx.ExecContext(ctx, "update products set stock = stock - $1 where id = $2", l.quantity, l.productID); err != nil {
+			return created, err
+		}
+		if left := l.stock - l.quantity; l.stock > lowStockThreshold && left <= lowStockThreshold {
+			if err := emitEvent(ctx, tx, eventProductStockLow, l.productID, StockEventData{ProductID: l.productID, Name: l.name, Stock: left}); err != nil {
+				return created, err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "delete from cart where user_id = $1", userID); err != nil {
+		return created, err
+	}
+	if err := tx.Commit(); err != nil {
+		return created, err
+	}
+
+	// An order the gateway won't take payment for fails straight away,
+	// releasing its stock like any failed payment.
+	created.Payment, err = payments.CreateIntent(ctx, created.TotalPrice, fmt.Sprintf("order-%d", created.OrderID))
+	if err != nil {
+		if rerr := releaseUnpaidOrder(ctx, created.OrderID, orderPaymentFailed); rerr != nil {
+			loggerFrom(ctx).Error("releasing order without payment", "order_id", created.OrderID, "err", rerr)
+		}
+		return created, fmt.Errorf("%w: %v", errPaymentProvider, err)
+	}
+	_, err = db.ExecContext(ctx, "insert into payments (order_id, provider, intent_id, amount, status) values ($1,$2,$3,$4,$5)", created.OrderID, payments.Name(), created.Payment.ID, created.TotalPrice, created.Payment.Status)
+	if err != nil {
+		return created, err
+	}
+	created.Message = "order created!"
+	return created, nil
+}
+
+// releaseUnpaidOrder moves an order still awaiting payment to status, puts
+// its reserved stock back and gives back the coupon use it took.
+func releaseUnpaidOrder(ctx context.Context, orderID int, status string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := releaseOrderStock(ctx, tx, orderID, status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// releaseOrderStock is releaseUnpaidOrder inside tx. It does nothing once
+// the order has left pending_payment.
+func releaseOrderStock(ctx context.Context, tx *sql.Tx, orderID int, status string) error {
+	res, err := tx.ExecContext(ctx, "update orders set status = $1 where id = $2 and status = $3", status, orderID, orderPendingPayment)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "update products set stock = products.stock + order_items.quantity from order_items where order_items.order_id = $1 and products.id = order_items.product_id", orderID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "with redeemed as (delete from coupon_redemptions where order_id = $1 returning coupon_id) update coupons set uses = uses - 1 from redeemed where coupons.id = redeemed.coupon_id", orderID); err != nil {
+		return err
+	}
+	return emitEvent(ctx, tx, eventOrderStatusChanged, orderID, OrderEventData{OrderID: orderID, Status: status})
+}
+
 func getAllOrders(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusBadRequest)
@@ -113,7 +590,7 @@ func getAllOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var role string
-	err := db.QueryRow("select role from users where username = $1", username).Scan(&role)
+	err := db.QueryRowContext(r.Context(), "select role from users where username = $1", username).Scan(&role)
 	if err != nil {
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -122,8 +599,8 @@ func getAllOrders(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Permission denied", http.StatusMethodNotAllowed)
 		return
 	}
-	var ords []OrderforA
-	orows, err := db.Query("select * from orders")
+	ords := []OrderforA{}
+	orows, err := db.QueryContext(r.Context(), "select id, user_id, status, total_price, created_at, shipping_address, discount, coupon_code, shipping_method, shipping_price, tax, tax_inclusive, tax_breakdown, currency, exchange_rate from orders")
 	if err != nil {
 		http.Error(w, "errror while getting data", http.StatusInternalServerError)
 		return
@@ -131,11 +608,12 @@ func getAllOrders(w http.ResponseWriter, r *http.Request) {
 	defer orows.Close()
 	for orows.Next() {
 		var o OrderforA
-		err := orows.Scan(&o.ID, &o.User_id, &o.Status, &o.TotalPrice, &o.CreatedAt)
+		err := orows.Scan(&o.ID, &o.User_id, &o.Status, &o.TotalPrice, &o.CreatedAt, &o.ShippingAddress, &o.Discount, &o.CouponCode, &o.ShippingMethod, &o.ShippingPrice, &o.Tax, &o.TaxInclusive, &o.TaxBreakdown, &o.Currency, &o.ExchangeRate)
 		if err != nil {
 			http.Error(w, "error while getting data", http.StatusInternalServerError)
 			return
 		}
+		inCurrency(o.Currency, &o.TotalPrice, &o.Discount, &o.ShippingPrice, &o.Tax)
 		ords = append(ords, o)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -152,8 +630,8 @@ func getOrders(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid username", http.StatusInternalServerError)
 		return
 	}
-	var ords []OrderDisplay
-	orows, err := db.Query("select orders.id, orders.status, orders.total_price, orders.created_at from orders join users on users.id = orders.user_id where users.username = $1", username)
+	ords := []OrderDisplay{}
+	orows, err := db.QueryContext(r.Context(), "select orders.id, orders.status, orders.total_price, orders.created_at, orders.shipping_address, orders.discount, orders.coupon_code, orders.shipping_method, orders.shipping_price, orders.tax, orders.tax_inclusive, orders.tax_breakdown, orders.currency, orders.exchange_rate from orders join users on users.id = orders.user_id where users.username = $1", username)
 	if err != nil {
 		http.Error(w, "errror while getting data", http.StatusInternalServerError)
 		return
@@ -161,11 +639,12 @@ func getOrders(w http.ResponseWriter, r *http.Request) {
 	defer orows.Close()
 	for orows.Next() {
 		var o OrderDisplay
-		err := orows.Scan(&o.ID, &o.Status, &o.TotalPrice, &o.CreatedAt)
+		err := orows.Scan(&o.ID, &o.Status, &o.TotalPrice, &o.CreatedAt, &o.ShippingAddress, &o.Discount, &o.CouponCode, &o.ShippingMethod, &o.ShippingPrice, &o.Tax, &o.TaxInclusive, &o.TaxBreakdown, &o.Currency, &o.ExchangeRate)
 		if err != nil {
 			http.Error(w, "error while getting data", http.StatusInternalServerError)
 			return
 		}
+		inCurrency(o.Currency, &o.TotalPrice, &o.Discount, &o.ShippingPrice, &o.Tax)
 		ords = append(ords, o)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -195,12 +674,45 @@ func getOrderbyID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var o OrderDisplay
-	row := db.QueryRow("select orders.id, orders.status, orders.total_price,orders.created_at from orders join users on users.id = orders.user_id where users.username = $1 and orders.id = $2", username, id)
-	err = row.Scan(&o.ID, &o.Status, &o.TotalPrice, &o.CreatedAt)
+	row := db.QueryRowContext(r.Context(), "select orders.id, orders.status, orders.total_price,orders.created_at, orders.shipping_address, orders.discount, orders.coupon_code, orders.shipping_method, orders.shipping_price, orders.tax, orders.tax_inclusive, orders.tax_breakdown, orders.currency, orders.exchange_rate from orders join users on users.id = orders.user_id where users.username = $1 and orders.id = $2", username, id)
+	err = row.Scan(&o.ID, &o.Status, &o.TotalPrice, &o.CreatedAt, &o.ShippingAddress, &o.Discount, &o.CouponCode, &o.ShippingMethod, &o.ShippingPrice, &o.Tax, &o.TaxInclusive, &o.TaxBreakdown, &o.Currency, &o.ExchangeRate)
 	if err != nil {
 		http.Error(w, "Internal server errror", http.StatusInternalServerError)
 		return
 	}
+	inCurrency(o.Currency, &o.TotalPrice, &o.Discount, &o.ShippingPrice, &o.Tax)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(o)
 }
+
+func getOrderItems(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "invalid username", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select order_items.id, order_items.product_id, order_items.quantity, order_items.price, order_items.discount, order_items.tax, order_items.tax_rate, order_items.refunded_quantity from order_items join orders on orders.id = order_items.order_id join users on users.id = orders.user_id where order_items.order_id = $1 and (users.username = $2 or exists (select 1 from users a where a.username = $2 and a.role = 'admin')) order by order_items.id", id, username)
+	if err != nil {
+		http.Error(w, "error while getting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing order items", "err", err)
+		return
+	}
+	defer rows.Close()
+	items := []OrderItem{}
+	for rows.Next() {
+		var it OrderItem
+		if err := rows.Scan(&it.ID, &it.ProductID, &it.Quantity, &it.Price, &it.Discount, &it.Tax, &it.TaxRate, &it.RefundedQuantity); err != nil {
+			http.Error(w, "error while getting data", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning order item", "err", err)
+			return
+		}
+		items = append(items, it)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// orderChannel is the PostgreSQL NOTIFY channel the orders triggers publish
+// on (see migrations/0010_order_notify.sql).
+const orderChannel = "order_changes"
+
+const (
+	// streamHeartbeat keeps idle streams from being cut by proxies.
+	streamHeartbeat = 25 * time.Second
+	// streamBuffer is how many changes a slow client may fall behind before
+	// its stream is closed; EventSource then reconnects.
+	streamBuffer = 16
+)
+
+// OrderChange is a new order or a status change, as announced by the
+// database.
+type OrderChange struct {
+	OrderID    int    `json:"order_id"`
+	UserID     int    `json:"user_id"`
+	Status     string `json:"status"`
+	TotalPrice int    `json:"total_price"`
+	Created    bool   `json:"created"`
+}
+
+type orderSubscriber struct {
+	ch     chan OrderChange
+	filter func(OrderChange) bool
+}
+
+// orderHub fans order changes from LISTEN out to the open streams of this
+// instance.
+type orderHub struct {
+	mu       sync.Mutex
+	subs     map[*orderSubscriber]struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var orderStreams = newOrderHub()
+
+func newOrderHub() *orderHub {
+	return &orderHub{subs: map[*orderSubscriber]struct{}{}, done: make(chan struct{})}
+}
+
+// subscribe returns a channel of the changes filter accepts and a func to
+// stop. The channel is closed if the subscriber falls behind.
+func (h *orderHub) subscribe(filter func(OrderChange) bool) (<-chan OrderChange, func()) {
+	s := &orderSubscriber{ch: make(chan OrderChange, streamBuffer), filter: filter}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s.ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[s]; ok {
+			delete(h.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+func (h *orderHub) publish(c OrderChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.filter(c) {
+			continue
+		}
+		select {
+		case s.ch <- c:
+		default:
+			delete(h.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+// shutdown ends every open stream so the HTTP server can drain.
+func (h *orderHub) shutdown() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+// listen relays notifications on orderChannel to the hub until ctx is
+// cancelled. It uses its own connection; pq reconnects it as needed.
+func (h *orderHub) listen(ctx context.Context, dsn string) {
+	l := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			loggerFrom(ctx).Warn("order change listener", "event", ev, "err", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(orderChannel); err != nil {
+		loggerFrom(ctx).Error("listening for order changes", "err", err)
+		return
+	}
+	ping := time.NewTicker(time.Minute)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			go l.Ping()
+		case n := <-l.Notify:
+			// nil means the connection was re-established; changes made
+			// while it was down are not replayed.
+			if n == nil {
+				continue
+			}
+			var c OrderChange
+			if err := json.Unmarshal([]byte(n.Extra), &c); err != nil {
+				loggerFrom(ctx).Warn("decoding order change", "payload", n.Extra, "err", err)
+				continue
+			}
+			h.publish(c)
+		}
+	}
+}
+
+// streamOrderChanges writes changes as Server-Sent Events until the client
+// goes away, its token expires, the hub shuts down or the subscriber falls
+// behind.
+func streamOrderChanges(w http.ResponseWriter, r *http.Request, filter func(OrderChange) bool) {
+	rc := http.NewResponseController(w)
+	// The server's WriteTimeout would cut the stream off.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		loggerFrom(r.Context()).Warn("clearing write deadline", "err", err)
+	}
+	changes, stop := orderStreams.subscribe(filter)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	rc.Flush()
+
+	// The token was only checked when the stream opened; the client has to
+	// reconnect with a fresh one to keep getting changes.
+	var expired <-chan time.Time
+	if exp, ok := r.Context().Value(tokenExpiresKey).(time.Time); ok {
+		t := time.NewTimer(time.Until(exp))
+		defer t.Stop()
+		expired = t.C
+	}
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired:
+			return
+		case <-orderStreams.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(c)
+			event := eventOrderStatusChanged
+			if c.Created {
+				event = eventOrderCreated
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// getOrderEvents streams changes to the current user's orders.
+func getOrderEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading user", "err", err)
+		return
+	}
+	streamOrderChanges(w, r, func(c OrderChange) bool { return c.UserID == userID })
+}
+
+// getAllOrderEvents streams every new order to admins.
+func getAllOrderEvents(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	streamOrderChanges(w, r, func(c OrderChange) bool { return c.Created })
+}
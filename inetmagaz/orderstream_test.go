@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestOrderEventsStreamsOwnOrders(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	jwt_key = []byte("test-key")
+	mock.ExpectQuery("select id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	token, err := generateJWT("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+apiV1Prefix+"/orders/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	lines.Scan() // retry:
+	lines.Scan()
+
+	// The subscription exists once the first bytes arrived.
+	orderStreams.publish(OrderChange{OrderID: 1, UserID: 8, Status: "shipped"})
+	orderStreams.publish(OrderChange{OrderID: 2, UserID: 7, Status: "shipped"})
+
+	got := make(chan string, 1)
+	go func() {
+		var ev []string
+		for lines.Scan() && lines.Text() != "" {
+			ev = append(ev, lines.Text())
+		}
+		got <- strings.Join(ev, "\n")
+	}()
+	select {
+	case ev := <-got:
+		want := "event: order.status_changed\ndata: {\"order_id\":2,\"user_id\":7,\"status\":\"shipped\",\"total_price\":0,\"created\":false}"
+		if ev != want {
+			t.Errorf("event = %q, want %q", ev, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestOrderEventsEndWhenTokenExpires(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	jwt_key = []byte("test-key")
+	mock.ExpectQuery("select id from users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "ann",
+		"exp":      time.Now().Add(2 * time.Second).Unix(),
+	}).SignedString(jwt_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+apiV1Prefix+"/orders/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream ended with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream still open after the token expired")
+	}
+}
+
+func TestOrderHubDropsSlowSubscribers(t *testing.T) {
+	h := newOrderHub()
+	ch, stop := h.subscribe(func(OrderChange) bool { return true })
+	defer stop()
+	for i := 0; i <= streamBuffer; i++ {
+		h.publish(OrderChange{OrderID: i})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != streamBuffer {
+		t.Errorf("got %d changes before close, want %d", n, streamBuffer)
+	}
+}
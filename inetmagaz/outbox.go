@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Domain events go through the outbox table: emitEvent writes them in the
+// same transaction as the change they describe, and runOutboxDispatcher
+// hands them to every sink afterwards. An event is published at least once;
+// events of one aggregate (an order, a product) are published in the order
+// they were written.
+
+// OutboxEvent is a domain event as read back from the outbox.
+type OutboxEvent struct {
+	ID            int64
+	AggregateType string
+	AggregateID   int
+	EventID       string
+	Type          string
+	// Payload is the JSON-encoded WebhookEvent envelope.
+	Payload []byte
+}
+
+// EventSink receives published events. Publish may see an event more than
+// once, e.g. after a crash or when another sink failed, so it should be
+// idempotent on EventID.
+type EventSink interface {
+	Name() string
+	Publish(ctx context.Context, ev OutboxEvent) error
+}
+
+// eventSinks are the sinks events are published to.
+var eventSinks = []EventSink{logSink{}, webhookSink{}, emailSink{}}
+
+const (
+	outboxBackoff    = 5 * time.Second
+	outboxMaxBackoff = 10 * time.Minute
+	// outboxRetention is how long published events are kept.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// emitEvent records an event in the outbox. Pass the transaction making the
+// change so the event exists if and only if the change commits. The
+// aggregate is the part of eventType before the dot.
+func emitEvent(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, eventType string, aggregateID int, data any) error {
+	ev := WebhookEvent{ID: randomID("evt_"), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	aggregate, _, _ := strings.Cut(eventType, ".")
+	_, err = q.ExecContext(ctx, "insert into outbox (aggregate_type, aggregate_id, event_id, event_type, payload) values ($1,$2,$3,$4,$5)", aggregate, aggregateID, ev.ID, eventType, payload)
+	return err
+}
+
+// publishOutbox publishes up to limit due events and returns how many it
+// handled. Only the oldest unpublished event of each aggregate is due, so a
+// failing event holds back the ones after it instead of being overtaken.
+func publishOutbox(ctx context.Context, limit int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "select id, aggregate_type, aggregate_id, event_id, event_type, payload, attempts from outbox o where published_at is null and next_attempt_at <= now() and not exists (select 1 from outbox p where p.aggregate_type = o.aggregate_type and p.aggregate_id = o.aggregate_id and p.published_at is null and p.id < o.id) order by id limit $1 for update skip locked", limit)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		OutboxEvent
+		attempts int
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.ID, &d.AggregateType, &d.AggregateID, &d.EventID, &d.Type, &d.Payload, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		var failed []string
+		for _, s := range eventSinks {
+			if err := s.Publish(ctx, d.OutboxEvent); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", s.Name(), err))
+			}
+		}
+		if len(failed) == 0 {
+			_, err = tx.ExecContext(ctx, "update outbox set published_at = now(), attempts = attempts + 1, last_error = '' where id = $1", d.ID)
+		} else {
+			backoff := outboxBackoff << min(d.attempts, 10)
+			if backoff > outboxMaxBackoff {
+				backoff = outboxMaxBackoff
+			}
+			_, err = tx.ExecContext(ctx, "update outbox set attempts = attempts + 1, last_error = $1, next_attempt_at = $2 where id = $3", strings.Join(failed, "; "), time.Now().Add(backoff), d.ID)
+			loggerFrom(ctx).Warn("publishing event failed", "event_id", d.EventID, "type", d.Type, "attempt", d.attempts+1, "err", strings.Join(failed, "; "))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), tx.Commit()
+}
+
+// runOutboxDispatcher publishes outbox events until ctx is cancelled and
+// prunes old published ones.
+func runOutboxDispatcher(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			if _, err := db.ExecContext(ctx, "delete from outbox where published_at < $1", time.Now().Add(-outboxRetention)); err != nil {
+				loggerFrom(ctx).Error("pruning outbox", "err", err)
+			}
+			continue
+		case <-t.C:
+		}
+		for {
+			n, err := publishOutbox(ctx, 50)
+			if err != nil {
+				if ctx.Err() == nil {
+					loggerFrom(ctx).Error("publishing outbox", "err", err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// logSink writes every event to the log.
+type logSink struct{}
+
+func (logSink) Name() string { return "log" }
+
+func (logSink) Publish(ctx context.Context, ev OutboxEvent) error {
+	loggerFrom(ctx).Info("event", "event_id", ev.EventID, "type", ev.Type, "aggregate", ev.AggregateType, "aggregate_id", ev.AggregateID)
+	return nil
+}
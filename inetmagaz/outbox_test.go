@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+type recordingSink struct {
+	err    error
+	events []string
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Publish(ctx context.Context, ev OutboxEvent) error {
+	s.events = append(s.events, ev.EventID)
+	return s.err
+}
+
+func TestPublishOutbox(t *testing.T) {
+	cols := []string{"id", "aggregate_type", "aggregate_id", "event_id", "event_type", "payload", "attempts"}
+	cases := []struct {
+		name   string
+		err    error
+		expect func(m sqlmock.Sqlmock)
+	}{
+		{name: "published events are marked", expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update outbox set published_at").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("update outbox set published_at").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "failed events are retried later", err: errors.New("smtp down"), expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update outbox set attempts").WithArgs("recording: smtp down", sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectExec("update outbox set attempts").WithArgs("recording: smtp down", sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			db = mockDB
+			sink := &recordingSink{err: tc.err}
+			defer func(s []EventSink) { eventSinks = s }(eventSinks)
+			eventSinks = []EventSink{sink}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("from outbox o where published_at is null").
+				WillReturnRows(sqlmock.NewRows(cols).
+					AddRow(1, "order", 3, "evt_1", eventOrderCreated, []byte(`{}`), 0).
+					AddRow(2, "product", 1, "evt_2", eventProductStockLow, []byte(`{}`), 0))
+			tc.expect(mock)
+			mock.ExpectCommit()
+
+			n, err := publishOutbox(context.Background(), 10)
+			if err != nil || n != 2 {
+				t.Fatalf("publishOutbox = %d, %v", n, err)
+			}
+			if len(sink.events) != 2 || sink.events[0] != "evt_1" {
+				t.Errorf("published %v", sink.events)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// passwordResetTTL is how long a reset link works.
+const passwordResetTTL = time.Hour
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type PasswordResetEmail struct {
+	Username string
+	Link     string
+	ValidFor string
+}
+
+// appURL is the frontend base URL used in links sent by email (APP_URL).
+func appURL() string {
+	if u := os.Getenv("APP_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:3000"
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgotPassword emails a reset link. It answers the same whether or not the
+// address is registered, so it can't be used to find accounts.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var userID int
+	var username, email string
+	err := db.QueryRowContext(r.Context(), "select id, username, email from users where email = $1", req.Email).Scan(&userID, &username, &email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("looking up user for password reset", "err", err)
+		return
+	}
+	if err == nil {
+		token := randomID("")
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err == nil {
+			defer tx.Rollback()
+			_, err = tx.ExecContext(r.Context(), "insert into password_resets (token_hash, user_id, expires_at) values ($1,$2,$3)", hashResetToken(token), userID, time.Now().Add(passwordResetTTL))
+		}
+		if err == nil {
+			err = queueEmail(r.Context(), tx, userID, "", emailPasswordReset, email, PasswordResetEmail{
+				Username: username,
+				Link:     appURL() + "/reset-password?token=" + url.QueryEscape(token),
+				ValidFor: "an hour",
+			})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("creating password reset", "err", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the address is registered, a reset link is on its way.",
+	})
+}
+
+// resetPassword sets a new password with a token from forgotPassword. A
+// token works once.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	hashed, err := HashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("hashing password", "err", err)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var userID int
+	err = tx.QueryRowContext(r.Context(), "update password_resets set used_at = now() where token_hash = $1 and used_at is null and expires_at > now() returning user_id", hashResetToken(req.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("using password reset token", "err", err)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), "update users set password_hash = $1 where id = $2", hashed, userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("updating password", "err", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed!",
+	})
+}
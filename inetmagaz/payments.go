@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Order statuses driven by payments. Only the payment provider moves an
+// order to paid; admins can't set it through updateStatus.
+const (
+	orderPendingPayment = "pending_payment"
+	orderPaid           = "paid"
+	orderPaymentFailed  = "payment_failed"
+	orderPaymentExpired = "payment_expired"
+)
+
+// unpaidOrderTTL is how long an order waits for payment before it expires
+// and its reserved stock goes back on sale.
+const unpaidOrderTTL = time.Hour
+
+// Payment statuses as stored in payments.status.
+const (
+	paymentRequiresConfirmation = "requires_confirmation"
+	paymentAuthorized           = "authorized"
+	paymentSucceeded            = "succeeded"
+	paymentFailed               = "failed"
+	paymentCanceled             = "canceled"
+)
+
+// paymentStatusRank orders payment statuses. A payment only ever moves to a
+// higher rank, so an event that arrives late or twice can't undo a later
+// one; succeeded, failed and canceled are final.
+var paymentStatusRank = map[string]int{
+	paymentRequiresConfirmation: 0,
+	paymentAuthorized:           1,
+	paymentSucceeded:            2,
+	paymentFailed:               2,
+	paymentCanceled:             2,
+}
+
+// paymentAdvances reports whether a payment in status from may move to to.
+func paymentAdvances(from, to string) bool {
+	return paymentStatusRank[to] > paymentStatusRank[from]
+}
+
+// Webhook event types a provider reports through VerifyWebhook.
+const (
+	eventPaymentAuthorized = "payment.authorized"
+	eventPaymentSucceeded  = "payment.succeeded"
+	eventPaymentFailed     = "payment.failed"
+)
+
+type PaymentIntent struct {
+	ID           string `json:"intent_id"`
+	ClientSecret string `json:"client_secret"`
+	Status       string `json:"status"`
+	Amount       int    `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+type PaymentEvent struct {
+	Type     string `json:"type"`
+	IntentID string `json:"intent_id"`
+	Amount   int    `json:"amount"`
+}
+
+type Refund struct {
+	ID     string `json:"refund_id"`
+	Amount int    `json:"amount"`
+	Status string `json:"status"`
+}
+
+// PaymentProvider is a payment gateway. Amounts are in minor units of the
+// currency the intent was opened in. Implementations must be safe for
+// concurrent use.
+type PaymentProvider interface {
+	Name() string
+	// CreateIntent starts a payment for an order. idempotencyKey makes
+	// retries return the same intent.
+	CreateIntent(ctx context.Context, amount Money, idempotencyKey string) (PaymentIntent, error)
+	// Capture collects an authorized payment.
+	Capture(ctx context.Context, intentID string, amount int) (PaymentIntent, error)
+	// Cancel abandons an intent that hasn't been paid, so it can't be paid
+	// any more. It fails once the customer has paid.
+	Cancel(ctx context.Context, intentID string) (PaymentIntent, error)
+	// Refund returns amount of a captured payment to the customer.
+	// idempotencyKey makes retries return the same refund.
+	Refund(ctx context.Context, intentID string, amount int, idempotencyKey string) (Refund, error)
+	// VerifyWebhook checks the signature on a webhook delivery and decodes
+	// the event it carries.
+	VerifyWebhook(payload []byte, header http.Header) (PaymentEvent, error)
+}
+
+var payments PaymentProvider
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// newPaymentProvider picks the provider from PAYMENT_PROVIDER. Only the
+// fake gateway exists so far, and it has to be asked for by name: it
+// accepts any payment, so it must never be what an unset variable gets.
+func newPaymentProvider() (PaymentProvider, error) {
+	switch p := os.Getenv("PAYMENT_PROVIDER"); p {
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	case "fake":
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, errors.New("PAYMENT_WEBHOOK_SECRET is required by the fake provider")
+		}
+		return newFakeProvider(secret), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", p)
+	}
+}
+
+type Payment struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	Provider  string    `json:"provider"`
+	IntentID  string    `json:"intent_id"`
+	Amount    int       `json:"amount"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// paymentWebhook receives provider callbacks. It is unauthenticated; the
+// provider signature is the authentication.
+func paymentWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	ev, err := payments.VerifyWebhook(payload, r.Header)
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if err := applyPaymentEvent(r.Context(), ev); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "unknown payment", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("applying payment event", "type", ev.Type, "intent_id", ev.IntentID, "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "received",
+	})
+}
+
+// applyPaymentEvent records a provider event on the payment and moves the
+// order along: authorized payments are captured, captured ones mark the
+// order paid, failed ones release the reserved stock. Events that would
+// move a payment back are ignored.
+func applyPaymentEvent(ctx context.Context, ev PaymentEvent) error {
+	if ev.Type == eventPaymentAuthorized {
+		var amount int
+		var status string
+		err := db.QueryRowContext(ctx, "select amount, status from payments where provider = $1 and intent_id = $2", payments.Name(), ev.IntentID).Scan(&amount, &status)
+		if err != nil {
+			return err
+		}
+		if status != paymentAuthorized && !paymentAdvances(status, paymentAuthorized) {
+			return nil
+		}
+		if _, err := setPaymentStatus(ctx, ev.IntentID, paymentAuthorized); err != nil {
+			return err
+		}
+		intent, err := payments.Capture(ctx, ev.IntentID, amount)
+		if err != nil {
+			return fmt.Errorf("capturing %s: %w", ev.IntentID, err)
+		}
+		if intent.Status != paymentSucceeded {
+			return nil
+		}
+		ev.Type = eventPaymentSucceeded
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	var status string
+	err = tx.QueryRowContext(ctx, "select order_id, status from payments where provider = $1 and intent_id = $2 for update", payments.Name(), ev.IntentID).Scan(&orderID, &status)
+	if err != nil {
+		return err
+	}
+	switch ev.Type {
+	case eventPaymentSucceeded:
+		if !paymentAdvances(status, paymentSucceeded) {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "update payments set status = $1, updated_at = now() where provider = $2 and intent_id = $3", paymentSucceeded, payments.Name(), ev.IntentID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "update orders set status = $1 where id = $2 and status = $3", orderPaid, orderID, orderPendingPayment)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if err := emitEvent(ctx, tx, eventOrderStatusChanged, orderID, OrderEventData{OrderID: orderID, Status: orderPaid}); err != nil {
+				return err
+			}
+		}
+	case eventPaymentFailed:
+		if !paymentAdvances(status, paymentFailed) {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "update payments set status = $1, updated_at = now() where provider = $2 and intent_id = $3", paymentFailed, payments.Name(), ev.IntentID); err != nil {
+			return err
+		}
+		if err := releaseOrderStock(ctx, tx, orderID, orderPaymentFailed); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return tx.Commit()
+}
+
+// runUnpaidOrderExpiry expires orders left awaiting payment for longer than
+// unpaidOrderTTL, until ctx is cancelled.
+func runUnpaidOrderExpiry(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := expireUnpaidOrders(ctx, time.Now().Add(-unpaidOrderTTL)); err != nil {
+				loggerFrom(ctx).Error("expiring unpaid orders", "err", err)
+			}
+		}
+	}
+}
+
+// expireUnpaidOrders cancels the payment intents of orders placed before
+// cutoff and still awaiting payment, then releases their stock. An order
+// whose intent the provider won't cancel, because the customer has just
+// paid, is left for the webhook to settle.
+func expireUnpaidOrders(ctx context.Context, cutoff time.Time) error {
+	rows, err := db.QueryContext(ctx, "select orders.id, payments.intent_id from orders left join payments on payments.order_id = orders.id where orders.status = $1 and orders.created_at < $2 order by orders.id limit 100", orderPendingPayment, cutoff)
+	if err != nil {
+		return err
+	}
+	type unpaid struct {
+		orderID  int
+		intentID *string
+	}
+	var orders []unpaid
+	for rows.Next() {
+		var u unpaid
+		if err := rows.Scan(&u.orderID, &u.intentID); err != nil {
+			rows.Close()
+			return err
+		}
+		orders = append(orders, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range orders {
+		if u.intentID != nil {
+			if _, err := payments.Cancel(ctx, *u.intentID); err != nil {
+				loggerFrom(ctx).Warn("canceling payment intent", "order_id", u.orderID, "intent_id", *u.intentID, "err", err)
+				continue
+			}
+		}
+		if err := expireOrder(ctx, u.orderID); err != nil {
+			return fmt.Errorf("expiring order %d: %w", u.orderID, err)
+		}
+	}
+	return nil
+}
+
+func expireOrder(ctx context.Context, orderID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "update payments set status = $1, updated_at = now() where order_id = $2 and status = $3", paymentCanceled, orderID, paymentRequiresConfirmation); err != nil {
+		return err
+	}
+	if err := releaseOrderStock(ctx, tx, orderID, orderPaymentExpired); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setPaymentStatus moves a payment to status unless it is already there or
+// further along.
+func setPaymentStatus(ctx context.Context, intentID, status string) (int64, error) {
+	var below []string
+	for s, rank := range paymentStatusRank {
+		if rank < paymentStatusRank[status] {
+			below = append(below, s)
+		}
+	}
+	res, err := db.ExecContext(ctx, "update payments set status = $1, updated_at = now() where provider = $2 and intent_id = $3 and status = any($4)", status, payments.Name(), intentID, pq.Array(below))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func getOrderPayments(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "invalid username", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select payments.id, payments.order_id, payments.provider, payments.intent_id, payments.amount, payments.status, payments.created_at, payments.updated_at from payments join orders on orders.id = payments.order_id join users on users.id = orders.user_id where payments.order_id = $1 and (users.username = $2 or exists (select 1 from users a where a.username = $2 and a.role = 'admin')) order by payments.id", id, username)
+	if err != nil {
+		http.Error(w, "error while getting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing payments", "err", err)
+		return
+	}
+	defer rows.Close()
+	ps := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.Provider, &p.IntentID, &p.Amount, &p.Status, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			http.Error(w, "error while getting data", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning payment", "err", err)
+			return
+		}
+		ps = append(ps, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ps)
+}
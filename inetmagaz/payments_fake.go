@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const fakeSignatureHeader = "Fake-Signature"
+
+// fakeProvider is an in-memory gateway for development and tests. Intents
+// wait for confirmFake, which plays the customer paying (or failing to) and
+// produces the signed webhook a real provider would send.
+type fakeProvider struct {
+	secret []byte
+
+	mu       sync.Mutex
+	intents  map[string]*fakeIntent
+	byKey    map[string]string
+	refunds  map[string]Refund
+	refundID int
+}
+
+type fakeIntent struct {
+	PaymentIntent
+	refunded int
+}
+
+func newFakeProvider(secret string) *fakeProvider {
+	return &fakeProvider{
+		secret:  []byte(secret),
+		intents: map[string]*fakeIntent{},
+		byKey:   map[string]string{},
+		refunds: map[string]Refund{},
+	}
+}
+
+func (f *fakeProvider) Name() string { return "fake" }
+
+func randomID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+func (f *fakeProvider) CreateIntent(ctx context.Context, amount Money, idempotencyKey string) (PaymentIntent, error) {
+	if amount.Amount <= 0 {
+		return PaymentIntent{}, errors.New("amount must be positive")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.byKey[idempotencyKey]; ok && idempotencyKey != "" {
+		return f.intents[id].PaymentIntent, nil
+	}
+	in := &fakeIntent{PaymentIntent: PaymentIntent{
+		ID:           randomID("fake_pi_"),
+		ClientSecret: randomID("fake_secret_"),
+		Status:       paymentRequiresConfirmation,
+		Amount:       amount.Amount,
+		Currency:     amount.Currency,
+	}}
+	f.intents[in.ID] = in
+	if idempotencyKey != "" {
+		f.byKey[idempotencyKey] = in.ID
+	}
+	return in.PaymentIntent, nil
+}
+
+func (f *fakeProvider) Capture(ctx context.Context, intentID string, amount int) (PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in, ok := f.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, fmt.Errorf("no such intent %s", intentID)
+	}
+	if in.Status == paymentSucceeded {
+		return in.PaymentIntent, nil
+	}
+	if in.Status != paymentAuthorized {
+		return PaymentIntent{}, fmt.Errorf("intent %s is %s, not authorized", intentID, in.Status)
+	}
+	if amount > in.Amount {
+		return PaymentIntent{}, fmt.Errorf("capture %d exceeds authorized %d", amount, in.Amount)
+	}
+	in.Amount = amount
+	in.Status = paymentSucceeded
+	return in.PaymentIntent, nil
+}
+
+func (f *fakeProvider) Cancel(ctx context.Context, intentID string) (PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in, ok := f.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, fmt.Errorf("no such intent %s", intentID)
+	}
+	if in.Status == paymentCanceled {
+		return in.PaymentIntent, nil
+	}
+	if in.Status != paymentRequiresConfirmation {
+		return PaymentIntent{}, fmt.Errorf("intent %s is %s, can't cancel", intentID, in.Status)
+	}
+	in.Status = paymentCanceled
+	return in.PaymentIntent, nil
+}
+
+func (f *fakeProvider) Refund(ctx context.Context, intentID string, amount int, idempotencyKey string) (Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rf, ok := f.refunds[idempotencyKey]; ok && idempotencyKey != "" {
+		return rf, nil
+	}
+	in, ok := f.intents[intentID]
+	if !ok {
+		return Refund{}, fmt.Errorf("no such intent %s", intentID)
+	}
+	if in.Status != paymentSucceeded {
+		return Refund{}, fmt.Errorf("intent %s is %s, not captured", intentID, in.Status)
+	}
+	if amount <= 0 || in.refunded+amount > in.Amount {
+		return Refund{}, fmt.Errorf("refund %d exceeds remaining %d", amount, in.Amount-in.refunded)
+	}
+	in.refunded += amount
+	f.refundID++
+	rf := Refund{ID: fmt.Sprintf("fake_re_%d", f.refundID), Amount: amount, Status: paymentSucceeded}
+	if idempotencyKey != "" {
+		f.refunds[idempotencyKey] = rf
+	}
+	return rf, nil
+}
+
+func (f *fakeProvider) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakeProvider) VerifyWebhook(payload []byte, header http.Header) (PaymentEvent, error) {
+	got, err := hex.DecodeString(header.Get(fakeSignatureHeader))
+	if err != nil {
+		return PaymentEvent{}, errBadSignature
+	}
+	want, _ := hex.DecodeString(f.sign(payload))
+	if !hmac.Equal(got, want) {
+		return PaymentEvent{}, errBadSignature
+	}
+	var ev PaymentEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return PaymentEvent{}, err
+	}
+	return ev, nil
+}
+
+// confirm settles an intent the way a customer completing (or abandoning)
+// checkout would, and returns the signed webhook payload describing it.
+// outcome is one of the eventPayment* types.
+func (f *fakeProvider) confirm(intentID, outcome string) ([]byte, http.Header, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in, ok := f.intents[intentID]
+	if !ok {
+		return nil, nil, fmt.Errorf("no such intent %s", intentID)
+	}
+	if in.Status != paymentRequiresConfirmation {
+		return nil, nil, fmt.Errorf("intent %s is already %s", intentID, in.Status)
+	}
+	switch outcome {
+	case eventPaymentAuthorized:
+		in.Status = paymentAuthorized
+	case eventPaymentSucceeded:
+		in.Status = paymentSucceeded
+	case eventPaymentFailed:
+		in.Status = paymentFailed
+	default:
+		return nil, nil, fmt.Errorf("unknown outcome %q", outcome)
+	}
+	payload, err := json.Marshal(PaymentEvent{Type: outcome, IntentID: intentID, Amount: in.Amount})
+	if err != nil {
+		return nil, nil, err
+	}
+	h := http.Header{}
+	h.Set(fakeSignatureHeader, f.sign(payload))
+	return payload, h, nil
+}
+
+type FakeConfirm struct {
+	Outcome string `json:"outcome"`
+}
+
+// confirmFakePayment lets admins complete a payment against the fake
+// gateway. The resulting webhook goes through the same verification and
+// handling as one from a real provider. It is only routed when the fake is
+// the configured provider.
+func confirmFakePayment(w http.ResponseWriter, r *http.Request) {
+	fake, ok := payments.(*fakeProvider)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can confirm fake payments", http.StatusForbidden)
+		return
+	}
+	var c FakeConfirm
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if c.Outcome == "" {
+		c.Outcome = eventPaymentSucceeded
+	}
+	payload, header, err := fake.confirm(chi.URLParam(r, "intent"), c.Outcome)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, err := payments.VerifyWebhook(payload, header)
+	if err == nil {
+		err = applyPaymentEvent(r.Context(), ev)
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("applying fake payment event", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "payment " + c.Outcome,
+	})
+}
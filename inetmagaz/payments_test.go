@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNewPaymentProviderRequiresExplicitFake(t *testing.T) {
+	for _, tc := range []struct {
+		provider, secret string
+		ok               bool
+	}{
+		{"", "", false},
+		{"", "s3cret", false},
+		{"fake", "", false},
+		{"fake", "s3cret", true},
+		{"stripe", "s3cret", false},
+	} {
+		t.Setenv("PAYMENT_PROVIDER", tc.provider)
+		t.Setenv("PAYMENT_WEBHOOK_SECRET", tc.secret)
+		p, err := newPaymentProvider()
+		if (err == nil) != tc.ok {
+			t.Errorf("provider %q secret %q: err = %v", tc.provider, tc.secret, err)
+		}
+		if tc.ok && p.Name() != tc.provider {
+			t.Errorf("provider %q: got %s", tc.provider, p.Name())
+		}
+	}
+}
+
+func TestLatePaymentEventsAreIgnored(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	payments = newFakeProvider("test-secret")
+
+	// An authorization reported after the capture neither rolls the
+	// payment back nor captures again.
+	mock.ExpectQuery("select amount, status from payments").
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "status"}).AddRow(1000, paymentSucceeded))
+	if err := applyPaymentEvent(context.Background(), PaymentEvent{Type: eventPaymentAuthorized, IntentID: "fake_pi_1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Nor does a failure reported after it.
+	mock.ExpectBegin()
+	mock.ExpectQuery("select order_id, status from payments").
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "status"}).AddRow(3, paymentSucceeded))
+	mock.ExpectRollback()
+	if err := applyPaymentEvent(context.Background(), PaymentEvent{Type: eventPaymentFailed, IntentID: "fake_pi_1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, tc := range []struct {
+		from, to string
+		want     bool
+	}{
+		{paymentRequiresConfirmation, paymentAuthorized, true},
+		{paymentAuthorized, paymentSucceeded, true},
+		{paymentAuthorized, paymentFailed, true},
+		{paymentSucceeded, paymentAuthorized, false},
+		{paymentSucceeded, paymentFailed, false},
+		{paymentFailed, paymentSucceeded, false},
+		{paymentAuthorized, paymentAuthorized, false},
+	} {
+		if got := paymentAdvances(tc.from, tc.to); got != tc.want {
+			t.Errorf("%s -> %s: got %v", tc.from, tc.to, got)
+		}
+	}
+}
+
+// downProvider is a gateway that can't open intents.
+type downProvider struct{ *fakeProvider }
+
+func (downProvider) CreateIntent(context.Context, Money, string) (PaymentIntent, error) {
+	return PaymentIntent{}, errors.New("gateway down")
+}
+
+func TestOrderWithoutIntentReleasesStock(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	payments = downProvider{newFakeProvider("test-secret")}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select products.id, products.name, products.category").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "category", "quantity", "price", "stock", "weight", "tax_class", "override"}).
+			AddRow(1, "Mug", "kitchen", 2, 500, 5, 300, "standard", nil))
+	mock.ExpectQuery("from cart_coupons").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("select exists \\(select 1 from shipping_methods").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("from tax_rates").WillReturnRows(sqlmock.NewRows(nil))
+	mock.ExpectQuery("insert into orders").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec("insert into outbox").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("update products set stock = stock -").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from cart").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// The gateway fails after the commit, so the order is released again.
+	mock.ExpectBegin()
+	mock.ExpectExec("update orders set status").WithArgs(orderPaymentFailed, 3, orderPendingPayment).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update products set stock = products.stock \\+ order_items.quantity").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from coupon_redemptions where order_id").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into outbox").WithArgs("order", 3, sqlmock.AnyArg(), eventOrderStatusChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err = placeOrder(context.Background(), 7, ShippingAddress{Country: "KZ"}, 0, shopCurrency)
+	if !errors.Is(err, errPaymentProvider) {
+		t.Fatalf("err = %v, want %v", err, errPaymentProvider)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpireUnpaidOrders(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	fake := newFakeProvider("test-secret")
+	payments = fake
+	open, err := fake.CreateIntent(context.Background(), money(1000), "order-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid, err := fake.CreateIntent(context.Background(), money(500), "order-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fake.confirm(paid.ID, eventPaymentSucceeded); err != nil {
+		t.Fatal(err)
+	}
+
+	cutoff := time.Now().Add(-unpaidOrderTTL)
+	mock.ExpectQuery("select orders.id, payments.intent_id from orders").WithArgs(orderPendingPayment, cutoff).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id"}).AddRow(3, open.ID).AddRow(4, paid.ID).AddRow(5, nil))
+	for _, id := range []int{3, 5} {
+		mock.ExpectBegin()
+		mock.ExpectExec("update payments set status").WithArgs(paymentCanceled, id, paymentRequiresConfirmation).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("update orders set status").WithArgs(orderPaymentExpired, id, orderPendingPayment).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("update products set stock = products.stock \\+ order_items.quantity").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("delete from coupon_redemptions where order_id").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("insert into outbox").WithArgs("order", id, sqlmock.AnyArg(), eventOrderStatusChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	if err := expireUnpaidOrders(context.Background(), cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	// A canceled intent can't be paid any more.
+	if _, _, err := fake.confirm(open.ID, eventPaymentSucceeded); err == nil {
+		t.Error("paid an intent of an expired order")
+	}
+}
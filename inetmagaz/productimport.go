@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxImportBytes = 32 << 20
+	maxImportRows  = 10000
+)
+
+// productColumns are the columns of an export, in order, and the ones an
+// import may have. Prices are in minor units of the shop currency.
+var productColumns = []string{"sku", "name", "description", "price", "currency", "stock", "image", "category", "weight", "tax_class"}
+
+var (
+	errImportTooLarge = fmt.Errorf("imports are limited to %d rows", maxImportRows)
+	errImportConflict = errors.New("name belongs to a product with another sku")
+	errImportArchived = errors.New("the product is archived; restore it first")
+)
+
+// productRow is one product read from an import. Only the columns in set
+// are written, so a file with just sku and stock updates the stock alone.
+type productRow struct {
+	n      int
+	p      Product
+	set    map[string]bool
+	errors []string
+}
+
+// setText sets col from its text in a CSV cell or a JSON value.
+func (row *productRow) setText(col, text string) {
+	row.set[col] = true
+	text = strings.TrimSpace(text)
+	number := func() int {
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			row.errors = append(row.errors, col+": must be a whole number")
+		}
+		return n
+	}
+	switch col {
+	case "sku":
+		row.p.SKU = text
+	case "name":
+		row.p.Name = text
+	case "description":
+		row.p.Description = text
+	case "price":
+		row.p.Price = money(number())
+	case "currency":
+		row.p.Currency = text
+	case "stock":
+		row.p.Stock = number()
+	case "image":
+		row.p.Image = text
+	case "category":
+		row.p.Category = text
+	case "weight":
+		row.p.Weight = number()
+	case "tax_class":
+		row.p.TaxClass = text
+	}
+}
+
+// validate checks what can be checked without the database.
+func (row *productRow) validate() {
+	if row.p.SKU == "" && row.p.Name == "" {
+		row.errors = append(row.errors, "a name or sku is required")
+	}
+	if row.set["name"] && row.p.Name == "" {
+		row.errors = append(row.errors, "name: can't be empty")
+	}
+	if err := checkPriceCurrency(row.p); err != nil {
+		row.errors = append(row.errors, err.Error())
+	}
+	if row.p.Stock < 0 {
+		row.errors = append(row.errors, "stock: can't be negative")
+	}
+	if row.p.Weight < 0 {
+		row.errors = append(row.errors, "weight: can't be negative")
+	}
+	if row.set["tax_class"] && row.p.TaxClass == "" {
+		row.p.TaxClass = defaultTaxClass
+	}
+}
+
+// readProductsCSV reads a CSV with a header row naming its columns, in
+// any order. Lines starting with # are skipped.
+func readProductsCSV(in io.Reader) ([]productRow, error) {
+	cr := csv.NewReader(in)
+	cr.Comment = '#'
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	} else if err != nil {
+		return nil, err
+	}
+	for i, col := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(col, "\ufeff")))
+		if !isProductColumn(header[i]) {
+			return nil, fmt.Errorf("unknown column %q; columns are %s", col, strings.Join(productColumns, ", "))
+		}
+	}
+	var rows []productRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxImportRows {
+			return nil, errImportTooLarge
+		}
+		line, _ := cr.FieldPos(0)
+		row := productRow{n: line, set: map[string]bool{}}
+		for i, col := range header {
+			row.setText(col, rec[i])
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readProductsJSON reads an array of objects keyed by column. Rows are
+// numbered from 1.
+func readProductsJSON(in io.Reader) ([]productRow, error) {
+	dec := json.NewDecoder(in)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("expected a JSON array of products")
+	}
+	var rows []productRow
+	for dec.More() {
+		if len(rows) == maxImportRows {
+			return nil, errImportTooLarge
+		}
+		var obj map[string]json.RawMessage
+		if err := dec.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("product %d: %w", len(rows)+1, err)
+		}
+		row := productRow{n: len(rows) + 1, set: map[string]bool{}}
+		for col, raw := range obj {
+			if !isProductColumn(col) {
+				row.errors = append(row.errors, fmt.Sprintf("unknown field %q", col))
+				continue
+			}
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				s = string(raw)
+			}
+			row.setText(col, s)
+		}
+		rows = append(rows, row)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func isProductColumn(col string) bool {
+	for _, c := range productColumns {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportReport says what an import did, or would have done, to each row.
+// Row is the line for CSV and the position for JSON. Nothing is saved
+// unless Saved.
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Saved   bool              `json:"saved"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	SKU    string   `json:"sku,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Action string   `json:"action"`
+	ID     int      `json:"id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// importProducts upserts rows: one with a sku matches the product with
+// that sku, then one with its name; one without matches by name. It's all
+// or nothing: every row is tried so the report lists every problem, but
+// if any fail nothing is saved. A dry run is rolled back either way.
+func importProducts(ctx context.Context, rows []productRow, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Rows: make([]ImportRowResult, len(rows))}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+	seen := map[string]int{}
+	for i := range rows {
+		row := &rows[i]
+		row.validate()
+		for _, kv := range [][2]string{{"sku", row.p.SKU}, {"name", row.p.Name}} {
+			col, v := kv[0], kv[1]
+			if v == "" {
+				continue
+			}
+			if first, ok := seen[col+"\x00"+v]; ok {
+				row.errors = append(row.errors, fmt.Sprintf("%s: same as row %d", col, first))
+			} else {
+				seen[col+"\x00"+v] = row.n
+			}
+		}
+		res := ImportRowResult{Row: row.n, SKU: row.p.SKU, Name: row.p.Name, Action: "error", Errors: row.errors}
+		if len(row.errors) == 0 {
+			var created bool
+			res.ID, created, err = upsertProduct(ctx, tx, row)
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				what := "name"
+				if strings.Contains(pqErr.Constraint, "sku") {
+					what = "sku"
+				}
+				res.Errors = []string{what + ": already used by another product"}
+			} else if errors.Is(err, errImportConflict) || errors.Is(err, errImportArchived) {
+				res.Errors = []string{err.Error()}
+			} else if err != nil {
+				return report, err
+			} else if created {
+				res.Action = "created"
+				report.Created++
+			} else {
+				res.Action = "updated"
+				report.Updated++
+			}
+		}
+		if res.Action == "error" {
+			report.Failed++
+		}
+		if dryRun && res.Action == "created" {
+			res.ID = 0
+		}
+		report.Rows[i] = res
+	}
+	if report.Failed > 0 || dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	report.Saved = true
+	return report, nil
+}
+
+// upsertProduct writes one row inside a savepoint, so a failed row leaves
+// the transaction usable for checking the rest.
+func upsertProduct(ctx context.Context, tx *sql.Tx, row *productRow) (id int, created bool, err error) {
+	if _, err := tx.ExecContext(ctx, "savepoint import_row"); err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.ExecContext(ctx, "rollback to savepoint import_row")
+		}
+	}()
+
+	err = sql.ErrNoRows
+	var archived bool
+	if row.p.SKU != "" {
+		err = tx.QueryRowContext(ctx, "select id, archived_at is not null from products where sku = $1", row.p.SKU).Scan(&id, &archived)
+	}
+	if err == sql.ErrNoRows && row.p.Name != "" {
+		var sku string
+		err = tx.QueryRowContext(ctx, "select id, coalesce(sku, ''), archived_at is not null from products where name = $1", row.p.Name).Scan(&id, &sku, &archived)
+		if err == nil && sku != "" && row.p.SKU != "" && sku != row.p.SKU {
+			return 0, false, fmt.Errorf("%w %s", errImportConflict, sku)
+		}
+	}
+	if err == nil && archived {
+		return 0, false, errImportArchived
+	}
+	if err == sql.ErrNoRows {
+		p := row.p
+		if p.Name == "" {
+			p.Name = p.SKU
+		}
+		if p.TaxClass == "" {
+			p.TaxClass = defaultTaxClass
+		}
+		err = tx.QueryRowContext(ctx, "insert into products (sku,name,description,price,stock,image,category,weight,tax_class) values (nullif($1,''),$2,$3,$4,$5,$6,$7,$8,$9) returning id",
+			p.SKU, p.Name, p.Description, p.Price, p.Stock, p.Image, p.Category, p.Weight, p.TaxClass).Scan(&id)
+		return id, true, err
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	values := map[string]any{
+		"sku": row.p.SKU, "name": row.p.Name, "description": row.p.Description, "price": row.p.Price, "stock": row.p.Stock,
+		"image": row.p.Image, "category": row.p.Category, "weight": row.p.Weight, "tax_class": row.p.TaxClass,
+	}
+	var sets []string
+	args := []any{id}
+	for _, col := range productColumns {
+		if v, ok := values[col]; ok && row.set[col] {
+			args = append(args, v)
+			if col == "sku" {
+				sets = append(sets, fmt.Sprintf("sku = nullif($%d, '')", len(args)))
+			} else {
+				sets = append(sets, fmt.Sprintf("%s = $%d", col, len(args)))
+			}
+		}
+	}
+	if len(sets) > 0 {
+		_, err = tx.ExecContext(ctx, "update products set "+strings.Join(sets, ", ")+" where id = $1", args...)
+	}
+	return id, false, err
+}
+
+// postProductImport takes a CSV (text/csv) or JSON (application/json)
+// body. It answers 200 with the report when every row is fine, and 422
+// with it when any isn't; ?dry_run=true checks without saving.
+func postProductImport(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can import products", http.StatusForbidden)
+		return
+	}
+	// Sending 32 MiB and saving 10000 rows can outlast the server's
+	// ReadTimeout and WriteTimeout.
+	allowLongTransfer(w, r)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var rows []productRow
+	var err error
+	switch mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt {
+	case "text/csv":
+		rows, err = readProductsCSV(body)
+	case "application/json":
+		rows, err = readProductsJSON(body)
+	default:
+		http.Error(w, "send text/csv or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		http.Error(w, fmt.Sprintf("imports are limited to %d MiB", maxImportBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 {
+		http.Error(w, "no products to import", http.StatusBadRequest)
+		return
+	}
+	report, err := importProducts(r.Context(), rows, dryRun)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("importing products", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Failed > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// exportProducts writes the catalog as CSV or JSON, a row at a time, in
+// the form importProducts reads back.
+func exportProducts(ctx context.Context, w io.Writer, format string) error {
+	rows, err := db.QueryContext(ctx, "select coalesce(sku, ''), name, description, price, stock, image, category, weight, tax_class from products where archived_at is null order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		cw.Write(productColumns)
+	} else {
+		io.WriteString(w, "[")
+	}
+	for n := 0; rows.Next(); n++ {
+		var p Product
+		if err := rows.Scan(&p.SKU, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Image, &p.Category, &p.Weight, &p.TaxClass); err != nil {
+			return err
+		}
+		if cw != nil {
+			cw.Write([]string{p.SKU, p.Name, p.Description, strconv.Itoa(p.Price.Amount), p.Price.Currency, strconv.Itoa(p.Stock), p.Image, p.Category, strconv.Itoa(p.Weight), p.TaxClass})
+			if n%100 == 99 {
+				cw.Flush()
+			}
+			continue
+		}
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		b, err := json.Marshal(map[string]any{
+			"sku": p.SKU, "name": p.Name, "description": p.Description, "price": p.Price, "currency": p.Price.Currency,
+			"stock": p.Stock, "image": p.Image, "category": p.Category, "weight": p.Weight, "tax_class": p.TaxClass,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if cw != nil {
+		cw.Flush()
+		return cw.Error()
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+// getProductExport downloads the catalog as CSV, or JSON with
+// ?format=json. It's streamed, so a failure after the first row can only
+// cut the file short; that's logged.
+func getProductExport(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can export products", http.StatusForbidden)
+		return
+	}
+	// A large catalog takes longer than the server's WriteTimeout to send.
+	allowLongTransfer(w, r)
+	out := &exportWriter{w: w, format: r.URL.Query().Get("format")}
+	switch out.format {
+	case "", "csv":
+		out.format, out.contentType = "csv", "text/csv; charset=utf-8"
+	case "json":
+		out.contentType = "application/json"
+	default:
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	if err := exportProducts(r.Context(), out, out.format); err != nil {
+		if !out.started {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		loggerFrom(r.Context()).Error("exporting products", "err", err)
+	}
+}
+
+// exportWriter sends the download headers with the first write, so an
+// error before then can still be answered with a 500.
+type exportWriter struct {
+	w                   http.ResponseWriter
+	format, contentType string
+	started             bool
+}
+
+func (e *exportWriter) Write(b []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.w.Header().Set("Content-Type", e.contentType)
+		e.w.Header().Set("Content-Disposition", `attachment; filename="products.`+e.format+`"`)
+	}
+	return e.w.Write(b)
+}
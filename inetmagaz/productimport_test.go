@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReadProductsCSV(t *testing.T) {
+	in := "\ufeffSKU, Name ,price,stock,description\n# a comment\nMUG-1,Mug,500,3,\"Big, white\"\n,Tee,x,-1,\n"
+	rows, err := readProductsCSV(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("rows = %+v", rows)
+	}
+	mug := rows[0]
+	mug.validate()
+	if mug.n != 3 || mug.p.SKU != "MUG-1" || mug.p.Name != "Mug" || mug.p.Price != money(500) || mug.p.Stock != 3 || mug.p.Description != "Big, white" || len(mug.errors) > 0 {
+		t.Errorf("mug = %+v", mug)
+	}
+	if !mug.set["description"] || mug.set["image"] {
+		t.Errorf("mug sets %v", mug.set)
+	}
+	tee := rows[1]
+	tee.validate()
+	want := []string{"price: must be a whole number", "stock: can't be negative"}
+	if tee.n != 4 || !reflect.DeepEqual(tee.errors, want) {
+		t.Errorf("tee = %d %q", tee.n, tee.errors)
+	}
+
+	for _, in := range []string{"", "name,colour\nMug,red\n", "name,price\nMug\n"} {
+		if _, err := readProductsCSV(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestReadProductsJSON(t *testing.T) {
+	rows, err := readProductsJSON(strings.NewReader(`[{"name":"Mug","price":500,"currency":"KZT"},{"sku":"TEE","colour":"red"},{"name":""}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, row := range rows {
+		row.validate()
+		got = append(got, row.errors)
+	}
+	want := [][]string{{"prices are in RUB"}, {`unknown field "colour"`}, {"a name or sku is required", "name: can't be empty"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %q", got)
+	}
+	if rows[0].p.Price != money(500) || rows[1].n != 2 || rows[1].p.SKU != "TEE" {
+		t.Errorf("rows = %+v", rows)
+	}
+	if _, err := readProductsJSON(strings.NewReader(`{"name":"Mug"}`)); err == nil {
+		t.Error("an object instead of an array: no error")
+	}
+}
+
+func TestExportRoundTrips(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	cols := []string{"sku", "name", "description", "price", "stock", "image", "category", "weight", "tax_class"}
+	for range 2 {
+		mock.ExpectQuery("from products where archived_at is null order by id").WillReturnRows(sqlmock.NewRows(cols).
+			AddRow("MUG-1", "Mug", "Big, \"white\"\nmug", 500, 3, "mug.png", "kitchen", 300, "standard").
+			AddRow("", "Tee", "", 1500, 0, "", "", 0, "reduced"))
+	}
+
+	for _, format := range []string{"csv", "json"} {
+		var out strings.Builder
+		if err := exportProducts(context.Background(), &out, format); err != nil {
+			t.Fatal(err)
+		}
+		read := readProductsCSV
+		if format == "json" {
+			read = readProductsJSON
+		}
+		rows, err := read(strings.NewReader(out.String()))
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, out.String())
+		}
+		if len(rows) != 2 {
+			t.Fatalf("%s: rows = %+v", format, rows)
+		}
+		for _, row := range rows {
+			row.validate()
+			if len(row.errors) > 0 || len(row.set) != len(productColumns) {
+				t.Errorf("%s: row %d = %+v", format, row.n, row)
+			}
+		}
+		if p := rows[0].p; p.Description != "Big, \"white\"\nmug" || p.Price != money(500) || p.Weight != 300 {
+			t.Errorf("%s: mug = %+v", format, p)
+		}
+		if p := rows[1].p; p.SKU != "" || p.TaxClass != "reduced" {
+			t.Errorf("%s: tee = %+v", format, p)
+		}
+	}
+}
@@ -3,26 +3,52 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
 )
 
 type Product struct {
 	ID          int    `json:"id"`
+	SKU         string `json:"sku"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
-	Price       int    `json:"price"`
+	Price       Money  `json:"price"`
+	Currency    string `json:"currency"`
 	Stock       int    `json:"stock"`
 	Image       string `json:"image"`
+	Category    string `json:"category"`
+	Weight      int    `json:"weight"`
+	TaxClass    string `json:"tax_class"`
+	// ArchivedAt is set once the product is deleted. Archived products
+	// aren't listed or sold but can still be fetched, for order history.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// Images is only filled in for a single product.
+	Images []ProductImage `json:"images,omitempty"`
 }
 type Productl struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Price int    `json:"price"`
-	Image string `json:"image"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Price    Money  `json:"price"`
+	Currency string `json:"currency"`
+	Image    string `json:"image"`
+}
+
+// checkPriceCurrency rejects a product priced in anything but the shop
+// currency; an empty currency means the shop's.
+func checkPriceCurrency(p Product) error {
+	if p.Currency != "" && !strings.EqualFold(p.Currency, shopCurrency) {
+		return fmt.Errorf("prices are in %s", shopCurrency)
+	}
+	if p.Price.Amount < 0 {
+		return fmt.Errorf("price can't be negative")
+	}
+	return nil
 }
 
 func deleteProduct(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +61,7 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No username in context", http.StatusServiceUnavailable)
 		return
 	}
-	row := db.QueryRow("select role from users where username = $1", username)
+	row := db.QueryRowContext(r.Context(), "select role from users where username = $1", username)
 	var role string
 	err := row.Scan(&role)
 	if err != nil {
@@ -44,10 +70,14 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 	}
 	if role == "admin" {
 		id := chi.URLParam(r, "id")
-		_, err := db.Exec("delete from products where id = $1", id)
+		found, err := archiveProduct(r.Context(), id)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			log.Print(err)
+			loggerFrom(r.Context()).Error("archiving product", "err", err)
+			return
+		}
+		if !found {
+			http.Error(w, "product not found", http.StatusNotFound)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -68,15 +98,31 @@ func getProductByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid param", http.StatusInternalServerError)
 		return
 	}
+	pr, ok := productPricing(w, r)
+	if !ok {
+		return
+	}
 	var p Product
-	row := db.QueryRow("select * from products where id = $1", id)
-	err = row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Image)
+	var override *int
+	row := db.QueryRowContext(r.Context(), "select products.id, coalesce(products.sku, ''), products.name, products.description, products.price, products.stock, products.image, products.category, products.weight, products.tax_class, products.archived_at, product_prices.price from products left join product_prices on product_prices.product_id = products.id and product_prices.currency = $2 where products.id = $1", id, pr.Currency)
+	err = row.Scan(&p.ID, &p.SKU, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Image, &p.Category, &p.Weight, &p.TaxClass, &p.ArchivedAt, &override)
 	if err == sql.ErrNoRows {
 		http.Error(w, "product not found", http.StatusNotFound)
 		return
 	} else if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Panic(err)
+		loggerFrom(r.Context()).Error("loading product", "err", err)
+		return
+	}
+	if p.Price, err = pr.price(p.Price, override); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("converting product price", "err", err)
+		return
+	}
+	p.Currency = p.Price.Currency
+	if p.Images, err = loadProductImages(r.Context(), db, id); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading product images", "err", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -94,7 +140,7 @@ func putProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var role string
-	row := db.QueryRow("select role from users where username = $1", username)
+	row := db.QueryRowContext(r.Context(), "select role from users where username = $1", username)
 	err := row.Scan(&role)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -107,10 +153,14 @@ func putProduct(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
 			return
 		}
-		_, err := db.Exec("UPDATE products SET name = CASE WHEN $1 = '' THEN name ELSE $1 END, description = CASE WHEN $2 = '' THEN description ELSE $2 END, price = $3, stock = CASE WHEN $4 = 0 THEN stock ELSE $4 END, image = CASE WHEN $5 = '' THEN image ELSE $5 END WHERE id = $6", p.Name, p.Description, p.Price, p.Stock, p.Image, id)
+		if err := checkPriceCurrency(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := db.ExecContext(r.Context(), "UPDATE products SET name = CASE WHEN $1 = '' THEN name ELSE $1 END, description = CASE WHEN $2 = '' THEN description ELSE $2 END, price = $3, stock = CASE WHEN $4 = 0 THEN stock ELSE $4 END, image = CASE WHEN $5 = '' THEN image ELSE $5 END, category = CASE WHEN $6 = '' THEN category ELSE $6 END, weight = CASE WHEN $7 = 0 THEN weight ELSE $7 END, tax_class = CASE WHEN $8 = '' THEN tax_class ELSE $8 END, sku = CASE WHEN $10 = '' THEN sku ELSE $10 END WHERE id = $9", p.Name, p.Description, p.Price, p.Stock, p.Image, p.Category, p.Weight, p.TaxClass, id, p.SKU)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			log.Print(err)
+			loggerFrom(r.Context()).Error("updating product", "err", err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -124,20 +174,30 @@ func putProduct(w http.ResponseWriter, r *http.Request) {
 }
 
 func getProducts(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("select id,name, price,image from products")
+	pr, ok := productPricing(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select products.id, products.name, products.price, products.image, product_prices.price from products left join product_prices on product_prices.product_id = products.id and product_prices.currency = $1 where products.archived_at is null", pr.Currency)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Panic(err)
+		loggerFrom(r.Context()).Error("listing products", "err", err)
+		return
 	}
 	defer rows.Close()
-	var products []Productl
+	products := []Productl{}
 	for rows.Next() {
 		p := Productl{}
-		err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.Image)
+		var override *int
+		err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.Image, &override)
+		if err == nil {
+			p.Price, err = pr.price(p.Price, override)
+		}
 		if err != nil {
-			log.Print("something with db", err)
+			loggerFrom(r.Context()).Warn("scanning product", "err", err)
 			continue
 		}
+		p.Currency = p.Price.Currency
 		products = append(products, p)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -154,7 +214,7 @@ func postProducts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var role string
-	row := db.QueryRow("select role from users where username = $1", username)
+	row := db.QueryRowContext(r.Context(), "select role from users where username = $1", username)
 	err := row.Scan(&role)
 	if err != nil {
 		http.Error(w, "invalid data", http.StatusInternalServerError)
@@ -166,7 +226,7 @@ func postProducts(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
 			return
 		}
-		tx, err := db.Begin()
+		tx, err := db.BeginTx(r.Context(), nil)
 		if err != nil {
 			http.Error(w, "Transaction error", http.StatusInternalServerError)
 			return
@@ -174,9 +234,20 @@ func postProducts(w http.ResponseWriter, r *http.Request) {
 		defer tx.Rollback()
 
 		for _, product := range products {
-			_, err := tx.Exec("insert into products (name,description,price,stock,image) values ($1,$2,$3,$4,$5)", product.Name, product.Description, product.Price, product.Stock, product.Image)
-			if err != nil {
+			if err := checkPriceCurrency(product); err != nil {
+				http.Error(w, product.Name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if product.TaxClass == "" {
+				product.TaxClass = defaultTaxClass
+			}
+			_, err := tx.ExecContext(r.Context(), "insert into products (name,description,price,stock,image,category,weight,tax_class,sku) values ($1,$2,$3,$4,$5,$6,$7,$8,nullif($9,''))", product.Name, product.Description, product.Price, product.Stock, product.Image, product.Category, product.Weight, product.TaxClass, product.SKU)
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				http.Error(w, product.Name+": a product with this name or sku already exists", http.StatusConflict)
+				return
+			} else if err != nil {
 				http.Error(w, "Insert failed", http.StatusInternalServerError)
+				loggerFrom(r.Context()).Error("inserting product", "name", product.Name, "err", err)
 				return
 			}
 		}
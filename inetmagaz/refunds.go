@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Order statuses set by refunds. Like paid, admins can't set these through
+// updateStatus.
+const (
+	orderPartiallyRefunded = "partially_refunded"
+	orderRefunded          = "refunded"
+)
+
+// OrderItem is an ordered line. Discount is the line's share of the
+// order's coupon discount and Tax what the line was taxed at TaxRate basis
+// points.
+type OrderItem struct {
+	ID               int   `json:"id"`
+	ProductID        int   `json:"product_id"`
+	Quantity         int   `json:"quantity"`
+	Price            Money `json:"price"`
+	Discount         Money `json:"discount"`
+	Tax              Money `json:"tax"`
+	TaxRate          int   `json:"tax_rate"`
+	RefundedQuantity int   `json:"refunded_quantity"`
+	// taxAdded is set when the tax was charged on top of the price
+	// rather than included in it.
+	taxAdded bool
+}
+
+type RefundLine struct {
+	ItemID   int `json:"item_id"`
+	Quantity int `json:"quantity"`
+}
+
+// RefundRequest describes a refund. With items, the amount is their price
+// times the refunded quantity. Without items, amount refunds that much of
+// the order without touching its lines; with neither, everything not yet
+// refunded is returned. Restock puts refunded quantities back in stock.
+type RefundRequest struct {
+	Items   []RefundLine `json:"items"`
+	Amount  int          `json:"amount"`
+	Restock bool         `json:"restock"`
+	Reason  string       `json:"reason"`
+}
+
+type OrderRefund struct {
+	ID        int          `json:"id"`
+	OrderID   int          `json:"order_id"`
+	RefundID  string       `json:"refund_id"`
+	Amount    int          `json:"amount"`
+	Reason    string       `json:"reason"`
+	Restocked bool         `json:"restocked"`
+	Items     []RefundLine `json:"items"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type RefundCreated struct {
+	Message        string      `json:"message"`
+	Refund         OrderRefund `json:"refund"`
+	OrderStatus    string      `json:"order_status"`
+	RefundedAmount int         `json:"refunded_amount"`
+}
+
+var (
+	errNotRefundable = errors.New("order has no captured payment to refund")
+	errBadRefund     = errors.New("invalid refund")
+)
+
+func postRefund(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "invalid username", http.StatusInternalServerError)
+		return
+	}
+	var role string
+	err := db.QueryRowContext(r.Context(), "select role from users where username = $1", username).Scan(&role)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if role != "admin" {
+		http.Error(w, "only admin can refund orders", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	created, err := refundOrder(r.Context(), id, req)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errBadRefund) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errNotRefundable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errPaymentProvider) {
+		http.Error(w, "payment provider unavailable", http.StatusBadGateway)
+		loggerFrom(r.Context()).Error("refunding payment", "order_id", id, "err", err)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("refunding order", "order_id", id, "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// Refund statuses as stored in refunds.status.
+const (
+	refundPending   = "pending"
+	refundSucceeded = "succeeded"
+	refundFailed    = "failed"
+)
+
+// refundOrder refunds part or all of a paid order through the payment
+// provider. The refund is first recorded as pending with the order row
+// locked, so concurrent refunds can't exceed what was paid; the provider is
+// then asked for the money with a key derived from that row, and only its
+// answer applies the refund to the order. A refund left pending by a
+// failure after the provider paid out is finished, not repeated, by the
+// next refund of the order.
+func refundOrder(ctx context.Context, orderID int, req RefundRequest) (RefundCreated, error) {
+	var created RefundCreated
+	if err := finishPendingRefunds(ctx, orderID); err != nil {
+		return created, err
+	}
+	p, err := reserveRefund(ctx, orderID, req)
+	if err != nil {
+		return created, err
+	}
+	refund, err := payments.Refund(ctx, p.intentID, p.amount, refundKey(p.id))
+	if err != nil {
+		if _, ferr := db.ExecContext(ctx, "update refunds set status = $1 where id = $2 and status = $3", refundFailed, p.id, refundPending); ferr != nil {
+			loggerFrom(ctx).Error("failing refund", "refund_id", p.id, "err", ferr)
+		}
+		return created, fmt.Errorf("%w: %v", errPaymentProvider, err)
+	}
+	if created.OrderStatus, created.RefundedAmount, err = completeRefund(ctx, p.id, refund.ID); err != nil {
+		return created, err
+	}
+	created.Message = "refunded!"
+	created.Refund = OrderRefund{
+		ID:        p.id,
+		OrderID:   orderID,
+		RefundID:  refund.ID,
+		Amount:    p.amount,
+		Reason:    req.Reason,
+		Restocked: p.restock,
+		Items:     p.lines,
+		CreatedAt: p.createdAt,
+	}
+	return created, nil
+}
+
+// refundKey is the provider idempotency key for refund id.
+func refundKey(id int) string {
+	return fmt.Sprintf("refund-%d", id)
+}
+
+// pendingRefund is a refund recorded but not yet paid out.
+type pendingRefund struct {
+	id        int
+	intentID  string
+	amount    int
+	restock   bool
+	lines     []RefundLine
+	createdAt time.Time
+}
+
+// reserveRefund records req as a pending refund of the order. Pending
+// refunds count as refunded when checking what is left.
+func reserveRefund(ctx context.Context, orderID int, req RefundRequest) (pendingRefund, error) {
+	var p pendingRefund
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var total, refunded, pending int
+	err = tx.QueryRowContext(ctx, "select status, total_price, refunded_amount, (select coalesce(sum(amount), 0) from refunds where refunds.order_id = orders.id and refunds.status = $2) from orders where id = $1 for update", orderID, refundPending).Scan(&status, &total, &refunded, &pending)
+	if err != nil {
+		return p, err
+	}
+	var paymentID int
+	err = tx.QueryRowContext(ctx, "select id, intent_id from payments where order_id = $1 and provider = $2 and status = $3 order by id desc limit 1", orderID, payments.Name(), paymentSucceeded).Scan(&paymentID, &p.intentID)
+	if err == sql.ErrNoRows || status == orderRefunded {
+		return p, errNotRefundable
+	} else if err != nil {
+		return p, err
+	}
+
+	items, err := lockOrderItems(ctx, tx, orderID)
+	if err != nil {
+		return p, err
+	}
+	remaining := total - refunded - pending
+	p.amount, p.lines, err = refundLines(req, items, remaining)
+	if err != nil {
+		return p, err
+	}
+	if p.amount > remaining {
+		return p, fmt.Errorf("%w: %d exceeds the %d left to refund", errBadRefund, p.amount, remaining)
+	}
+
+	p.restock = req.Restock && len(p.lines) > 0
+	err = tx.QueryRowContext(ctx, "insert into refunds (order_id, payment_id, amount, reason, restocked, status) values ($1,$2,$3,$4,$5,$6) returning id, created_at", orderID, paymentID, p.amount, req.Reason, p.restock, refundPending).Scan(&p.id, &p.createdAt)
+	if err != nil {
+		return p, err
+	}
+	for _, l := range p.lines {
+		if _, err := tx.ExecContext(ctx, "insert into refund_items (refund_id, order_item_id, quantity) values ($1,$2,$3)", p.id, l.ItemID, l.Quantity); err != nil {
+			return p, err
+		}
+	}
+	return p, tx.Commit()
+}
+
+// completeRefund applies a pending refund the provider has paid out to its
+// order, and returns the order's new status and refunded total. A refund
+// already completed is left alone.
+func completeRefund(ctx context.Context, refundID int, providerRefundID string) (string, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var orderID, total, refunded int
+	var status string
+	err = tx.QueryRowContext(ctx, "select orders.id, orders.status, orders.total_price, orders.refunded_amount from orders join refunds on refunds.order_id = orders.id where refunds.id = $1 for update of orders", refundID).Scan(&orderID, &status, &total, &refunded)
+	if err != nil {
+		return "", 0, err
+	}
+	var amount int
+	var restock bool
+	err = tx.QueryRowContext(ctx, "update refunds set status = $1, provider_refund_id = $2 where id = $3 and status = $4 returning amount, restocked", refundSucceeded, providerRefundID, refundID, refundPending).Scan(&amount, &restock)
+	if err == sql.ErrNoRows {
+		return status, refunded, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "update order_items set refunded_quantity = order_items.refunded_quantity + refund_items.quantity from refund_items where refund_items.refund_id = $1 and order_items.id = refund_items.order_item_id", refundID); err != nil {
+		return "", 0, err
+	}
+	if restock {
+		if _, err := tx.ExecContext(ctx, "update products set stock = products.stock + refund_items.quantity from refund_items join order_items on order_items.id = refund_items.order_item_id where refund_items.refund_id = $1 and products.id = order_items.product_id", refundID); err != nil {
+			return "", 0, err
+		}
+	}
+
+	refunded += amount
+	newStatus := orderPartiallyRefunded
+	if refunded == total {
+		newStatus = orderRefunded
+	}
+	if _, err := tx.ExecContext(ctx, "update orders set refunded_amount = $1, status = $2 where id = $3", refunded, newStatus, orderID); err != nil {
+		return "", 0, err
+	}
+	if newStatus != status {
+		if err := emitEvent(ctx, tx, eventOrderStatusChanged, orderID, OrderEventData{OrderID: orderID, Status: newStatus}); err != nil {
+			return "", 0, err
+		}
+	}
+	return newStatus, refunded, tx.Commit()
+}
+
+// finishPendingRefunds asks the provider again, with the same keys, for the
+// order's refunds left pending, and completes them.
+func finishPendingRefunds(ctx context.Context, orderID int) error {
+	rows, err := db.QueryContext(ctx, "select refunds.id, payments.intent_id, refunds.amount from refunds join payments on payments.id = refunds.payment_id where refunds.order_id = $1 and refunds.status = $2 order by refunds.id", orderID, refundPending)
+	if err != nil {
+		return err
+	}
+	var pending []pendingRefund
+	for rows.Next() {
+		var p pendingRefund
+		if err := rows.Scan(&p.id, &p.intentID, &p.amount); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range pending {
+		refund, err := payments.Refund(ctx, p.intentID, p.amount, refundKey(p.id))
+		if err != nil {
+			return fmt.Errorf("%w: finishing refund %d: %v", errPaymentProvider, p.id, err)
+		}
+		if _, _, err := completeRefund(ctx, p.id, refund.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockOrderItems locks the order's lines. Quantities in pending refunds
+// count as refunded.
+func lockOrderItems(ctx context.Context, tx *sql.Tx, orderID int) ([]OrderItem, error) {
+	rows, err := tx.QueryContext(ctx, "select order_items.id, order_items.product_id, order_items.quantity, order_items.price, order_items.discount, order_items.tax, order_items.tax_rate, order_items.refunded_quantity + (select coalesce(sum(refund_items.quantity), 0) from refund_items join refunds on refunds.id = refund_items.refund_id where refund_items.order_item_id = order_items.id and refunds.status = $2), not orders.tax_inclusive from order_items join orders on orders.id = order_items.order_id where order_items.order_id = $1 order by order_items.id for update of order_items", orderID, refundPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []OrderItem
+	for rows.Next() {
+		var it OrderItem
+		if err := rows.Scan(&it.ID, &it.ProductID, &it.Quantity, &it.Price, &it.Discount, &it.Tax, &it.TaxRate, &it.RefundedQuantity, &it.taxAdded); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// refundLines works out the amount and the order lines a request refunds.
+// remaining is how much of the order hasn't been refunded yet.
+func refundLines(req RefundRequest, items []OrderItem, remaining int) (int, []RefundLine, error) {
+	lines := []RefundLine{}
+	if len(req.Items) > 0 {
+		byID := map[int]OrderItem{}
+		for _, it := range items {
+			byID[it.ID] = it
+		}
+		if req.Amount != 0 {
+			return 0, nil, fmt.Errorf("%w: give either items or amount", errBadRefund)
+		}
+		seen := map[int]bool{}
+		amount := 0
+		for _, l := range req.Items {
+			it, ok := byID[l.ItemID]
+			if !ok || seen[l.ItemID] {
+				return 0, nil, fmt.Errorf("%w: item %d", errBadRefund, l.ItemID)
+			}
+			seen[l.ItemID] = true
+			if l.Quantity <= 0 || l.Quantity > it.Quantity-it.RefundedQuantity {
+				return 0, nil, fmt.Errorf("%w: %d of item %d, %d left", errBadRefund, l.Quantity, l.ItemID, it.Quantity-it.RefundedQuantity)
+			}
+			// Refund what was paid: the line's price less its share of
+			// the coupon discount, plus its share of tax charged on top.
+			amount += l.Quantity*it.Price.Amount - unitsShare(it.Discount.Amount, it, l.Quantity)
+			if it.taxAdded {
+				amount += unitsShare(it.Tax.Amount, it, l.Quantity)
+			}
+			lines = append(lines, l)
+		}
+		return amount, lines, nil
+	}
+	if req.Amount < 0 {
+		return 0, nil, fmt.Errorf("%w: negative amount", errBadRefund)
+	}
+	if req.Amount > 0 {
+		return req.Amount, lines, nil
+	}
+
+	// Full refund: the rest of the money and every line still outstanding.
+	// Earlier amount-only refunds mean remaining can be less than the lines
+	// are worth.
+	if remaining <= 0 {
+		return 0, nil, fmt.Errorf("%w: nothing left to refund", errBadRefund)
+	}
+	for _, it := range items {
+		if left := it.Quantity - it.RefundedQuantity; left > 0 {
+			lines = append(lines, RefundLine{ItemID: it.ID, Quantity: left})
+		}
+	}
+	return remaining, lines, nil
+}
+
+// unitsShare is the part of total, spread over the line's units, that
+// comes with refunding n more of them. Shares are counted from the units
+// already refunded, so rounding evens out and the last unit gets the rest.
+func unitsShare(total int, it OrderItem, n int) int {
+	done := it.RefundedQuantity
+	return total*(done+n)/it.Quantity - total*done/it.Quantity
+}
+
+func getOrderRefunds(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(usernameKey)
+	if username == nil {
+		http.Error(w, "invalid username", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select refunds.id, refunds.order_id, refunds.provider_refund_id, refunds.amount, refunds.reason, refunds.restocked, refunds.created_at, refund_items.order_item_id, refund_items.quantity from refunds join orders on orders.id = refunds.order_id join users on users.id = orders.user_id left join refund_items on refund_items.refund_id = refunds.id where refunds.order_id = $1 and refunds.status = $3 and (users.username = $2 or exists (select 1 from users a where a.username = $2 and a.role = 'admin')) order by refunds.id, refund_items.order_item_id", id, username, refundSucceeded)
+	if err != nil {
+		http.Error(w, "error while getting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing refunds", "err", err)
+		return
+	}
+	defer rows.Close()
+	refunds := []OrderRefund{}
+	for rows.Next() {
+		var rf OrderRefund
+		var itemID, quantity sql.NullInt64
+		if err := rows.Scan(&rf.ID, &rf.OrderID, &rf.RefundID, &rf.Amount, &rf.Reason, &rf.Restocked, &rf.CreatedAt, &itemID, &quantity); err != nil {
+			http.Error(w, "error while getting data", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning refund", "err", err)
+			return
+		}
+		if n := len(refunds); n == 0 || refunds[n-1].ID != rf.ID {
+			rf.Items = []RefundLine{}
+			refunds = append(refunds, rf)
+		}
+		if itemID.Valid {
+			last := &refunds[len(refunds)-1]
+			last.Items = append(last.Items, RefundLine{ItemID: int(itemID.Int64), Quantity: int(quantity.Int64)})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refunds)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPendingRefundIsFinishedNotRepeated(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	db = mockDB
+	fake := newFakeProvider("test-secret")
+	payments = fake
+	intent, err := fake.CreateIntent(context.Background(), money(1000), "order-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fake.confirm(intent.ID, eventPaymentSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	// Refund 1 was paid out, but recording it failed.
+	paidOut, err := fake.Refund(context.Background(), intent.ID, 600, refundKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("from refunds join payments").WithArgs(3, refundPending).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "intent_id", "amount"}).AddRow(1, intent.ID, 600))
+	mock.ExpectBegin()
+	mock.ExpectQuery("from orders join refunds").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "total_price", "refunded_amount"}).AddRow(3, orderPaid, 1000, 0))
+	mock.ExpectQuery("update refunds set status").WithArgs(refundSucceeded, paidOut.ID, 1, refundPending).
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "restocked"}).AddRow(600, false))
+	mock.ExpectExec("update order_items set refunded_quantity").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("update orders set refunded_amount").WithArgs(600, orderPartiallyRefunded, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into outbox").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := finishPendingRefunds(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	// Only 400 is left at the provider: the retry didn't pay out again.
+	if _, err := fake.Refund(context.Background(), intent.ID, 401, refundKey(2)); err == nil {
+		t.Error("refund 1 was paid out twice")
+	}
+}
+
+func TestRefundingUnitsOneByOneAddsUpToTheLine(t *testing.T) {
+	it := OrderItem{ID: 1, Quantity: 3, Price: money(1000), Discount: money(100), Tax: money(290), TaxRate: 1000, taxAdded: true}
+	paid := 3*1000 - 100 + 290
+	remaining, refunded := paid, 0
+	for i := 0; i < it.Quantity; i++ {
+		amount, _, err := refundLines(RefundRequest{Items: []RefundLine{{ItemID: 1, Quantity: 1}}}, []OrderItem{it}, remaining)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if amount > remaining {
+			t.Fatalf("unit %d: refund %d is more than the %d left", i+1, amount, remaining)
+		}
+		remaining -= amount
+		refunded += amount
+		it.RefundedQuantity++
+	}
+	if refunded != paid {
+		t.Errorf("refunded %d, want %d", refunded, paid)
+	}
+}
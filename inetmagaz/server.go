@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 120 * time.Second
+	shutdownTimeout   = 20 * time.Second
+	// transferTimeout replaces readTimeout and writeTimeout for requests
+	// that move whole files, like image uploads.
+	transferTimeout = 10 * time.Minute
+)
+
+// workers tracks background goroutines started with goWorker so shutdown
+// can wait for them after the HTTP server has drained.
+var (
+	workers       sync.WaitGroup
+	workersCtx    context.Context
+	cancelWorkers context.CancelFunc
+)
+
+func init() {
+	workersCtx, cancelWorkers = context.WithCancel(context.Background())
+}
+
+// goWorker runs fn in the background. fn must return once ctx is cancelled.
+func goWorker(fn func(ctx context.Context)) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn(workersCtx)
+	}()
+}
+
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// allowLongTransfer gives the request transferTimeout to send its body and
+// receive the response, instead of the server's ReadTimeout and
+// WriteTimeout.
+func allowLongTransfer(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(transferTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil && err != http.ErrNotSupported {
+		loggerFrom(r.Context()).Warn("extending read deadline", "err", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && err != http.ErrNotSupported {
+		loggerFrom(r.Context()).Warn("extending write deadline", "err", err)
+	}
+}
+
+// runServer serves until SIGINT/SIGTERM, then stops accepting connections,
+// drains in-flight requests and background workers within shutdownTimeout.
+func runServer(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		log.Print("listening on ", srv.Addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		cancelWorkers()
+		workers.Wait()
+		return err
+	case <-ctx.Done():
+	}
+	log.Print("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	cancelWorkers()
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		err = errors.Join(err, errors.New("background workers did not stop before deadline"))
+	}
+	return err
+}
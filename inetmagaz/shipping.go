@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ShippingMethod is a way to deliver an order. Methods priced by the
+// built-in "table" provider carry their Rates; other providers price them
+// on their own.
+type ShippingMethod struct {
+	ID        int            `json:"id"`
+	Name      string         `json:"name"`
+	Provider  string         `json:"provider"`
+	Active    bool           `json:"active"`
+	Rates     []ShippingRate `json:"rates"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// ShippingRate is one rule of a table-priced method: Price plus PerKg for
+// every started kilogram, or nothing once the goods cost FreeAbove. Empty
+// Country and Region match anywhere; weights are in grams and a MaxWeight
+// of 0 has no upper bound.
+type ShippingRate struct {
+	Country   string `json:"country"`
+	Region    string `json:"region"`
+	MinWeight int    `json:"min_weight"`
+	MaxWeight int    `json:"max_weight"`
+	Price     int    `json:"price"`
+	PerKg     int    `json:"per_kg"`
+	FreeAbove int    `json:"free_above"`
+}
+
+type ShippingMethodInput struct {
+	Name     string         `json:"name"`
+	Provider string         `json:"provider"`
+	Rates    []ShippingRate `json:"rates"`
+}
+
+// ShippingQuote is what a method would cost for the current cart.
+type ShippingQuote struct {
+	MethodID int    `json:"method_id"`
+	Name     string `json:"name"`
+	Price    int    `json:"price"`
+}
+
+// Shipment is what a rate provider prices: where the goods go, what they
+// weigh in grams and what they cost after discounts.
+type Shipment struct {
+	To       ShippingAddress `json:"to"`
+	Weight   int             `json:"weight"`
+	Subtotal int             `json:"subtotal"`
+}
+
+// ShippingRateProvider prices shipments. Implementations must be safe for
+// concurrent use.
+type ShippingRateProvider interface {
+	Name() string
+	// Quote prices s with m. ok is false when m doesn't deliver there.
+	Quote(ctx context.Context, m ShippingMethod, s Shipment) (price int, ok bool, err error)
+}
+
+// shippingProviders are the rate providers methods can name, by Name.
+var shippingProviders = map[string]ShippingRateProvider{"table": tableRates{}}
+
+var (
+	errNoShippingMethod    = errors.New("shipping method required")
+	errShippingUnavailable = errors.New("shipping method doesn't deliver to this address")
+)
+
+// setupShippingProviders adds the external calculator at SHIPPING_RATES_URL,
+// if set, as the "http" provider.
+func setupShippingProviders() error {
+	raw := os.Getenv("SHIPPING_RATES_URL")
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("SHIPPING_RATES_URL must be an absolute http(s) URL")
+	}
+	p := httpRates{url: raw, client: &http.Client{Timeout: 5 * time.Second}}
+	shippingProviders[p.Name()] = p
+	return nil
+}
+
+// tableRates prices methods from their rate rules. The most specific rule
+// that matches wins: country and region over country alone over anywhere.
+type tableRates struct{}
+
+func (tableRates) Name() string { return "table" }
+
+func (tableRates) Quote(ctx context.Context, m ShippingMethod, s Shipment) (int, bool, error) {
+	best, bestScore := -1, -1
+	for i, r := range m.Rates {
+		if r.Country != "" && !strings.EqualFold(r.Country, s.To.Country) {
+			continue
+		}
+		if r.Region != "" && !strings.EqualFold(r.Region, s.To.Region) {
+			continue
+		}
+		if s.Weight < r.MinWeight || (r.MaxWeight > 0 && s.Weight >= r.MaxWeight) {
+			continue
+		}
+		score := 0
+		if r.Country != "" {
+			score += 2
+		}
+		if r.Region != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return 0, false, nil
+	}
+	r := m.Rates[best]
+	if r.FreeAbove > 0 && s.Subtotal >= r.FreeAbove {
+		return 0, true, nil
+	}
+	kg := (s.Weight + 999) / 1000
+	return r.Price + r.PerKg*kg, true, nil
+}
+
+// httpRates asks an external calculator. It POSTs the method and Shipment
+// as JSON and expects {"available": bool, "price": int} back.
+type httpRates struct {
+	url    string
+	client *http.Client
+}
+
+func (httpRates) Name() string { return "http" }
+
+func (h httpRates) Quote(ctx context.Context, m ShippingMethod, s Shipment) (int, bool, error) {
+	body, err := json.Marshal(struct {
+		MethodID int    `json:"method_id"`
+		Method   string `json:"method"`
+		Shipment
+	}{m.ID, m.Name, s})
+	if err != nil {
+		return 0, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("rate calculator responded %s", resp.Status)
+	}
+	var out struct {
+		Available bool `json:"available"`
+		Price     int  `json:"price"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, false, err
+	}
+	return out.Price, out.Available, nil
+}
+
+// quoteShipping prices s with m through m's provider. A free shipping
+// coupon makes any method that delivers free.
+func quoteShipping(ctx context.Context, m ShippingMethod, s Shipment, free bool) (int, bool, error) {
+	p, ok := shippingProviders[m.Provider]
+	if !ok {
+		return 0, false, fmt.Errorf("unknown shipping provider %q", m.Provider)
+	}
+	price, ok, err := p.Quote(ctx, m, s)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	if free {
+		price = 0
+	}
+	return price, true, nil
+}
+
+// loadShippingMethods returns methods with their rates, all of them or only
+// the active ones, or just the one with id when id isn't 0.
+func loadShippingMethods(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}, activeOnly bool, id int) ([]ShippingMethod, error) {
+	rows, err := q.QueryContext(ctx, "select id, name, provider, active, created_at from shipping_methods where (active or not $1) and ($2 = 0 or id = $2) order by id", activeOnly, id)
+	if err != nil {
+		return nil, err
+	}
+	methods := []ShippingMethod{}
+	byID := map[int]int{}
+	for rows.Next() {
+		m := ShippingMethod{Rates: []ShippingRate{}}
+		if err := rows.Scan(&m.ID, &m.Name, &m.Provider, &m.Active, &m.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byID[m.ID] = len(methods)
+		methods = append(methods, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(methods) == 0 {
+		return methods, err
+	}
+
+	rows, err = q.QueryContext(ctx, "select method_id, country, region, min_weight, max_weight, price, per_kg, free_above from shipping_rates where method_id in (select id from shipping_methods where (active or not $1) and ($2 = 0 or id = $2)) order by id", activeOnly, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var methodID int
+		var r ShippingRate
+		if err := rows.Scan(&methodID, &r.Country, &r.Region, &r.MinWeight, &r.MaxWeight, &r.Price, &r.PerKg, &r.FreeAbove); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[methodID]; ok {
+			methods[i].Rates = append(methods[i].Rates, r)
+		}
+	}
+	return methods, rows.Err()
+}
+
+// getShippingQuote prices every active method for the current cart, sent
+// to address_id or the default address. Methods that don't deliver there
+// are left out.
+func getShippingQuote(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	addressID := 0
+	if s := r.URL.Query().Get("address_id"); s != "" {
+		if addressID, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "invalid address_id", http.StatusBadRequest)
+			return
+		}
+	}
+	addr, err := shippingAddressFor(r.Context(), db, userID, addressID)
+	if err == errNoAddress {
+		http.Error(w, "shipping address required", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading shipping address", "err", err)
+		return
+	}
+	sum, err := loadCartSummary(r.Context(), r.Context().Value(usernameKey))
+	if err != nil {
+		http.Error(w, "error while getting cart", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading cart summary", "err", err)
+		return
+	}
+	methods, err := loadShippingMethods(r.Context(), db, true, 0)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("loading shipping methods", "err", err)
+		return
+	}
+	s := Shipment{To: addr, Weight: sum.Weight, Subtotal: sum.GrandTotal.Amount}
+	quotes := []ShippingQuote{}
+	for _, m := range methods {
+		price, ok, err := quoteShipping(r.Context(), m, s, sum.FreeShipping)
+		if err != nil {
+			loggerFrom(r.Context()).Warn("quoting shipping", "method_id", m.ID, "err", err)
+			continue
+		}
+		if ok {
+			quotes = append(quotes, ShippingQuote{MethodID: m.ID, Name: m.Name, Price: price})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quotes)
+}
+
+func (in *ShippingMethodInput) validate() error {
+	if strings.TrimSpace(in.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if in.Provider == "" {
+		in.Provider = "table"
+	}
+	if _, ok := shippingProviders[in.Provider]; !ok {
+		return fmt.Errorf("unknown provider %q", in.Provider)
+	}
+	if in.Provider == "table" && len(in.Rates) == 0 {
+		return fmt.Errorf("table methods need at least one rate")
+	}
+	for i, r := range in.Rates {
+		if r.MinWeight < 0 || r.Price < 0 || r.PerKg < 0 || r.FreeAbove < 0 {
+			return fmt.Errorf("rate %d: values can't be negative", i)
+		}
+		if r.MaxWeight != 0 && r.MaxWeight <= r.MinWeight {
+			return fmt.Errorf("rate %d: max_weight must be above min_weight", i)
+		}
+	}
+	return nil
+}
+
+func getShippingMethods(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage shipping", http.StatusForbidden)
+		return
+	}
+	methods, err := loadShippingMethods(r.Context(), db, false, 0)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing shipping methods", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(methods)
+}
+
+// saveShippingMethod creates the method when id is 0 and otherwise replaces
+// its name, provider and rates.
+func saveShippingMethod(ctx context.Context, id int, in ShippingMethodInput) (ShippingMethod, error) {
+	m := ShippingMethod{ID: id, Name: in.Name, Provider: in.Provider, Active: true, Rates: in.Rates}
+	if m.Rates == nil {
+		m.Rates = []ShippingRate{}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+	if id == 0 {
+		err = tx.QueryRowContext(ctx, "insert into shipping_methods (name, provider) values ($1,$2) returning id, created_at", m.Name, m.Provider).Scan(&m.ID, &m.CreatedAt)
+	} else {
+		err = tx.QueryRowContext(ctx, "update shipping_methods set name = $1, provider = $2 where id = $3 returning active, created_at", m.Name, m.Provider, id).Scan(&m.Active, &m.CreatedAt)
+	}
+	if err != nil {
+		return m, err
+	}
+	if _, err := tx.ExecContext(ctx, "delete from shipping_rates where method_id = $1", m.ID); err != nil {
+		return m, err
+	}
+	for _, r := range m.Rates {
+		_, err := tx.ExecContext(ctx, "insert into shipping_rates (method_id, country, region, min_weight, max_weight, price, per_kg, free_above) values ($1,$2,$3,$4,$5,$6,$7,$8)",
+			m.ID, strings.ToUpper(r.Country), r.Region, r.MinWeight, r.MaxWeight, r.Price, r.PerKg, r.FreeAbove)
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, tx.Commit()
+}
+
+func postShippingMethod(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage shipping", http.StatusForbidden)
+		return
+	}
+	var in ShippingMethodInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := saveShippingMethod(r.Context(), 0, in)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("inserting shipping method", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+func putShippingMethod(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage shipping", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	var in ShippingMethodInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := saveShippingMethod(r.Context(), id, in)
+	if err == sql.ErrNoRows {
+		http.Error(w, "shipping method not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("updating shipping method", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// deleteShippingMethod deactivates a method. It stays on record because
+// orders refer to it.
+func deleteShippingMethod(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage shipping", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "update shipping_methods set active = false where id = $1", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deactivating shipping method", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "shipping method not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deactivated successfully!",
+	})
+}
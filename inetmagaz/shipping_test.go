@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTableRatesQuote(t *testing.T) {
+	m := ShippingMethod{Name: "Courier", Provider: "table", Rates: []ShippingRate{
+		{Price: 900},
+		{Country: "KZ", Price: 500, PerKg: 100, FreeAbove: 20000},
+		{Country: "KZ", Region: "Almaty", MaxWeight: 5000, Price: 300},
+		{Country: "RU", MinWeight: 1000, Price: 700},
+	}}
+	cases := []struct {
+		name    string
+		country string
+		region  string
+		weight  int
+		total   int
+		price   int
+		ok      bool
+	}{
+		{name: "anywhere", country: "DE", weight: 500, total: 1000, price: 900, ok: true},
+		{name: "country with started kilograms", country: "kz", region: "Astana", weight: 2500, total: 1000, price: 800, ok: true},
+		{name: "region beats country", country: "KZ", region: "almaty", weight: 2500, total: 1000, price: 300, ok: true},
+		{name: "region rule outgrown", country: "KZ", region: "Almaty", weight: 5000, total: 1000, price: 1000, ok: true},
+		{name: "free above threshold", country: "KZ", region: "Astana", weight: 2500, total: 20000, price: 0, ok: true},
+		{name: "too light for the country rule", country: "RU", weight: 500, total: 1000, price: 900, ok: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Shipment{To: ShippingAddress{Country: tc.country, Region: tc.region}, Weight: tc.weight, Subtotal: tc.total}
+			price, ok, err := tableRates{}.Quote(context.Background(), m, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if price != tc.price || ok != tc.ok {
+				t.Errorf("got %d, %v; want %d, %v", price, ok, tc.price, tc.ok)
+			}
+		})
+	}
+
+	m.Rates = m.Rates[1:]
+	if _, ok, _ := (tableRates{}).Quote(context.Background(), m, Shipment{To: ShippingAddress{Country: "DE"}}); ok {
+		t.Error("quoted a country no rule covers")
+	}
+}
+
+func TestQuoteShippingFreeShippingCoupon(t *testing.T) {
+	m := ShippingMethod{Provider: "table", Rates: []ShippingRate{{Country: "KZ", Price: 500}}}
+	if price, ok, err := quoteShipping(context.Background(), m, Shipment{To: ShippingAddress{Country: "KZ"}}, true); err != nil || !ok || price != 0 {
+		t.Errorf("got %d, %v, %v; want free", price, ok, err)
+	}
+	if _, ok, err := quoteShipping(context.Background(), m, Shipment{To: ShippingAddress{Country: "DE"}}, true); err != nil || ok {
+		t.Errorf("got %v, %v; a coupon shouldn't make an undeliverable method available", ok, err)
+	}
+	m.Provider = "pigeon"
+	if _, _, err := quoteShipping(context.Background(), m, Shipment{}, false); err == nil {
+		t.Error("quoted with an unknown provider")
+	}
+}
+
+func TestHTTPRatesQuote(t *testing.T) {
+	var got struct {
+		MethodID int    `json:"method_id"`
+		Method   string `json:"method"`
+		Shipment
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got.To.Country != "KZ" {
+			w.Write([]byte(`{"available":false}`))
+			return
+		}
+		w.Write([]byte(`{"available":true,"price":1250}`))
+	}))
+	defer srv.Close()
+
+	p := httpRates{url: srv.URL, client: srv.Client()}
+	m := ShippingMethod{ID: 2, Name: "Express", Provider: "http"}
+	price, ok, err := p.Quote(context.Background(), m, Shipment{To: ShippingAddress{Country: "KZ", City: "Almaty"}, Weight: 1200, Subtotal: 3000})
+	if err != nil || !ok || price != 1250 {
+		t.Fatalf("got %d, %v, %v", price, ok, err)
+	}
+	if got.MethodID != 2 || got.Method != "Express" || got.Weight != 1200 || got.Subtotal != 3000 || got.To.City != "Almaty" {
+		t.Errorf("calculator got %+v", got)
+	}
+	if _, ok, err := p.Quote(context.Background(), m, Shipment{To: ShippingAddress{Country: "DE"}}); err != nil || ok {
+		t.Errorf("got %v, %v; want unavailable", ok, err)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	if _, _, err := (httpRates{url: down.URL, client: down.Client()}).Quote(context.Background(), m, Shipment{}); err == nil {
+		t.Error("no error from a failing calculator")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+const defaultTaxClass = "standard"
+
+// taxInclusive is the pricing mode: whether catalog prices already include
+// tax (TAX_MODE=inclusive) or tax is added on top at checkout (the default).
+var taxInclusive bool
+
+// TaxRate is the rate a tax class pays in a place, in basis points. Empty
+// Country and Region match anywhere.
+type TaxRate struct {
+	ID        int       `json:"id"`
+	TaxClass  string    `json:"tax_class"`
+	Country   string    `json:"country"`
+	Region    string    `json:"region"`
+	Name      string    `json:"name"`
+	Rate      int       `json:"rate"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TaxRateInput struct {
+	TaxClass string `json:"tax_class"`
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	Name     string `json:"name"`
+	Rate     int    `json:"rate"`
+}
+
+// TaxAmount is one line of an order's tax breakdown: what a named rate
+// charged and on how much.
+type TaxAmount struct {
+	Name    string `json:"name"`
+	Rate    int    `json:"rate"`
+	Taxable int    `json:"taxable"`
+	Amount  int    `json:"amount"`
+}
+
+// TaxBreakdown is stored on orders as jsonb.
+type TaxBreakdown []TaxAmount
+
+func (b TaxBreakdown) Value() (driver.Value, error) {
+	if b == nil {
+		b = TaxBreakdown{}
+	}
+	return json.Marshal(b)
+}
+
+func (b *TaxBreakdown) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, b)
+	case string:
+		return json.Unmarshal([]byte(v), b)
+	}
+	return fmt.Errorf("cannot scan %T into TaxBreakdown", src)
+}
+
+// setupTax reads the pricing mode from TAX_MODE.
+func setupTax() error {
+	switch mode := os.Getenv("TAX_MODE"); mode {
+	case "", "exclusive":
+		taxInclusive = false
+	case "inclusive":
+		taxInclusive = true
+	default:
+		return fmt.Errorf("TAX_MODE must be inclusive or exclusive, not %q", mode)
+	}
+	return nil
+}
+
+// taxLine is an order line as tax sees it: its class and what it costs
+// after discounts.
+type taxLine struct {
+	class  string
+	amount int
+}
+
+type lineTax struct {
+	Tax  int
+	Rate int
+}
+
+type taxResult struct {
+	Tax       int
+	Lines     []lineTax
+	Breakdown TaxBreakdown
+}
+
+// taxRateFor picks the most specific rate for class at to: country and
+// region over country alone over anywhere. ok is false when none matches.
+func taxRateFor(rates []TaxRate, class string, to ShippingAddress) (TaxRate, bool) {
+	best, bestScore := -1, -1
+	for i, r := range rates {
+		if r.TaxClass != class {
+			continue
+		}
+		if r.Country != "" && !strings.EqualFold(r.Country, to.Country) {
+			continue
+		}
+		if r.Region != "" && !strings.EqualFold(r.Region, to.Region) {
+			continue
+		}
+		score := 0
+		if r.Country != "" {
+			score += 2
+		}
+		if r.Region != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return TaxRate{}, false
+	}
+	return rates[best], true
+}
+
+// computeTax works out each line's tax, rounding half up per line. With
+// inclusive prices the tax is the part of the amount above its net value;
+// otherwise it's charged on top of the amount. The breakdown groups lines
+// by rate name and percentage, in the order they first appear.
+func computeTax(rates []TaxRate, to ShippingAddress, lines []taxLine, inclusive bool) taxResult {
+	res := taxResult{Lines: make([]lineTax, len(lines)), Breakdown: TaxBreakdown{}}
+	groups := map[string]int{}
+	for i, l := range lines {
+		r, ok := taxRateFor(rates, l.class, to)
+		if !ok || r.Rate == 0 || l.amount <= 0 {
+			continue
+		}
+		var tax, net int
+		if inclusive {
+			net = divRound(l.amount*10000, 10000+r.Rate)
+			tax = l.amount - net
+		} else {
+			net = l.amount
+			tax = divRound(l.amount*r.Rate, 10000)
+		}
+		res.Lines[i] = lineTax{Tax: tax, Rate: r.Rate}
+		res.Tax += tax
+
+		key := r.Name + "\x00" + strconv.Itoa(r.Rate)
+		g, ok := groups[key]
+		if !ok {
+			g = len(res.Breakdown)
+			groups[key] = g
+			res.Breakdown = append(res.Breakdown, TaxAmount{Name: r.Name, Rate: r.Rate})
+		}
+		res.Breakdown[g].Taxable += net
+		res.Breakdown[g].Amount += tax
+	}
+	return res
+}
+
+func loadTaxRates(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}) ([]TaxRate, error) {
+	rows, err := q.QueryContext(ctx, "select id, tax_class, country, region, name, rate, created_at from tax_rates order by tax_class, country, region")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := []TaxRate{}
+	for rows.Next() {
+		var r TaxRate
+		if err := rows.Scan(&r.ID, &r.TaxClass, &r.Country, &r.Region, &r.Name, &r.Rate, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+func (in *TaxRateInput) validate() error {
+	in.TaxClass = strings.TrimSpace(in.TaxClass)
+	if in.TaxClass == "" {
+		in.TaxClass = defaultTaxClass
+	}
+	in.Country = strings.ToUpper(strings.TrimSpace(in.Country))
+	if strings.TrimSpace(in.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if in.Region != "" && in.Country == "" {
+		return fmt.Errorf("a region needs a country")
+	}
+	if in.Rate < 0 || in.Rate > 10000 {
+		return fmt.Errorf("rate must be between 0 and 10000 basis points")
+	}
+	return nil
+}
+
+func getTaxRates(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage taxes", http.StatusForbidden)
+		return
+	}
+	rates, err := loadTaxRates(r.Context(), db)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing tax rates", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func postTaxRate(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage taxes", http.StatusForbidden)
+		return
+	}
+	var in TaxRateInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := TaxRate{TaxClass: in.TaxClass, Country: in.Country, Region: in.Region, Name: in.Name, Rate: in.Rate}
+	err := db.QueryRowContext(r.Context(), "insert into tax_rates (tax_class, country, region, name, rate) values ($1,$2,$3,$4,$5) returning id, created_at",
+		t.TaxClass, t.Country, t.Region, t.Name, t.Rate).Scan(&t.ID, &t.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "a rate for this class and place already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("inserting tax rate", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// deleteTaxRate removes a rate. Orders keep the tax they were charged.
+func deleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage taxes", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "delete from tax_rates where id = $1", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting tax rate", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "tax rate not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully!",
+	})
+}
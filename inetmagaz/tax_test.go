@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestComputeTax(t *testing.T) {
+	rates := []TaxRate{
+		{TaxClass: "standard", Name: "VAT", Rate: 2000},
+		{TaxClass: "standard", Country: "KZ", Name: "VAT", Rate: 1200},
+		{TaxClass: "standard", Country: "KZ", Region: "Almaty", Name: "VAT", Rate: 1200},
+		{TaxClass: "reduced", Country: "KZ", Name: "VAT reduced", Rate: 500},
+		{TaxClass: "zero", Name: "VAT zero", Rate: 0},
+	}
+	lines := []taxLine{
+		{class: "standard", amount: 1000},
+		{class: "reduced", amount: 333},
+		{class: "standard", amount: 1499},
+		{class: "zero", amount: 700},
+		{class: "books", amount: 900},
+	}
+	cases := []struct {
+		name      string
+		to        ShippingAddress
+		inclusive bool
+		tax       int
+		lines     []lineTax
+		breakdown string
+	}{
+		{name: "exclusive in a country", to: ShippingAddress{Country: "kz"}, tax: 317,
+			lines:     []lineTax{{120, 1200}, {17, 500}, {180, 1200}, {}, {}},
+			breakdown: "[{VAT 1200 2499 300} {VAT reduced 500 333 17}]"},
+		{name: "exclusive elsewhere", to: ShippingAddress{Country: "DE"}, tax: 500,
+			lines:     []lineTax{{200, 2000}, {}, {300, 2000}, {}, {}},
+			breakdown: "[{VAT 2000 2499 500}]"},
+		{name: "inclusive", to: ShippingAddress{Country: "KZ", Region: "Almaty"}, inclusive: true, tax: 284,
+			lines:     []lineTax{{107, 1200}, {16, 500}, {161, 1200}, {}, {}},
+			breakdown: "[{VAT 1200 2231 268} {VAT reduced 500 317 16}]"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := computeTax(rates, tc.to, lines, tc.inclusive)
+			if res.Tax != tc.tax || fmt.Sprint(res.Lines) != fmt.Sprint(tc.lines) || fmt.Sprint(res.Breakdown) != tc.breakdown {
+				t.Errorf("got %+v, want tax %d, lines %v, breakdown %s", res, tc.tax, tc.lines, tc.breakdown)
+			}
+		})
+	}
+}
+
+func TestRefundLinesIncludeAddedTax(t *testing.T) {
+	items := []OrderItem{
+		{ID: 1, Quantity: 2, Price: money(500), Discount: money(100), Tax: money(108), TaxRate: 1200, taxAdded: true},
+		{ID: 2, Quantity: 1, Price: money(1120), Tax: money(120), TaxRate: 1200},
+	}
+	amount, _, err := refundLines(RefundRequest{Items: []RefundLine{{ItemID: 1, Quantity: 1}, {ItemID: 2, Quantity: 1}}}, items, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 500 - 50 discount + 54 tax on top, and 1120 with tax already in it.
+	if amount != 1624 {
+		t.Errorf("amount = %d, want 1624", amount)
+	}
+}
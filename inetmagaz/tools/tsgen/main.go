@@ -0,0 +1,311 @@
+// Command tsgen generates TypeScript types and a typed fetch client for the
+// frontend from openapi.json. Run it through go generate in inetmagaz.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	AllOf                []*schema          `json:"allOf"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Enum                 []any              `json:"enum"`
+	Nullable             bool               `json:"nullable"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Description          string             `json:"description"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Deprecated  bool                  `json:"deprecated"`
+	Security    []map[string][]string `json:"security"`
+	Parameters  []parameter           `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]mediaType `json:"content"`
+	} `json:"responses"`
+}
+
+type server struct {
+	URL string `json:"url"`
+}
+
+type pathItem struct {
+	Servers []server   `json:"servers"`
+	Get     *operation `json:"get"`
+	Post    *operation `json:"post"`
+	Put     *operation `json:"put"`
+	Patch   *operation `json:"patch"`
+	Delete  *operation `json:"delete"`
+}
+
+type methodOp struct {
+	method string
+	op     *operation
+}
+
+func (p *pathItem) operations() []methodOp {
+	return []methodOp{{"get", p.Get}, {"post", p.Post}, {"put", p.Put}, {"patch", p.Patch}, {"delete", p.Delete}}
+}
+
+type document struct {
+	Servers    []server             `json:"servers"`
+	Paths      map[string]*pathItem `json:"paths"`
+	Components struct {
+		Schemas    map[string]*schema   `json:"schemas"`
+		Parameters map[string]parameter `json:"parameters"`
+	} `json:"components"`
+}
+
+func main() {
+	in := flag.String("in", "openapi.json", "OpenAPI document")
+	out := flag.String("out", "", "TypeScript file to write")
+	flag.Parse()
+
+	raw, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		log.Fatal(err)
+	}
+	src, err := generate(&doc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func generate(doc *document) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by inetmagaz/tools/tsgen from openapi.json. DO NOT EDIT.\n\n")
+	b.WriteString("import { fetchJSON } from \"./api\"\n")
+
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for n := range doc.Components.Schemas {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(&b, "\nexport type %s = %s\n", n, tsType(doc.Components.Schemas[n], ""))
+	}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	b.WriteString("\nexport const client = {\n")
+	for _, p := range paths {
+		item := doc.Paths[p]
+		servers := doc.Servers
+		if len(item.Servers) > 0 {
+			servers = item.Servers
+		}
+		prefix := ""
+		if len(servers) > 0 && strings.HasPrefix(servers[0].URL, "/") {
+			prefix = strings.TrimSuffix(servers[0].URL, "/")
+		}
+		// The client covers the versioned API only; probes, metrics and
+		// docs served from the root are for operators, not the frontend.
+		if !strings.HasPrefix(prefix, "/api/") {
+			continue
+		}
+		for _, o := range item.operations() {
+			// Server-Sent Events streams are read with EventSource, not
+			// fetchJSON.
+			if o.op == nil || o.op.OperationID == "" || isStream(o.op) {
+				continue
+			}
+			line, err := clientMethod(doc, prefix+p, o.method, o.op)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(o.method), p, err)
+			}
+			b.WriteString(line)
+		}
+	}
+	b.WriteString("}\n")
+	return b.Bytes(), nil
+}
+
+func isStream(op *operation) bool {
+	for c, r := range op.Responses {
+		if _, ok := r.Content["text/event-stream"]; ok && strings.HasPrefix(c, "2") {
+			return true
+		}
+	}
+	return false
+}
+
+func clientMethod(doc *document, path, method string, op *operation) (string, error) {
+	var args []string
+	url := path
+	for _, p := range op.Parameters {
+		if p.Ref != "" {
+			p = doc.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+		}
+		if p.In != "path" {
+			continue
+		}
+		args = append(args, fmt.Sprintf("%s: %s", p.Name, tsType(p.Schema, "")))
+		url = strings.ReplaceAll(url, "{"+p.Name+"}", "${"+p.Name+"}")
+	}
+	opts := []string{fmt.Sprintf("method: %q", strings.ToUpper(method))}
+	if len(op.Security) > 0 {
+		opts = append(opts, "auth: true")
+	}
+	if op.RequestBody != nil {
+		if mt, ok := op.RequestBody.Content["application/json"]; ok {
+			args = append(args, "body: "+tsType(mt.Schema, ""))
+			opts = append(opts, "body")
+		} else if _, ok := op.RequestBody.Content["multipart/form-data"]; ok {
+			// fetchJSON sends a FormData body as it is.
+			args = append(args, "body: FormData")
+			opts = append(opts, "body")
+		}
+	}
+
+	result := "unknown"
+	codes := make([]string, 0, len(op.Responses))
+	for c := range op.Responses {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		if !strings.HasPrefix(c, "2") {
+			continue
+		}
+		if mt, ok := op.Responses[c].Content["application/json"]; ok {
+			result = tsType(mt.Schema, "")
+		} else if len(op.Responses[c].Content) > 0 {
+			result = "string"
+		}
+		break
+	}
+
+	quoted := fmt.Sprintf("%q", url)
+	if strings.Contains(url, "${") {
+		quoted = "`" + url + "`"
+	}
+	var comment string
+	if op.Summary != "" {
+		comment = "  /** " + op.Summary
+		if op.Deprecated {
+			comment += " @deprecated"
+		}
+		comment += " */\n"
+	}
+	return fmt.Sprintf("%s  %s: (%s) =>\n    fetchJSON<%s>(%s, { %s }),\n",
+		comment, op.OperationID, strings.Join(args, ", "), result, quoted, strings.Join(opts, ", ")), nil
+}
+
+// tsType renders s as a TypeScript type expression. indent is the current
+// indentation for nested object literals.
+func tsType(s *schema, indent string) string {
+	if s == nil {
+		return "unknown"
+	}
+	t := baseType(s, indent)
+	if s.Nullable {
+		t += " | null"
+	}
+	return t
+}
+
+func baseType(s *schema, indent string) string {
+	if s.Ref != "" {
+		return s.Ref[strings.LastIndex(s.Ref, "/")+1:]
+	}
+	if len(s.AllOf) > 0 {
+		parts := make([]string, len(s.AllOf))
+		for i, sub := range s.AllOf {
+			parts[i] = tsType(sub, indent)
+		}
+		return strings.Join(parts, " & ")
+	}
+	if len(s.Enum) > 0 {
+		parts := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			lit, _ := json.Marshal(v)
+			parts[i] = string(lit)
+		}
+		return strings.Join(parts, " | ")
+	}
+	switch s.Type {
+	case "integer", "number":
+		return "number"
+	case "string":
+		return "string"
+	case "boolean":
+		return "boolean"
+	case "array":
+		item := tsType(s.Items, indent)
+		if strings.Contains(item, " | ") {
+			item = "(" + item + ")"
+		}
+		return item + "[]"
+	case "object":
+		if len(s.Properties) == 0 {
+			if s.AdditionalProperties != nil {
+				return "Record<string, " + tsType(s.AdditionalProperties, indent) + ">"
+			}
+			return "Record<string, unknown>"
+		}
+		required := map[string]bool{}
+		for _, r := range s.Required {
+			required[r] = true
+		}
+		props := make([]string, 0, len(s.Properties))
+		for p := range s.Properties {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+		var b strings.Builder
+		b.WriteString("{\n")
+		for _, p := range props {
+			opt := "?"
+			if required[p] {
+				opt = ""
+			}
+			fmt.Fprintf(&b, "%s  %s%s: %s\n", indent, p, opt, tsType(s.Properties[p], indent+"  "))
+		}
+		b.WriteString(indent + "}")
+		return b.String()
+	}
+	return "unknown"
+}
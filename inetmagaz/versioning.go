@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const apiV1Prefix = "/api/v1"
+
+var (
+	// legacyDeprecated is when the unversioned root paths were deprecated in
+	// favour of /api/v1, legacySunset when they will be removed.
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// v1Routes registers version 1 of the API. The response shapes behind these
+// routes are frozen: a breaking change goes into a v2Routes mounted at
+// /api/v2 next to this one, reusing handlers where nothing changed.
+func v1Routes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(AuthMiddleware)
+		r.Use(Idempotency)
+		r.Get("/profile", getProfile)
+		r.Get("/profile/notifications", getNotificationPreferences)
+		r.Put("/profile/notifications", putNotificationPreferences)
+		r.Post("/products", postProducts)
+		r.Get("/products/export", getProductExport)
+		r.Put("/products/{id}", putProduct)
+		r.Delete("/products/{id}", deleteProduct)
+		r.Get("/products/archived", getArchivedProducts)
+		r.Post("/products/{id}/restore", restoreProduct)
+		r.Get("/products/{id}/prices", getProductPrices)
+		r.Put("/products/{id}/prices/{currency}", putProductPrice)
+		r.Delete("/products/{id}/prices/{currency}", deleteProductPrice)
+		r.Put("/products/{id}/images/order", putProductImageOrder)
+		r.Delete("/products/{id}/images/{imageID}", deleteProductImage)
+		r.Route("/cart", func(r chi.Router) {
+			r.Get("/", getCart)
+			r.Get("/summary", getCartSummary)
+			r.Post("/add", addCart)
+			r.Post("/remove", removefromCart)
+			r.Delete("/clear", clearCart)
+			r.Patch("/{id}", updateCartLine)
+			r.Post("/coupon", postCartCoupon)
+			r.Delete("/coupon", deleteCartCoupon)
+		})
+		// Settling payments by hand only exists on the fake gateway.
+		if _, ok := payments.(*fakeProvider); ok {
+			r.Post("/payments/fake/{intent}/confirm", confirmFakePayment)
+		}
+		r.Route("/addresses", func(r chi.Router) {
+			r.Get("/", getAddresses)
+			r.Post("/", postAddress)
+			r.Put("/{id}", putAddress)
+			r.Delete("/{id}", deleteAddress)
+			r.Post("/{id}/default", setDefaultAddress)
+		})
+		r.Route("/coupons", func(r chi.Router) {
+			r.Get("/", getCoupons)
+			r.Post("/", postCoupon)
+			r.Delete("/{id}", deleteCoupon)
+		})
+		r.Route("/shipping", func(r chi.Router) {
+			r.Get("/quote", getShippingQuote)
+			r.Get("/methods", getShippingMethods)
+			r.Post("/methods", postShippingMethod)
+			r.Put("/methods/{id}", putShippingMethod)
+			r.Delete("/methods/{id}", deleteShippingMethod)
+		})
+		r.Route("/tax/rates", func(r chi.Router) {
+			r.Get("/", getTaxRates)
+			r.Post("/", postTaxRate)
+			r.Delete("/{id}", deleteTaxRate)
+		})
+		r.Put("/exchange-rates/{currency}", putExchangeRate)
+		r.Delete("/exchange-rates/{currency}", deleteExchangeRate)
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Get("/", getWebhooks)
+			r.Post("/", postWebhook)
+			r.Delete("/{id}", deleteWebhook)
+			r.Get("/{id}/deliveries", getWebhookDeliveries)
+		})
+		r.Route("/orders", func(r chi.Router) {
+			r.Post("/", postOrders)
+			r.Get("/", getOrders)
+			r.Post("/update", updateStatus)
+			r.Get("/{id}", getOrderbyID)
+			r.Get("/{id}/payments", getOrderPayments)
+			r.Get("/{id}/items", getOrderItems)
+			r.Get("/{id}/refunds", getOrderRefunds)
+			r.Post("/{id}/refunds", postRefund)
+			r.Get("/getall", getAllOrders)
+			r.Get("/events", getOrderEvents)
+			r.Get("/events/all", getAllOrderEvents)
+		})
+	})
+
+	// Uploads and imports skip Idempotency, which refuses bodies over 1 MiB
+	// so it can fingerprint them.
+	r.Group(func(r chi.Router) {
+		r.Use(AuthMiddleware)
+		r.Post("/products/{id}/images", postProductImages)
+		r.Post("/products/import", postProductImport)
+	})
+
+	r.Get("/products", getProducts)
+	r.Get("/products/{id}", getProductByID)
+	r.Get("/products/{id}/images", getProductImages)
+	r.Get("/exchange-rates", getExchangeRates)
+	r.Post("/login", Login)
+	r.Post("/registration", Registration)
+	r.Post("/password/forgot", forgotPassword)
+	r.Post("/password/reset", resetPassword)
+	r.Post("/payments/webhook", paymentWebhook)
+}
+
+// Deprecated marks legacy alias routes: it announces the deprecation and
+// sunset dates (RFC 9745, RFC 8594) and links to the same path under
+// successor.
+func Deprecated(successor string, sunset time.Time) func(http.Handler) http.Handler {
+	deprecation := "@" + strconv.FormatInt(legacyDeprecated.Unix(), 10)
+	sunsetHeader := sunset.UTC().Format(http.TimeFormat)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			w.Header().Set("Sunset", sunsetHeader)
+			w.Header().Add("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successor, r.URL.Path))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Events sent to webhook subscribers.
+const (
+	eventOrderCreated       = "order.created"
+	eventOrderStatusChanged = "order.status_changed"
+	eventProductStockLow    = "product.stock_low"
+)
+
+var webhookEvents = []string{eventOrderCreated, eventOrderStatusChanged, eventProductStockLow}
+
+// lowStockThreshold is the stock level at or below which product.stock_low
+// fires.
+const lowStockThreshold = 5
+
+const (
+	webhookSignatureHeader = "Webhook-Signature"
+	webhookIDHeader        = "Webhook-Id"
+	webhookEventHeader     = "Webhook-Event"
+
+	// A failed delivery is retried after webhookBackoff, doubling each time,
+	// until webhookMaxAttempts have been made.
+	webhookMaxAttempts = 8
+	webhookBackoff     = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+// Delivery statuses as stored in webhook_deliveries.status.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+type WebhookSubscription struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secret is only returned when the subscription is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookSubscriptionInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	SubscriptionID int             `json:"subscription_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+// WebhookEvent is the body POSTed to subscribers.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// OrderEventData is the data of order events. TotalPrice is in minor units
+// of Currency; both are only set on order.created.
+type OrderEventData struct {
+	OrderID    int    `json:"order_id"`
+	Status     string `json:"status"`
+	TotalPrice int    `json:"total_price,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+}
+
+type StockEventData struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	Stock     int    `json:"stock"`
+}
+
+// webhookSink queues a delivery of each event to every active subscriber
+// of its type; runWebhookDispatcher sends them.
+type webhookSink struct{}
+
+func (webhookSink) Name() string { return "webhooks" }
+
+func (webhookSink) Publish(ctx context.Context, ev OutboxEvent) error {
+	_, err := db.ExecContext(ctx, "insert into webhook_deliveries (subscription_id, event_id, event_type, payload) select id, $1, $2, $3 from webhook_subscriptions where active and $2 = any(events) on conflict (event_id, subscription_id) do nothing", ev.EventID, ev.Type, ev.Payload)
+	return err
+}
+
+// signWebhook returns the Webhook-Signature value for payload sent at ts:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<payload>">".
+func signWebhook(secret string, ts time.Time, payload []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(payload)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs one event to a subscriber and returns the response
+// status. Any non-2xx status is an error.
+func deliverWebhook(ctx context.Context, client *http.Client, target, secret, eventID, eventType string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, eventID)
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, time.Now(), payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverDueWebhooks sends up to limit deliveries whose next attempt is due
+// and records the outcome. It returns how many it tried.
+func deliverDueWebhooks(ctx context.Context, client *http.Client, limit int) (int, error) {
+	// Claiming pushes next_attempt_at out so other instances skip these
+	// rows while they are in flight; if this one dies they come back.
+	rows, err := db.QueryContext(ctx, "update webhook_deliveries d set next_attempt_at = now() + interval '1 minute' from webhook_subscriptions s where s.id = d.subscription_id and d.id in (select id from webhook_deliveries where status = $1 and next_attempt_at <= now() order by id limit $2 for update skip locked) returning d.id, d.event_id, d.event_type, d.payload, d.attempts, s.url, s.secret", deliveryPending, limit)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		id, attempts                       int
+		eventID, eventType, target, secret string
+		payload                            []byte
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.eventID, &d.eventType, &d.payload, &d.attempts, &d.target, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		code, derr := deliverWebhook(ctx, client, d.target, d.secret, d.eventID, d.eventType, d.payload)
+		attempts := d.attempts + 1
+		var statusCode *int
+		if code != 0 {
+			statusCode = &code
+		}
+		if derr == nil {
+			_, err = db.ExecContext(ctx, "update webhook_deliveries set status = $1, attempts = $2, last_status_code = $3, last_error = '', delivered_at = now() where id = $4", deliverySucceeded, attempts, statusCode, d.id)
+		} else if attempts >= webhookMaxAttempts {
+			_, err = db.ExecContext(ctx, "update webhook_deliveries set status = $1, attempts = $2, last_status_code = $3, last_error = $4 where id = $5", deliveryFailed, attempts, statusCode, derr.Error(), d.id)
+		} else {
+			next := time.Now().Add(webhookBackoff << (attempts - 1))
+			_, err = db.ExecContext(ctx, "update webhook_deliveries set attempts = $1, last_status_code = $2, last_error = $3, next_attempt_at = $4 where id = $5", attempts, statusCode, derr.Error(), next, d.id)
+		}
+		if err != nil {
+			return len(batch), err
+		}
+		if derr != nil {
+			loggerFrom(ctx).Warn("webhook delivery failed", "delivery_id", d.id, "event", d.eventType, "attempt", attempts, "err", derr)
+		}
+	}
+	return len(batch), nil
+}
+
+// runWebhookDispatcher delivers queued webhooks until ctx is cancelled.
+func runWebhookDispatcher(ctx context.Context) {
+	client := &http.Client{Timeout: webhookTimeout}
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for {
+			n, err := deliverDueWebhooks(ctx, client, 20)
+			if err != nil {
+				if ctx.Err() == nil {
+					loggerFrom(ctx).Error("delivering webhooks", "err", err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
+
+func (in WebhookSubscriptionInput) validate() error {
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	if len(in.Events) == 0 {
+		return fmt.Errorf("events is required")
+	}
+	for _, e := range in.Events {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	return nil
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage webhooks", http.StatusForbidden)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select id, url, events, active, created_at from webhook_subscriptions order by id")
+	if err != nil {
+		http.Error(w, "error while getting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing webhooks", "err", err)
+		return
+	}
+	defer rows.Close()
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		if err := rows.Scan(&s.ID, &s.URL, pq.Array(&s.Events), &s.Active, &s.CreatedAt); err != nil {
+			http.Error(w, "error while getting data", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning webhook", "err", err)
+			return
+		}
+		subs = append(subs, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+func postWebhook(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage webhooks", http.StatusForbidden)
+		return
+	}
+	var in WebhookSubscriptionInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if in.Secret == "" {
+		in.Secret = randomID("whsec_")
+	}
+	s := WebhookSubscription{URL: in.URL, Events: in.Events, Active: true, Secret: in.Secret}
+	err := db.QueryRowContext(r.Context(), "insert into webhook_subscriptions (url, secret, events) values ($1,$2,$3) returning id, created_at", in.URL, in.Secret, pq.Array(in.Events)).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("inserting webhook", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage webhooks", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "delete from webhook_subscriptions where id = $1", id)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("deleting webhook", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Deleted successfully!",
+	})
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if ok, err := isAdmin(r); err != nil || !ok {
+		http.Error(w, "only admin can manage webhooks", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid param", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "select id, subscription_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, delivered_at from webhook_deliveries where subscription_id = $1 order by id desc limit 100", id)
+	if err != nil {
+		http.Error(w, "error while getting data", http.StatusInternalServerError)
+		loggerFrom(r.Context()).Error("listing webhook deliveries", "err", err)
+		return
+	}
+	defer rows.Close()
+	ds := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			http.Error(w, "error while getting data", http.StatusInternalServerError)
+			loggerFrom(r.Context()).Error("scanning webhook delivery", "err", err)
+			return
+		}
+		d.Payload = payload
+		ds = append(ds, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ds)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeliverWebhookSignsPayload(t *testing.T) {
+	payload := []byte(`{"id":"evt_1","type":"order.created","data":{"order_id":3}}`)
+	var got *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	code, err := deliverWebhook(context.Background(), receiver.Client(), receiver.URL, "s3cret", "evt_1", eventOrderCreated, payload)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("deliver: %d, %v", code, err)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("body = %s", body)
+	}
+	if got.Header.Get(webhookIDHeader) != "evt_1" || got.Header.Get(webhookEventHeader) != eventOrderCreated {
+		t.Errorf("headers = %v", got.Header)
+	}
+	sig := got.Header.Get(webhookSignatureHeader)
+	ts, _, ok := strings.Cut(strings.TrimPrefix(sig, "t="), ",")
+	if !ok {
+		t.Fatalf("signature = %q", sig)
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		t.Fatalf("signature = %q: %v", sig, err)
+	}
+	if want := signWebhook("s3cret", time.Unix(unix, 0), payload); sig != want {
+		t.Errorf("signature = %q, want %q", sig, want)
+	}
+}
+
+func TestDeliverDueWebhooksRetriesWithBackoff(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	cols := []string{"id", "event_id", "event_type", "payload", "attempts", "url", "secret"}
+	cases := []struct {
+		name     string
+		status   int
+		attempts int
+		expect   func(m sqlmock.Sqlmock)
+	}{
+		{name: "failure is retried later", status: http.StatusServiceUnavailable, attempts: 2, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update webhook_deliveries set attempts").
+				WithArgs(3, http.StatusServiceUnavailable, sqlmock.AnyArg(), sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "last attempt gives up", status: http.StatusServiceUnavailable, attempts: webhookMaxAttempts - 1, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update webhook_deliveries set status").
+				WithArgs(deliveryFailed, webhookMaxAttempts, http.StatusServiceUnavailable, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		{name: "success is recorded", status: http.StatusNoContent, attempts: 2, expect: func(m sqlmock.Sqlmock) {
+			m.ExpectExec("update webhook_deliveries set status").
+				WithArgs(deliverySucceeded, 3, http.StatusNoContent, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			db = mockDB
+			status = tc.status
+
+			mock.ExpectQuery("update webhook_deliveries d set next_attempt_at").
+				WillReturnRows(sqlmock.NewRows(cols).AddRow(1, "evt_1", eventOrderCreated, []byte(`{}`), tc.attempts, receiver.URL, "s3cret"))
+			tc.expect(mock)
+			n, err := deliverDueWebhooks(context.Background(), receiver.Client(), 10)
+			if err != nil || n != 1 {
+				t.Fatalf("deliverDueWebhooks = %d, %v", n, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
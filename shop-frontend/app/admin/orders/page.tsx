@@ -12,6 +12,7 @@ import { fetchJSON } from "@/lib/api"
 import type { OrderDisplay, Profile } from "@/lib/types"
 import { Loader2, RefreshCw } from "lucide-react"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney } from "@/lib/money"
 
 function StatusBadge({ status }: { status: string }) {
   const st = status?.toLowerCase?.() || ""
@@ -96,6 +97,7 @@ export default function AdminOrdersPage() {
           id: Number(idRaw),
           status: String(o?.status ?? o?.Status ?? ""),
           total_price: total,
+          currency: String(o?.currency ?? ""),
           created_at: created,
         }
       })
@@ -263,7 +265,7 @@ export default function AdminOrdersPage() {
                               </Button>
                             </div>
                           </TableCell>
-                          <TableCell>{o.total_price} ₽</TableCell>
+                          <TableCell>{formatMoney(o.total_price, o.currency)}</TableCell>
                           <TableCell>{new Date((o as any).created_at).toLocaleString()}</TableCell>
                           <TableCell className="text-right">
                             <Button
@@ -9,15 +9,20 @@ import { Label } from "@/components/ui/label"
 import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from "@/components/ui/table"
 import { useToast } from "@/hooks/use-toast"
 import { fetchJSON } from "@/lib/api"
-import type { Product, ProductListItem, Profile } from "@/lib/types"
+import type { ArchivedProduct, Product, ProductListItem, Profile } from "@/lib/types"
 import { Loader2 } from "lucide-react"
 import BulkProductsBuilder from "@/components/admin/bulk-products-builder"
+import ProductImagesManager from "@/components/admin/product-images-manager"
+import ProductsImportExport from "@/components/admin/products-import-export"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney, fromMinor, toMinor } from "@/lib/money"
 
 export default function AdminPage() {
   const { toast } = useToast()
   const [profile, setProfile] = useState<Profile | null>(null)
   const [products, setProducts] = useState<ProductListItem[]>([])
+  const [archived, setArchived] = useState<ArchivedProduct[]>([])
+  const [restoringId, setRestoringId] = useState<number | null>(null)
   const [loading, setLoading] = useState(true)
 
   const [edit, setEdit] = useState<Partial<Product> & { id?: number }>({})
@@ -33,6 +38,8 @@ export default function AdminPage() {
         if (prof.error) throw new Error(prof.error)
         const list = await fetchJSON<ProductListItem[]>("/products")
         if (list.data) setProducts(list.data)
+        const arch = await fetchJSON<ArchivedProduct[]>("/products/archived", { auth: true })
+        if (arch.data) setArchived(arch.data)
       } catch (e: any) {
         toast({ title: "Ошибка", description: e?.message || "Нет доступа", variant: "destructive" })
       } finally {
@@ -45,6 +52,8 @@ export default function AdminPage() {
   async function refreshProducts() {
     const list = await fetchJSON<ProductListItem[]>("/products")
     if (list.data) setProducts(list.data)
+    const arch = await fetchJSON<ArchivedProduct[]>("/products/archived", { auth: true })
+    if (arch.data) setArchived(arch.data)
   }
 
   async function updateProduct() {
@@ -83,8 +92,8 @@ export default function AdminPage() {
     try {
       const res = await fetchJSON<{ message: string }>(`/products/${id}`, { method: "DELETE", auth: true })
       if (res.data) {
-        setProducts((prev) => prev.filter((p) => p.id !== id))
-        toast({ title: "Удалено" })
+        toast({ title: "Товар перенесён в архив" })
+        refreshProducts()
       } else {
         toast({ title: "Ошибка", description: res.error || "Не удалось удалить", variant: "destructive" })
       }
@@ -95,6 +104,21 @@ export default function AdminPage() {
     }
   }
 
+  async function restoreProduct(id: number) {
+    setRestoringId(id)
+    try {
+      const res = await fetchJSON<{ message: string }>(`/products/${id}/restore`, { method: "POST", auth: true })
+      if (res.data) {
+        toast({ title: "Товар восстановлен" })
+        refreshProducts()
+      } else {
+        toast({ title: "Ошибка", description: res.error || "Не удалось восстановить", variant: "destructive" })
+      }
+    } finally {
+      setRestoringId(null)
+    }
+  }
+
   const [orderId, setOrderId] = useState<number | "">("")
   const [orderStatus, setOrderStatus] = useState("processing")
 
@@ -147,6 +171,10 @@ export default function AdminPage() {
 
         <BulkProductsBuilder onPosted={refreshProducts} />
 
+        <ProductsImportExport onImported={refreshProducts} />
+
+        <ProductImagesManager onChanged={refreshProducts} />
+
         <Card>
           <CardHeader>
             <CardTitle>Обновить товар</CardTitle>
@@ -175,8 +203,9 @@ export default function AdminPage() {
               <Label>Цена</Label>
               <Input
                 type="number"
-                value={edit.price ?? 0}
-                onChange={(e) => setEdit((p) => ({ ...p, price: Number(e.target.value) }))}
+                step="0.01"
+                value={fromMinor(edit.price ?? 0)}
+                onChange={(e) => setEdit((p) => ({ ...p, price: toMinor(Number(e.target.value)) }))}
               />
             </div>
             <div className="grid gap-2">
@@ -240,7 +269,7 @@ export default function AdminPage() {
 
         <Card>
           <CardHeader>
-            <CardTitle>Товары (быстрое удаление)</CardTitle>
+            <CardTitle>Товары (перенос в архив)</CardTitle>
           </CardHeader>
           <CardContent>
             <div className="w-full overflow-x-auto">
@@ -260,7 +289,7 @@ export default function AdminPage() {
                       <TableRow key={p.id}>
                         <TableCell>{p.id}</TableCell>
                         <TableCell>{p.name}</TableCell>
-                        <TableCell>{p.price} ₽</TableCell>
+                        <TableCell>{formatMoney(p.price, p.currency)}</TableCell>
                         <TableCell className="text-right">
                           <Button
                             variant="destructive"
@@ -270,7 +299,7 @@ export default function AdminPage() {
                             aria-busy={busy}
                             className="transition active:scale-95"
                           >
-                            {busy ? <Loader2 className="w-4 h-4 animate-spin" /> : "Удалить"}
+                            {busy ? <Loader2 className="w-4 h-4 animate-spin" /> : "В архив"}
                           </Button>
                         </TableCell>
                       </TableRow>
@@ -281,6 +310,56 @@ export default function AdminPage() {
             </div>
           </CardContent>
         </Card>
+
+        <Card>
+          <CardHeader>
+            <CardTitle>Архив товаров</CardTitle>
+          </CardHeader>
+          <CardContent>
+            {archived.length === 0 ? (
+              <div className="text-sm text-muted-foreground">Архив пуст</div>
+            ) : (
+              <div className="w-full overflow-x-auto">
+                <Table className="min-w-[700px]">
+                  <TableHeader>
+                    <TableRow>
+                      <TableHead>ID</TableHead>
+                      <TableHead>Название</TableHead>
+                      <TableHead>В архиве с</TableHead>
+                      <TableHead>Заказы</TableHead>
+                      <TableHead className="text-right">Действия</TableHead>
+                    </TableRow>
+                  </TableHeader>
+                  <TableBody>
+                    {archived.map((p) => {
+                      const busy = restoringId === p.id
+                      return (
+                        <TableRow key={p.id}>
+                          <TableCell>{p.id}</TableCell>
+                          <TableCell>{p.name}</TableCell>
+                          <TableCell>{new Date(p.archived_at).toLocaleDateString()}</TableCell>
+                          <TableCell>{p.ordered ? "есть" : "нет — будет удалён при очистке"}</TableCell>
+                          <TableCell className="text-right">
+                            <Button
+                              variant="outline"
+                              size="sm"
+                              onClick={() => restoreProduct(p.id)}
+                              disabled={busy}
+                              aria-busy={busy}
+                              className="bg-transparent transition active:scale-95"
+                            >
+                              {busy ? <Loader2 className="w-4 h-4 animate-spin" /> : "Восстановить"}
+                            </Button>
+                          </TableCell>
+                        </TableRow>
+                      )
+                    })}
+                  </TableBody>
+                </Table>
+              </div>
+            )}
+          </CardContent>
+        </Card>
       </div>
     </>
   )
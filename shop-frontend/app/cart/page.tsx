@@ -13,6 +13,7 @@ import { fetchJSON } from "@/lib/api"
 import type { CartDisplay, Profile } from "@/lib/types"
 import { Alert, AlertDescription, AlertTitle } from "@/components/ui/alert"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney } from "@/lib/money"
 
 export default function CartPage() {
   const [items, setItems] = useState<CartDisplay[]>([])
@@ -179,7 +180,7 @@ export default function CartPage() {
                     return (
                       <TableRow key={it.id}>
                         <TableCell className="font-medium">{it.product_name}</TableCell>
-                        <TableCell>{isNaN(price) ? "-" : `${price} ₽`}</TableCell>
+                        <TableCell>{isNaN(price) ? "-" : formatMoney(price)}</TableCell>
                         <TableCell>{it.quantity}</TableCell>
                         <TableCell className="text-right">
                           <Button
@@ -204,7 +205,7 @@ export default function CartPage() {
         </CardContent>
         <Separator />
         <CardFooter className="flex flex-col gap-3 sm:flex-row sm:items-center sm:justify-between">
-          <div className="text-lg font-semibold">Итого: {total} ₽</div>
+          <div className="text-lg font-semibold">Итого: {formatMoney(total)}</div>
           <Link href="/checkout" className="w-full sm:w-auto">
             <Button disabled={items.length === 0} className="w-full transition active:scale-95">
               Оформить заказ
@@ -1,20 +1,32 @@
 "use client"
 
-import { useEffect, useMemo, useState } from "react"
+import { useEffect, useMemo, useRef, useState } from "react"
 import { useRouter } from "next/navigation"
 import { Card, CardContent, CardFooter, CardHeader, CardTitle } from "@/components/ui/card"
 import { Button } from "@/components/ui/button"
+import { Input } from "@/components/ui/input"
 import { Separator } from "@/components/ui/separator"
 import { useToast } from "@/hooks/use-toast"
 import { fetchJSON } from "@/lib/api"
-import type { CartDisplay } from "@/lib/types"
+import type { CartDisplay, CartSummary, ShippingQuote } from "@/lib/types"
 import { Loader2 } from "lucide-react"
 import { GlobalTabs } from "@/components/global-tabs"
+import CheckoutAddress from "@/components/checkout-address"
+import { SHOP_CURRENCY, formatMoney, getCurrency } from "@/lib/money"
 
 export default function CheckoutPage() {
   const [items, setItems] = useState<CartDisplay[]>([])
   const [loading, setLoading] = useState(true)
   const [placing, setPlacing] = useState(false)
+  const [summary, setSummary] = useState<CartSummary | null>(null)
+  const [code, setCode] = useState("")
+  const [applying, setApplying] = useState(false)
+  const [quotes, setQuotes] = useState<ShippingQuote[]>([])
+  const [methodId, setMethodId] = useState<number | null>(null)
+  const [addressId, setAddressId] = useState<number | null>(null)
+  // One key per visit to the page: a double click or a retry after a dropped
+  // connection replays the first order instead of creating another.
+  const idempotencyKey = useRef(crypto.randomUUID())
   const { toast } = useToast()
   const router = useRouter()
 
@@ -24,6 +36,8 @@ export default function CheckoutPage() {
         const res = await fetchJSON<CartDisplay[]>("/cart/", { auth: true })
         if (Array.isArray(res.data)) setItems(res.data)
         else setItems([])
+        const sum = await fetchJSON<CartSummary>("/cart/summary", { auth: true })
+        if (sum.data) setSummary(sum.data)
       } catch {
         toast({ title: "Ошибка", description: "Не удалось загрузить корзину", variant: "destructive" })
       } finally {
@@ -42,16 +56,62 @@ export default function CheckoutPage() {
     }, 0)
   }, [items])
 
+  // Quotes depend on the cart total and the address, so they're refreshed
+  // whenever a coupon or the address changes. The previous choice is kept
+  // while it's still offered.
+  async function loadQuotes() {
+    if (addressId === null) {
+      setQuotes([])
+      setMethodId(null)
+      return
+    }
+    const res = await fetchJSON<ShippingQuote[]>(`/shipping/quote?address_id=${addressId}`, { auth: true })
+    const list = Array.isArray(res.data) ? res.data : []
+    setQuotes(list)
+    setMethodId((prev) => (list.some((q) => q.method_id === prev) ? prev : (list[0]?.method_id ?? null)))
+  }
+
+  useEffect(() => {
+    loadQuotes()
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [addressId])
+
+  const shipping = quotes.find((q) => q.method_id === methodId)?.price ?? 0
+
+  async function applyCoupon(remove = false) {
+    setApplying(true)
+    try {
+      const res = await fetchJSON<CartSummary>("/cart/coupon", {
+        method: remove ? "DELETE" : "POST",
+        auth: true,
+        body: remove ? undefined : { code },
+      })
+      if (res.data) {
+        setSummary(res.data)
+        setCode("")
+        await loadQuotes()
+      } else {
+        toast({ title: "Промокод не применён", description: res.error, variant: "destructive" })
+      }
+    } finally {
+      setApplying(false)
+    }
+  }
+
   async function placeOrder() {
     setPlacing(true)
     try {
       const res = await fetchJSON<{ message: string }>("/orders/", {
         method: "POST",
         auth: true,
+        headers: { "Idempotency-Key": idempotencyKey.current },
         body: {
           status: "pending",
           total_price: total,
           created_at: new Date().toISOString(),
+          shipping_method_id: methodId ?? undefined,
+          address_id: addressId ?? undefined,
+          currency: getCurrency(),
         },
       })
       if (res.data) {
@@ -59,6 +119,11 @@ export default function CheckoutPage() {
         toast({ title: "Заказ создан" })
         router.push("/orders")
       } else {
+        // A 4xx the customer has to fix (the cart, stock) spends the key: the
+        // retry is a new order. On a network error (0), while the first
+        // attempt is still running (409) or on a server error (5xx, not
+        // stored) the order may yet go through, so the key is kept.
+        if (res.status >= 400 && res.status < 500 && res.status !== 409) idempotencyKey.current = crypto.randomUUID()
         toast({ title: "Ошибка", description: res.error || "Не удалось создать заказ", variant: "destructive" })
       }
     } finally {
@@ -93,22 +158,75 @@ export default function CheckoutPage() {
                       <div className="text-sm">
                         {it.product_name} × {it.quantity}
                       </div>
-                      <div className="font-medium">{isNaN(price) ? "-" : `${price * it.quantity} ₽`}</div>
+                      <div className="font-medium">{isNaN(price) ? "-" : formatMoney(price * it.quantity)}</div>
                     </div>
                   )
                 })}
                 <Separator />
+                {summary?.coupon_code ? (
+                  <div className="flex items-center justify-between text-sm">
+                    <div>
+                      Промокод {summary.coupon_code}
+                      {summary.coupon_error && <div className="text-destructive">{summary.coupon_error}</div>}
+                      {summary.free_shipping && <div className="text-muted-foreground">Бесплатная доставка</div>}
+                    </div>
+                    <div className="flex items-center gap-2">
+                      {summary.discount > 0 && <div className="font-medium">−{formatMoney(summary.discount, summary.currency)}</div>}
+                      <Button variant="ghost" size="sm" onClick={() => applyCoupon(true)} disabled={applying}>
+                        Убрать
+                      </Button>
+                    </div>
+                  </div>
+                ) : (
+                  <form
+                    className="flex gap-2"
+                    onSubmit={(e) => {
+                      e.preventDefault()
+                      applyCoupon()
+                    }}
+                  >
+                    <Input placeholder="Промокод" value={code} onChange={(e) => setCode(e.target.value)} />
+                    <Button type="submit" variant="outline" disabled={!code || applying}>
+                      Применить
+                    </Button>
+                  </form>
+                )}
+                <CheckoutAddress value={addressId} onChange={setAddressId} />
+                {quotes.length > 0 && (
+                  <div className="space-y-1">
+                    <div className="text-sm font-medium">Доставка</div>
+                    {quotes.map((q) => (
+                      <label key={q.method_id} className="flex items-center justify-between text-sm">
+                        <span className="flex items-center gap-2">
+                          <input
+                            type="radio"
+                            name="shipping"
+                            checked={methodId === q.method_id}
+                            onChange={() => setMethodId(q.method_id)}
+                          />
+                          {q.name}
+                        </span>
+                        <span>{q.price === 0 ? "Бесплатно" : formatMoney(q.price)}</span>
+                      </label>
+                    ))}
+                  </div>
+                )}
                 <div className="flex items-center justify-between text-lg font-semibold">
                   <div>Итого</div>
-                  <div>{total} ₽</div>
+                  <div>{formatMoney((summary ? summary.grand_total : total) + shipping)}</div>
                 </div>
+                {getCurrency() !== SHOP_CURRENCY && (
+                  <div className="text-sm text-muted-foreground">
+                    Оплата в {getCurrency()} по курсу на момент оформления заказа
+                  </div>
+                )}
               </div>
             )}
           </CardContent>
           <CardFooter>
             <Button
               onClick={placeOrder}
-              disabled={items.length === 0 || placing}
+              disabled={items.length === 0 || addressId === null || placing}
               aria-busy={placing}
               className="transition active:scale-95"
             >
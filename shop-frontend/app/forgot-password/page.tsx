@@ -0,0 +1,67 @@
+"use client"
+
+import type React from "react"
+import { useState } from "react"
+import Link from "next/link"
+import { Button } from "@/components/ui/button"
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/components/ui/card"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
+import { useToast } from "@/hooks/use-toast"
+import { fetchJSON } from "@/lib/api"
+import { Loader2 } from "lucide-react"
+
+export default function ForgotPasswordPage() {
+  const [email, setEmail] = useState("")
+  const [loading, setLoading] = useState(false)
+  const [sent, setSent] = useState(false)
+  const { toast } = useToast()
+
+  async function onSubmit(e: React.FormEvent) {
+    e.preventDefault()
+    setLoading(true)
+    try {
+      const res = await fetchJSON("/password/forgot", { method: "POST", body: { email } })
+      if (res.error) {
+        toast({ title: "Ошибка", description: res.error, variant: "destructive" })
+      } else {
+        setSent(true)
+      }
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <div className="min-h-[100dvh] grid place-items-center px-4">
+      <Card className="w-full max-w-md">
+        <CardHeader>
+          <CardTitle>Восстановление пароля</CardTitle>
+          <CardDescription>Мы отправим ссылку для смены пароля на вашу почту.</CardDescription>
+        </CardHeader>
+        <CardContent>
+          {sent ? (
+            <p className="text-sm text-muted-foreground">
+              Если этот адрес зарегистрирован, письмо уже в пути. Ссылка действует один час.
+            </p>
+          ) : (
+            <form onSubmit={onSubmit} className="grid gap-4">
+              <div className="grid gap-2">
+                <Label htmlFor="email">Email</Label>
+                <Input id="email" type="email" required value={email} onChange={(e) => setEmail(e.target.value)} />
+              </div>
+              <Button type="submit" disabled={loading} aria-busy={loading} className="transition active:scale-95">
+                {loading ? <Loader2 className="w-4 h-4 animate-spin" /> : "Отправить ссылку"}
+              </Button>
+            </form>
+          )}
+          <div className="mt-4 text-sm text-muted-foreground">
+            <Link className="underline" href="/login">
+              Вернуться ко входу
+            </Link>
+          </div>
+        </CardContent>
+      </Card>
+    </div>
+  )
+}
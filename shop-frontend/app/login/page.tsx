@@ -65,6 +65,11 @@ export default function LoginPage() {
             <Button type="submit" disabled={loading} aria-busy={loading} className="transition active:scale-95">
               {loading ? <Loader2 className="w-4 h-4 animate-spin" /> : "Войти"}
             </Button>
+            <div className="text-sm text-muted-foreground">
+              <Link className="underline" href="/forgot-password">
+                Забыли пароль?
+              </Link>
+            </div>
             <div className="text-sm text-muted-foreground">
               Нет аккаунта?{" "}
               <Link className="underline" href="/register">
@@ -5,10 +5,11 @@ import { useParams } from "next/navigation"
 import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card"
 import { Badge } from "@/components/ui/badge"
 import { useToast } from "@/hooks/use-toast"
-import { fetchJSON } from "@/lib/api"
+import { fetchJSON, streamEvents } from "@/lib/api"
 import type { OrderDisplay } from "@/lib/types"
 import { Button } from "@/components/ui/button"
 import { Loader2 } from "lucide-react"
+import { formatMoney } from "@/lib/money"
 
 export default function OrderDetailsPage() {
   const params = useParams()
@@ -65,6 +66,21 @@ export default function OrderDetailsPage() {
     if (id) load()
   }, [id, toast])
 
+  // Status changes made elsewhere (e.g. the order being shipped) arrive
+  // without a reload.
+  useEffect(() => {
+    if (!id) return
+    return streamEvents(
+      "/orders/events",
+      (_event, change: { order_id: number; status: string }) => {
+        if (change?.order_id === id) {
+          setOrder((o) => (o ? { ...o, status: change.status } : o))
+        }
+      },
+      { auth: true },
+    )
+  }, [id])
+
   return (
     <div className="container px-4 py-6">
       <Card>
@@ -81,8 +97,19 @@ export default function OrderDetailsPage() {
                 <Badge variant="secondary">{order.status}</Badge>
               </div>
               <div>
-                Сумма: <span className="font-semibold">{order.total_price} ₽</span>
+                Сумма: <span className="font-semibold">{formatMoney(order.total_price, order.currency)}</span>
               </div>
+              {order.shipping_method && (
+                <div className="text-sm text-muted-foreground">
+                  Доставка: {order.shipping_method}, {formatMoney(order.shipping_price, order.currency)}
+                </div>
+              )}
+              {order.tax_breakdown.map((t) => (
+                <div key={`${t.name}-${t.rate}`} className="text-sm text-muted-foreground">
+                  {order.tax_inclusive ? "В т.ч. " : ""}
+                  {t.name} {t.rate / 100}%: {formatMoney(t.amount, order.currency)}
+                </div>
+              ))}
               <div>Создан: {new Date(order.created_at as any as string).toLocaleString()}</div>
               <div className="pt-2">
                 <Button
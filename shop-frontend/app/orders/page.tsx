@@ -12,6 +12,7 @@ import { fetchJSON } from "@/lib/api"
 import type { OrderDisplay } from "@/lib/types"
 import { Loader2 } from "lucide-react"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney } from "@/lib/money"
 
 function StatusBadge({ status }: { status: string }) {
   const st = status?.toLowerCase?.() || ""
@@ -149,7 +150,7 @@ export default function OrdersPage() {
                       <TableCell>
                         <StatusBadge status={o.status} />
                       </TableCell>
-                      <TableCell>{o.total_price} ₽</TableCell>
+                      <TableCell>{formatMoney(o.total_price, o.currency)}</TableCell>
                       <TableCell>{new Date((o as any).created_at).toLocaleString()}</TableCell>
                       <TableCell className="text-right">
                         <Button
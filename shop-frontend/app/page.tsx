@@ -9,10 +9,12 @@ import { Card, CardContent, CardFooter, CardHeader, CardTitle } from "@/componen
 import { Input } from "@/components/ui/input"
 import { Separator } from "@/components/ui/separator"
 import { useToast } from "@/hooks/use-toast"
-import { fetchJSON, getToken, clearToken } from "@/lib/api"
+import { assetUrl, fetchJSON, getToken, clearToken } from "@/lib/api"
 import type { ProductListItem, Profile } from "@/lib/types"
 import { Select, SelectContent, SelectItem, SelectTrigger, SelectValue } from "@/components/ui/select"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney, getCurrency } from "@/lib/money"
+import { CurrencySelect } from "@/components/currency-select"
 
 type ProductSort = "default" | "price-asc" | "price-desc" | "name-asc" | "name-desc"
 
@@ -21,6 +23,7 @@ export default function Page() {
   const [loading, setLoading] = useState(true)
   const [q, setQ] = useState("")
   const [sort, setSort] = useState<ProductSort>("default")
+  const [currency, setCurrency] = useState("")
   const [profile, setProfile] = useState<Profile | null>(null)
   const [loggingOut, setLoggingOut] = useState(false)
   const { toast } = useToast()
@@ -49,10 +52,15 @@ export default function Page() {
   }, [filtered, sort])
 
   useEffect(() => {
+    setCurrency(getCurrency())
+  }, [])
+
+  useEffect(() => {
+    if (!currency) return
     let mounted = true
     async function load() {
       try {
-        const res = await fetchJSON<ProductListItem[]>("/products")
+        const res = await fetchJSON<ProductListItem[]>(`/products?currency=${currency}`)
         if (mounted && Array.isArray(res.data)) setProducts(res.data)
       } catch (e) {
         console.error(e)
@@ -62,6 +70,13 @@ export default function Page() {
       }
     }
     load()
+    return () => {
+      mounted = false
+    }
+  }, [currency, toast])
+
+  useEffect(() => {
+    let mounted = true
     async function loadAuth() {
       if (!getToken()) return
       try {
@@ -156,6 +171,7 @@ export default function Page() {
                 <SelectItem value="name-desc">название: Я→A</SelectItem>
               </SelectContent>
             </Select>
+            <CurrencySelect onChange={setCurrency} />
           </div>
         </div>
 
@@ -186,7 +202,7 @@ export default function Page() {
               <Card key={`prod-${p.id}`} className="overflow-hidden">
                 <div className="relative aspect-[4/3] bg-muted">
                   <Image
-                    src={p.image || "/placeholder.svg?height=400&width=600&query=product image placeholder"}
+                    src={assetUrl(p.image) || "/placeholder.svg?height=400&width=600&query=product image placeholder"}
                     alt={p.name}
                     fill
                     className="object-cover"
@@ -196,7 +212,7 @@ export default function Page() {
                   <CardTitle className="text-lg line-clamp-1">{p.name}</CardTitle>
                 </CardHeader>
                 <CardContent className="pt-0">
-                  <div className="text-xl font-semibold">{p.price} ₽</div>
+                  <div className="text-xl font-semibold">{formatMoney(p.price, p.currency)}</div>
                 </CardContent>
                 <CardFooter className="gap-2">
                   <Link href={`/products/${p.id}`} className="w-full">
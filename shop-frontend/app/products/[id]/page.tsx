@@ -9,10 +9,11 @@ import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/com
 import { Input } from "@/components/ui/input"
 import { Separator } from "@/components/ui/separator"
 import { useToast } from "@/hooks/use-toast"
-import { fetchJSON, getToken } from "@/lib/api"
+import { assetUrl, fetchJSON, getToken } from "@/lib/api"
 import type { Product } from "@/lib/types"
 import { Loader2 } from "lucide-react"
 import { GlobalTabs } from "@/components/global-tabs"
+import { formatMoney, getCurrency } from "@/lib/money"
 
 export default function ProductPage() {
   const params = useParams()
@@ -22,13 +23,14 @@ export default function ProductPage() {
   const [qty, setQty] = useState<number>(1)
   const [loading, setLoading] = useState(true)
   const [adding, setAdding] = useState(false)
+  const [shown, setShown] = useState(0)
   const id = Number(params?.id)
 
   useEffect(() => {
     const mounted = true
     async function load() {
       try {
-        const res = await fetchJSON<Product>(`/products/${id}`)
+        const res = await fetchJSON<Product>(`/products/${id}?currency=${getCurrency()}`)
         if (mounted && res.data) setProduct(res.data)
       } catch {
         toast({ title: "Ошибка", description: "Не удалось загрузить товар", variant: "destructive" })
@@ -77,14 +79,35 @@ export default function ProductPage() {
           ← Назад к каталогу
         </Link>
         <div className="grid gap-6 md:grid-cols-2 mt-4">
-          <div className="relative aspect-square bg-muted rounded-lg overflow-hidden">
-            {product && (
-              <Image
-                src={product.image || "/placeholder.svg?height=800&width=800&query=product detail image placeholder"}
-                alt={product.name}
-                fill
-                className="object-cover"
-              />
+          <div className="space-y-3">
+            <div className="relative aspect-square bg-muted rounded-lg overflow-hidden">
+              {product && (
+                <Image
+                  src={
+                    (product.images?.length
+                      ? assetUrl(product.images[shown]?.thumbnails["1200"] || product.images[shown]?.url)
+                      : assetUrl(product.image)) || "/placeholder.svg?height=800&width=800&query=product detail image placeholder"
+                  }
+                  alt={product.name}
+                  fill
+                  className="object-cover"
+                />
+              )}
+            </div>
+            {product?.images && product.images.length > 1 && (
+              <div className="flex gap-2 overflow-x-auto">
+                {product.images.map((img, i) => (
+                  <button
+                    key={img.id}
+                    type="button"
+                    onClick={() => setShown(i)}
+                    className={`relative w-16 h-16 shrink-0 rounded-md overflow-hidden border-2 ${i === shown ? "border-primary" : "border-transparent"}`}
+                    aria-label={`Изображение ${i + 1}`}
+                  >
+                    <Image src={assetUrl(img.thumbnails["160"] || img.url)} alt="" fill className="object-cover" />
+                  </button>
+                ))}
+              </div>
             )}
           </div>
           <Card>
@@ -95,8 +118,12 @@ export default function ProductPage() {
             <CardContent className="space-y-4">
               {!loading && (
                 <>
-                  <div className="text-2xl font-bold">{product?.price} ₽</div>
-                  <div className="text-sm text-muted-foreground">В наличии: {product?.stock}</div>
+                  <div className="text-2xl font-bold">{product && formatMoney(product.price, product.currency)}</div>
+                  {product?.archived_at ? (
+                    <div className="text-sm text-muted-foreground">Товар снят с продажи</div>
+                  ) : (
+                    <div className="text-sm text-muted-foreground">В наличии: {product?.stock}</div>
+                  )}
                   <Separator />
                   <div className="flex items-center gap-3">
                     <Input
@@ -114,7 +141,7 @@ export default function ProductPage() {
                     <Button
                       onClick={addToCart}
                       className="flex-1 transition active:scale-95"
-                      disabled={adding || (product?.stock ?? 0) <= 0}
+                      disabled={adding || (product?.stock ?? 0) <= 0 || !!product?.archived_at}
                       aria-busy={adding}
                     >
                       {adding ? <Loader2 className="w-4 h-4 animate-spin" /> : "Добавить в корзину"}
@@ -0,0 +1,79 @@
+"use client"
+
+import type React from "react"
+import { useEffect, useState } from "react"
+import Link from "next/link"
+import { useRouter } from "next/navigation"
+import { Button } from "@/components/ui/button"
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/components/ui/card"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
+import { useToast } from "@/hooks/use-toast"
+import { fetchJSON } from "@/lib/api"
+import { Loader2 } from "lucide-react"
+
+export default function ResetPasswordPage() {
+  const [token, setToken] = useState("")
+  const [password, setPassword] = useState("")
+  const [loading, setLoading] = useState(false)
+  const { toast } = useToast()
+  const router = useRouter()
+
+  useEffect(() => {
+    setToken(new URLSearchParams(window.location.search).get("token") || "")
+  }, [])
+
+  async function onSubmit(e: React.FormEvent) {
+    e.preventDefault()
+    setLoading(true)
+    try {
+      const res = await fetchJSON("/password/reset", { method: "POST", body: { token, password } })
+      if (res.error) {
+        toast({ title: "Не удалось сменить пароль", description: res.error, variant: "destructive" })
+      } else {
+        toast({ title: "Пароль изменён" })
+        router.push("/login")
+      }
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <div className="min-h-[100dvh] grid place-items-center px-4">
+      <Card className="w-full max-w-md">
+        <CardHeader>
+          <CardTitle>Новый пароль</CardTitle>
+          <CardDescription>Придумайте новый пароль для входа.</CardDescription>
+        </CardHeader>
+        <CardContent>
+          {token ? (
+            <form onSubmit={onSubmit} className="grid gap-4">
+              <div className="grid gap-2">
+                <Label htmlFor="password">Пароль</Label>
+                <Input
+                  id="password"
+                  type="password"
+                  required
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                />
+              </div>
+              <Button type="submit" disabled={loading} aria-busy={loading} className="transition active:scale-95">
+                {loading ? <Loader2 className="w-4 h-4 animate-spin" /> : "Сменить пароль"}
+              </Button>
+            </form>
+          ) : (
+            <p className="text-sm text-muted-foreground">
+              Ссылка неполная.{" "}
+              <Link className="underline" href="/forgot-password">
+                Запросите новую
+              </Link>
+              .
+            </p>
+          )}
+        </CardContent>
+      </Card>
+    </div>
+  )
+}
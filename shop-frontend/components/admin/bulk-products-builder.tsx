@@ -10,6 +10,7 @@ import { Separator } from "@/components/ui/separator"
 import { Accordion, AccordionContent, AccordionItem, AccordionTrigger } from "@/components/ui/accordion"
 import { useToast } from "@/hooks/use-toast"
 import { fetchJSON } from "@/lib/api"
+import { fromMinor, toMinor } from "@/lib/money"
 import { Plus, Trash2, Copy, Loader2, UploadCloud, FileText } from "lucide-react"
 import { cn } from "@/lib/utils"
 import type { Product } from "@/lib/types"
@@ -45,8 +46,9 @@ function validateItem(p: BuilderItem): BuilderItem {
   return { ...p, _errors: Object.keys(errors).length ? errors : undefined }
 }
 
+// The form edits prices in rubles; the API and pasted JSON use kopecks.
 function toPayload(items: BuilderItem[]): NewProduct[] {
-  return items.map(({ _key, _errors, ...rest }) => rest)
+  return items.map(({ _key, _errors, ...rest }) => ({ ...rest, price: toMinor(rest.price) }))
 }
 
 export default function BulkProductsBuilder({ onPosted = () => {} }: { onPosted?: () => void }) {
@@ -121,7 +123,7 @@ export default function BulkProductsBuilder({ onPosted = () => {} }: { onPosted?
         _key: `paste-${Date.now()}-${idx}`,
         name: String(raw?.name ?? ""),
         description: String(raw?.description ?? ""),
-        price: sanitizeNumber(raw?.price, 0),
+        price: fromMinor(sanitizeNumber(raw?.price, 0)),
         stock: sanitizeNumber(raw?.stock, 0),
         image: String(raw?.image ?? ""),
       }))
@@ -268,6 +270,7 @@ export default function BulkProductsBuilder({ onPosted = () => {} }: { onPosted?
                     <Label>Цена</Label>
                     <Input
                       type="number"
+                      step="0.01"
                       value={it.price}
                       onChange={(e) => updateAt(i, "price", e.target.value)}
                       className={cn(err.price ? "border-red-500" : "")}
@@ -0,0 +1,192 @@
+"use client"
+
+import { useState } from "react"
+import { Button } from "@/components/ui/button"
+import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
+import { useToast } from "@/hooks/use-toast"
+import { assetUrl, fetchJSON } from "@/lib/api"
+import type { ProductImage } from "@/lib/types"
+import { ArrowLeft, ArrowRight, Loader2, Trash2, UploadCloud } from "lucide-react"
+
+// Matches the server's limits, so obviously oversized files fail fast.
+const MAX_IMAGE_BYTES = 10 << 20
+const MAX_IMAGES_PER_UPLOAD = 10
+
+export default function ProductImagesManager({ onChanged = () => {} }: { onChanged?: () => void }) {
+  const { toast } = useToast()
+  const [productId, setProductId] = useState<number | "">("")
+  const [images, setImages] = useState<ProductImage[]>([])
+  const [loaded, setLoaded] = useState(false)
+  const [busy, setBusy] = useState(false)
+
+  async function load() {
+    if (!productId) {
+      toast({ title: "Укажите ID товара", variant: "destructive" })
+      return
+    }
+    setBusy(true)
+    try {
+      const res = await fetchJSON<ProductImage[]>(`/products/${productId}/images`)
+      if (res.data) {
+        setImages(res.data)
+        setLoaded(true)
+      } else {
+        toast({ title: "Ошибка", description: res.error || "Не удалось загрузить", variant: "destructive" })
+      }
+    } finally {
+      setBusy(false)
+    }
+  }
+
+  async function upload(files: FileList | null) {
+    if (!files || files.length === 0 || !productId) return
+    const list = Array.from(files)
+    if (list.length > MAX_IMAGES_PER_UPLOAD) {
+      toast({ title: `Не больше ${MAX_IMAGES_PER_UPLOAD} файлов за раз`, variant: "destructive" })
+      return
+    }
+    const tooBig = list.find((f) => f.size > MAX_IMAGE_BYTES)
+    if (tooBig) {
+      toast({ title: "Файл слишком большой", description: `${tooBig.name}: больше 10 МБ`, variant: "destructive" })
+      return
+    }
+    const form = new FormData()
+    list.forEach((f) => form.append("image", f))
+    setBusy(true)
+    try {
+      const res = await fetchJSON<ProductImage[]>(`/products/${productId}/images`, {
+        method: "POST",
+        auth: true,
+        body: form,
+      })
+      if (res.data) {
+        setImages((prev) => [...prev, ...res.data!])
+        toast({ title: "Изображения загружены" })
+        onChanged()
+      } else {
+        toast({ title: "Ошибка", description: res.error || "Не удалось загрузить", variant: "destructive" })
+      }
+    } finally {
+      setBusy(false)
+    }
+  }
+
+  async function move(index: number, delta: number) {
+    const next = [...images]
+    const target = index + delta
+    if (target < 0 || target >= next.length) return
+    ;[next[index], next[target]] = [next[target], next[index]]
+    setBusy(true)
+    try {
+      const res = await fetchJSON<ProductImage[]>(`/products/${productId}/images/order`, {
+        method: "PUT",
+        auth: true,
+        body: { ids: next.map((img) => img.id) },
+      })
+      if (res.data) {
+        setImages(res.data)
+        onChanged()
+      } else {
+        toast({ title: "Ошибка", description: res.error || "Не удалось изменить порядок", variant: "destructive" })
+      }
+    } finally {
+      setBusy(false)
+    }
+  }
+
+  async function remove(id: number) {
+    setBusy(true)
+    try {
+      const res = await fetchJSON<{ message: string }>(`/products/${productId}/images/${id}`, {
+        method: "DELETE",
+        auth: true,
+      })
+      if (res.data) {
+        setImages((prev) => prev.filter((img) => img.id !== id))
+        onChanged()
+      } else {
+        toast({ title: "Ошибка", description: res.error || "Не удалось удалить", variant: "destructive" })
+      }
+    } finally {
+      setBusy(false)
+    }
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>Изображения товара</CardTitle>
+      </CardHeader>
+      <CardContent className="space-y-4">
+        <div className="flex items-end gap-3">
+          <div className="grid gap-2">
+            <Label>ID товара</Label>
+            <Input
+              type="number"
+              value={productId}
+              onChange={(e) => {
+                setProductId(e.target.value ? Number(e.target.value) : "")
+                setLoaded(false)
+              }}
+            />
+          </div>
+          <Button variant="outline" onClick={load} disabled={busy} className="bg-transparent transition active:scale-95">
+            {busy ? <Loader2 className="w-4 h-4 animate-spin" /> : "Показать"}
+          </Button>
+          {loaded && (
+            <Label className="inline-flex items-center gap-2 cursor-pointer rounded-md border px-3 h-10">
+              <UploadCloud className="w-4 h-4" />
+              Загрузить
+              <input
+                type="file"
+                accept="image/jpeg,image/png,image/gif"
+                multiple
+                className="hidden"
+                disabled={busy}
+                onChange={(e) => {
+                  upload(e.target.files)
+                  e.target.value = ""
+                }}
+              />
+            </Label>
+          )}
+        </div>
+        {loaded && images.length === 0 && <div className="text-sm text-muted-foreground">Изображений пока нет</div>}
+        <div className="grid grid-cols-2 sm:grid-cols-4 gap-3">
+          {images.map((img, i) => (
+            <div key={img.id} className="border rounded-lg overflow-hidden">
+              {/* eslint-disable-next-line @next/next/no-img-element */}
+              <img
+                src={assetUrl(img.thumbnails["480"] || img.url)}
+                alt={`#${img.id}`}
+                className="aspect-square w-full object-cover bg-muted"
+              />
+              <div className="flex items-center justify-between p-2 text-xs text-muted-foreground">
+                <span>{i === 0 ? "Главное" : `${img.width}×${img.height}`}</span>
+                <div className="flex gap-1">
+                  <Button size="icon" variant="ghost" disabled={busy || i === 0} onClick={() => move(i, -1)} title="Раньше">
+                    <ArrowLeft className="w-4 h-4" />
+                  </Button>
+                  <Button
+                    size="icon"
+                    variant="ghost"
+                    disabled={busy || i === images.length - 1}
+                    onClick={() => move(i, 1)}
+                    title="Позже"
+                  >
+                    <ArrowRight className="w-4 h-4" />
+                  </Button>
+                  <Button size="icon" variant="ghost" disabled={busy} onClick={() => remove(img.id)} title="Удалить">
+                    <Trash2 className="w-4 h-4" />
+                  </Button>
+                </div>
+              </div>
+            </div>
+          ))}
+        </div>
+      </CardContent>
+    </Card>
+  )
+}
@@ -0,0 +1,140 @@
+"use client"
+
+import { useState } from "react"
+import { Button } from "@/components/ui/button"
+import { Card, CardContent, CardFooter, CardHeader, CardTitle } from "@/components/ui/card"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
+import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from "@/components/ui/table"
+import { useToast } from "@/hooks/use-toast"
+import { downloadFile, fetchJSON } from "@/lib/api"
+import type { ImportReport } from "@/lib/types"
+import { Download, Loader2 } from "lucide-react"
+
+const ACTION_LABELS: Record<string, string> = {
+  created: "новый",
+  updated: "обновлён",
+  error: "ошибка",
+}
+
+export default function ProductsImportExport({ onImported = () => {} }: { onImported?: () => void }) {
+  const { toast } = useToast()
+  const [file, setFile] = useState<File | null>(null)
+  const [report, setReport] = useState<ImportReport | null>(null)
+  const [busy, setBusy] = useState(false)
+
+  async function runImport(dryRun: boolean) {
+    if (!file) {
+      toast({ title: "Выберите файл CSV или JSON", variant: "destructive" })
+      return
+    }
+    const isJSON = file.name.toLowerCase().endsWith(".json")
+    setBusy(true)
+    try {
+      const res = await fetchJSON<ImportReport>(`/products/import${dryRun ? "?dry_run=true" : ""}`, {
+        method: "POST",
+        auth: true,
+        body: file,
+        headers: { "Content-Type": isJSON ? "application/json" : "text/csv" },
+      })
+      const got: ImportReport | undefined = res.data || (res.status === 422 ? res.errorBody : undefined)
+      if (got) {
+        setReport(got)
+        if (got.saved) {
+          toast({ title: "Импорт завершён", description: `Новых: ${got.created}, обновлено: ${got.updated}` })
+          onImported()
+        } else if (got.failed > 0) {
+          toast({ title: "Ничего не сохранено", description: `Ошибок в строках: ${got.failed}`, variant: "destructive" })
+        }
+      } else {
+        setReport(null)
+        toast({ title: "Ошибка", description: res.error || "Не удалось импортировать", variant: "destructive" })
+      }
+    } finally {
+      setBusy(false)
+    }
+  }
+
+  async function runExport(format: "csv" | "json") {
+    const err = await downloadFile(`/products/export?format=${format}`, `products.${format}`, { auth: true })
+    if (err) toast({ title: "Ошибка", description: err, variant: "destructive" })
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>Импорт и экспорт товаров</CardTitle>
+      </CardHeader>
+      <CardContent className="space-y-4">
+        <div className="grid gap-2">
+          <Label>Файл CSV или JSON</Label>
+          <Input
+            type="file"
+            accept=".csv,.json,text/csv,application/json"
+            onChange={(e) => {
+              setFile(e.target.files?.[0] || null)
+              setReport(null)
+            }}
+          />
+          <div className="text-xs text-muted-foreground">
+            Колонки: sku, name, description, price (в копейках), currency, stock, image, category, weight, tax_class.
+            Товары сопоставляются по sku, затем по названию; незаполненные колонки не меняются. Если хоть одна строка
+            с ошибкой, ничего не сохраняется.
+          </div>
+        </div>
+        {report && (
+          <div className="space-y-2">
+            <div className="text-sm">
+              {report.dry_run ? "Проверка: " : ""}новых {report.created}, обновлено {report.updated}, ошибок{" "}
+              {report.failed}
+              {report.saved ? " — сохранено" : " — не сохранено"}
+            </div>
+            <div className="w-full overflow-x-auto max-h-80">
+              <Table>
+                <TableHeader>
+                  <TableRow>
+                    <TableHead>Строка</TableHead>
+                    <TableHead>SKU</TableHead>
+                    <TableHead>Название</TableHead>
+                    <TableHead>Результат</TableHead>
+                  </TableRow>
+                </TableHeader>
+                <TableBody>
+                  {report.rows.map((row) => (
+                    <TableRow key={row.row}>
+                      <TableCell>{row.row}</TableCell>
+                      <TableCell>{row.sku}</TableCell>
+                      <TableCell>{row.name}</TableCell>
+                      <TableCell className={row.action === "error" ? "text-destructive" : ""}>
+                        {ACTION_LABELS[row.action] || row.action}
+                        {row.errors?.length ? `: ${row.errors.join("; ")}` : ""}
+                      </TableCell>
+                    </TableRow>
+                  ))}
+                </TableBody>
+              </Table>
+            </div>
+          </div>
+        )}
+      </CardContent>
+      <CardFooter className="flex flex-wrap gap-2">
+        <Button variant="outline" onClick={() => runImport(true)} disabled={busy} className="bg-transparent transition active:scale-95">
+          Проверить
+        </Button>
+        <Button onClick={() => runImport(false)} disabled={busy} aria-busy={busy} className="transition active:scale-95">
+          {busy ? <Loader2 className="w-4 h-4 animate-spin" /> : "Импортировать"}
+        </Button>
+        <div className="ml-auto flex gap-2">
+          <Button variant="outline" onClick={() => runExport("csv")} className="gap-2 bg-transparent transition active:scale-95">
+            <Download className="w-4 h-4" />
+            CSV
+          </Button>
+          <Button variant="outline" onClick={() => runExport("json")} className="gap-2 bg-transparent transition active:scale-95">
+            <Download className="w-4 h-4" />
+            JSON
+          </Button>
+        </div>
+      </CardFooter>
+    </Card>
+  )
+}
@@ -9,8 +9,10 @@ import { Input } from "@/components/ui/input"
 import { Button } from "@/components/ui/button"
 import { Select, SelectContent, SelectItem, SelectTrigger, SelectValue } from "@/components/ui/select"
 import { Separator } from "@/components/ui/separator"
-import { fetchJSON } from "@/lib/api"
+import { assetUrl, fetchJSON } from "@/lib/api"
 import type { ProductListItem } from "@/lib/types"
+import { formatMoney, getCurrency } from "@/lib/money"
+import { CurrencySelect } from "@/components/currency-select"
 
 type ProductSort = "default" | "price-asc" | "price-desc" | "name-asc" | "name-desc"
 
@@ -25,12 +27,18 @@ export default function CatalogComponent({
   const [loading, setLoading] = useState(true)
   const [q, setQ] = useState("")
   const [sort, setSort] = useState<ProductSort>("default")
+  const [currency, setCurrency] = useState("")
 
   useEffect(() => {
+    setCurrency(getCurrency())
+  }, [])
+
+  useEffect(() => {
+    if (!currency) return
     let mounted = true
     async function load() {
       try {
-        const res = await fetchJSON<ProductListItem[]>("/products")
+        const res = await fetchJSON<ProductListItem[]>(`/products?currency=${currency}`)
         if (mounted && Array.isArray(res.data)) setProducts(res.data)
       } finally {
         setLoading(false)
@@ -40,7 +48,7 @@ export default function CatalogComponent({
     return () => {
       mounted = false
     }
-  }, [])
+  }, [currency])
 
   const filtered = useMemo(() => {
     const query = q.trim().toLowerCase()
@@ -94,6 +102,7 @@ export default function CatalogComponent({
               <SelectItem value="name-desc">название: Я→A</SelectItem>
             </SelectContent>
           </Select>
+          <CurrencySelect onChange={setCurrency} />
         </div>
       </div>
 
@@ -124,7 +133,7 @@ export default function CatalogComponent({
             <Card key={`prod-${p.id}`} className="overflow-hidden">
               <div className="relative aspect-[4/3] bg-muted">
                 <Image
-                  src={p.image || "/placeholder.svg?height=400&width=600&query=product image placeholder"}
+                  src={assetUrl(p.image) || "/placeholder.svg?height=400&width=600&query=product image placeholder"}
                   alt={p.name}
                   fill
                   className="object-cover"
@@ -134,7 +143,7 @@ export default function CatalogComponent({
                 <CardTitle className="text-lg line-clamp-1">{p.name}</CardTitle>
               </CardHeader>
               <CardContent className="pt-0">
-                <div className="text-xl font-semibold">{p.price} ₽</div>
+                <div className="text-xl font-semibold">{formatMoney(p.price, p.currency)}</div>
               </CardContent>
               <CardFooter className="gap-2">
                 <Link href={`/products/${p.id}`} className="w-full">
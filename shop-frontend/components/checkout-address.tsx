@@ -0,0 +1,114 @@
+"use client"
+
+import { useEffect, useState } from "react"
+import { Button } from "@/components/ui/button"
+import { Input } from "@/components/ui/input"
+import { useToast } from "@/hooks/use-toast"
+import { fetchJSON } from "@/lib/api"
+import type { Address, AddressInput } from "@/lib/types"
+import { Loader2 } from "lucide-react"
+
+const EMPTY: AddressInput = { full_name: "", phone: "", line1: "", line2: "", city: "", region: "", postal_code: "", country: "" }
+
+function oneLine(a: Address) {
+  return [a.full_name, a.line1, a.line2, a.city, a.region, a.postal_code, a.country].filter(Boolean).join(", ")
+}
+
+// CheckoutAddress lists the customer's addresses to ship to and lets them
+// add one. The default address is preselected; a new one is selected once
+// saved.
+export default function CheckoutAddress({ value, onChange }: { value: number | null; onChange: (id: number | null) => void }) {
+  const { toast } = useToast()
+  const [addresses, setAddresses] = useState<Address[]>([])
+  const [adding, setAdding] = useState(false)
+  const [form, setForm] = useState<AddressInput>(EMPTY)
+  const [saving, setSaving] = useState(false)
+
+  useEffect(() => {
+    async function load() {
+      const res = await fetchJSON<Address[]>("/addresses/", { auth: true })
+      const list = Array.isArray(res.data) ? res.data : []
+      setAddresses(list)
+      setAdding(list.length === 0)
+      onChange((list.find((a) => a.is_default) ?? list[0])?.id ?? null)
+    }
+    load()
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [])
+
+  async function save() {
+    setSaving(true)
+    try {
+      const res = await fetchJSON<Address>("/addresses/", { method: "POST", auth: true, body: form })
+      if (res.data) {
+        const saved = res.data
+        setAddresses((prev) => [...prev, saved])
+        setForm(EMPTY)
+        setAdding(false)
+        onChange(saved.id)
+      } else {
+        toast({ title: "Адрес не сохранён", description: res.error, variant: "destructive" })
+      }
+    } finally {
+      setSaving(false)
+    }
+  }
+
+  function field(key: keyof AddressInput, placeholder: string) {
+    return (
+      <Input
+        placeholder={placeholder}
+        value={(form[key] as string | undefined) ?? ""}
+        onChange={(e) => setForm((f) => ({ ...f, [key]: e.target.value }))}
+      />
+    )
+  }
+
+  return (
+    <div className="space-y-1">
+      <div className="text-sm font-medium">Адрес доставки</div>
+      {addresses.map((a) => (
+        <label key={a.id} className="flex items-center gap-2 text-sm">
+          <input type="radio" name="address" checked={value === a.id} onChange={() => onChange(a.id)} />
+          {oneLine(a)}
+        </label>
+      ))}
+      {adding ? (
+        <form
+          className="grid gap-2 sm:grid-cols-2"
+          onSubmit={(e) => {
+            e.preventDefault()
+            save()
+          }}
+        >
+          {field("full_name", "Получатель")}
+          {field("phone", "Телефон")}
+          {field("line1", "Улица, дом")}
+          {field("line2", "Квартира, офис")}
+          {field("city", "Город")}
+          {field("region", "Регион")}
+          {field("postal_code", "Индекс")}
+          {field("country", "Страна")}
+          <div className="flex gap-2 sm:col-span-2">
+            <Button
+              type="submit"
+              variant="outline"
+              disabled={saving || !form.full_name || !form.line1 || !form.city || !form.country}
+            >
+              {saving ? <Loader2 className="w-4 h-4 animate-spin" /> : "Сохранить адрес"}
+            </Button>
+            {addresses.length > 0 && (
+              <Button type="button" variant="ghost" onClick={() => setAdding(false)}>
+                Отмена
+              </Button>
+            )}
+          </div>
+        </form>
+      ) : (
+        <Button variant="ghost" size="sm" onClick={() => setAdding(true)}>
+          Добавить адрес
+        </Button>
+      )}
+    </div>
+  )
+}
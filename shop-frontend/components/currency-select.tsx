@@ -0,0 +1,44 @@
+"use client"
+
+import { useEffect, useState } from "react"
+import { Select, SelectContent, SelectItem, SelectTrigger, SelectValue } from "@/components/ui/select"
+import { fetchJSON } from "@/lib/api"
+import { SHOP_CURRENCY, getCurrency, setCurrency } from "@/lib/money"
+import type { ExchangeRate } from "@/lib/types"
+
+// Picks the storefront currency out of the shop currency and those with an
+// exchange rate. Hidden while the shop sells in one currency only.
+export function CurrencySelect({ onChange = () => {} }: { onChange?: (currency: string) => void }) {
+  const [currencies, setCurrencies] = useState<string[]>([SHOP_CURRENCY])
+  const [value, setValue] = useState(SHOP_CURRENCY)
+
+  useEffect(() => {
+    setValue(getCurrency())
+    fetchJSON<ExchangeRate[]>("/exchange-rates").then((res) => {
+      if (Array.isArray(res.data)) setCurrencies([SHOP_CURRENCY, ...res.data.map((r) => r.currency)])
+    })
+  }, [])
+
+  if (currencies.length < 2) return null
+  return (
+    <Select
+      value={value}
+      onValueChange={(c) => {
+        setCurrency(c)
+        setValue(c)
+        onChange(c)
+      }}
+    >
+      <SelectTrigger className="w-[100px]" aria-label="Валюта">
+        <SelectValue />
+      </SelectTrigger>
+      <SelectContent>
+        {currencies.map((c) => (
+          <SelectItem key={c} value={c}>
+            {c}
+          </SelectItem>
+        ))}
+      </SelectContent>
+    </Select>
+  )
+}
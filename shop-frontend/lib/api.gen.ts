@@ -0,0 +1,708 @@
+// Code generated by inetmagaz/tools/tsgen from openapi.json. DO NOT EDIT.
+
+import { fetchJSON } from "./api"
+
+export type Address = ShippingAddress & {
+  id: number
+  is_default: boolean
+}
+
+export type AddressInput = {
+  city: string
+  country: string
+  full_name: string
+  is_default?: boolean
+  line1: string
+  line2?: string
+  phone?: string
+  postal_code?: string
+  region?: string
+}
+
+export type ArchivedProduct = {
+  archived_at: string
+  id: number
+  name: string
+  ordered: boolean
+  sku: string
+}
+
+export type Cart = {
+  product_id: number
+  quantity: number
+}
+
+export type CartLine = {
+  added_price: number
+  id: number
+  in_stock: boolean
+  price: number
+  price_changed: boolean
+  product_id: number
+  product_name: string
+  quantity: number
+  stock: number
+  stock_changed: boolean
+  subtotal: number
+}
+
+export type CartQuantity = {
+  quantity: number
+}
+
+export type CartSummary = {
+  coupon_code?: string
+  coupon_error?: string
+  currency: string
+  discount: number
+  free_shipping: boolean
+  grand_total: number
+  has_changes: boolean
+  item_count: number
+  lines: CartLine[]
+  total: number
+  weight: number
+}
+
+export type Coupon = {
+  active: boolean
+  categories: string[]
+  code: string
+  created_at: string
+  ends_at: string | null
+  id: number
+  kind: "percent" | "fixed" | "free_shipping"
+  max_uses: number
+  max_uses_per_user: number
+  min_total: number
+  product_ids: number[]
+  starts_at: string | null
+  uses: number
+  value: number
+}
+
+export type CouponCode = {
+  code: string
+}
+
+export type CouponInput = {
+  categories?: string[]
+  code: string
+  ends_at?: string | null
+  kind: "percent" | "fixed" | "free_shipping"
+  max_uses?: number
+  max_uses_per_user?: number
+  min_total?: number
+  product_ids?: number[]
+  starts_at?: string | null
+  value?: number
+}
+
+export type DCart = {
+  currency: string
+  id: number
+  price: number
+  product_name: string
+  product_price: string
+  quantity: number
+}
+
+export type ExchangeRate = {
+  currency: string
+  rate: number
+  updated_at: string
+}
+
+export type ExchangeRateInput = {
+  rate: number
+}
+
+export type FakeConfirm = {
+  outcome?: "payment.authorized" | "payment.succeeded" | "payment.failed"
+}
+
+export type ForgotPasswordRequest = {
+  email: string
+}
+
+export type Health = {
+  status: string
+}
+
+export type IDRequest = {
+  id: number
+}
+
+export type ImageOrder = {
+  ids: number[]
+}
+
+export type ImportReport = {
+  created: number
+  dry_run: boolean
+  failed: number
+  rows: ImportRowResult[]
+  saved: boolean
+  updated: number
+}
+
+export type ImportRowResult = {
+  action: "created" | "updated" | "error"
+  errors?: string[]
+  id?: number
+  name?: string
+  row: number
+  sku?: string
+}
+
+export type LoginRequest = {
+  nameoremail: string
+  password: string
+}
+
+export type Message = {
+  message: string
+}
+
+export type NotificationPreferences = {
+  order_confirmation: boolean
+  order_status: boolean
+}
+
+export type Order = {
+  address_id?: number
+  created_at: string
+  currency?: string
+  shipping_method_id?: number
+  status: string
+  total_price: number
+  user_id: number
+}
+
+export type OrderChange = {
+  created: boolean
+  order_id: number
+  status: string
+  total_price: number
+  user_id: number
+}
+
+export type OrderCreated = {
+  currency: string
+  discount: number
+  exchange_rate: number
+  message: string
+  order_id: number
+  payment: PaymentIntent
+  shipping_price: number
+  tax: number
+  total_price: number
+}
+
+export type OrderDisplay = {
+  coupon_code: string | null
+  created_at: string
+  currency: string
+  discount: number
+  exchange_rate: number
+  id: number
+  shipping_address: ShippingAddress | null
+  shipping_method: string | null
+  shipping_price: number
+  status: string
+  tax: number
+  tax_breakdown: TaxAmount[]
+  tax_inclusive: boolean
+  total_price: number
+}
+
+export type OrderEventData = {
+  currency?: string
+  order_id: number
+  status: string
+  total_price?: number
+}
+
+export type OrderItem = {
+  discount: number
+  id: number
+  price: number
+  product_id: number
+  quantity: number
+  refunded_quantity: number
+  tax: number
+  tax_rate: number
+}
+
+export type OrderRefund = {
+  amount: number
+  created_at: string
+  id: number
+  items: RefundLine[]
+  order_id: number
+  reason: string
+  refund_id: string
+  restocked: boolean
+}
+
+export type OrderforA = {
+  coupon_code: string | null
+  created_at: string
+  currency: string
+  discount: number
+  exchange_rate: number
+  id: number
+  shipping_address: ShippingAddress | null
+  shipping_method: string | null
+  shipping_price: number
+  status: string
+  tax: number
+  tax_breakdown: TaxAmount[]
+  tax_inclusive: boolean
+  total_price: number
+  user_id: number
+}
+
+export type Payment = {
+  amount: number
+  created_at: string
+  id: number
+  intent_id: string
+  order_id: number
+  provider: string
+  status: string
+  updated_at: string
+}
+
+export type PaymentEvent = {
+  amount?: number
+  intent_id: string
+  type: "payment.authorized" | "payment.succeeded" | "payment.failed"
+}
+
+export type PaymentIntent = {
+  amount: number
+  client_secret: string
+  currency: string
+  intent_id: string
+  status: "requires_confirmation" | "authorized" | "succeeded" | "failed" | "canceled"
+}
+
+export type Product = {
+  archived_at?: string
+  category?: string
+  currency?: string
+  description: string
+  id: number
+  image: string
+  images?: ProductImage[]
+  name: string
+  price: number
+  sku?: string
+  stock: number
+  tax_class?: string
+  weight?: number
+}
+
+export type ProductImage = {
+  content_type: "image/jpeg" | "image/png" | "image/gif"
+  created_at: string
+  height: number
+  id: number
+  position: number
+  product_id: number
+  thumbnails: Record<string, string>
+  url: string
+  width: number
+}
+
+export type ProductImportRow = {
+  category?: string
+  currency?: string
+  description?: string
+  image?: string
+  name?: string
+  price?: number
+  sku?: string
+  stock?: number
+  tax_class?: string
+  weight?: number
+}
+
+export type ProductPrice = {
+  currency: string
+  price: number
+}
+
+export type ProductPriceInput = {
+  price: number
+}
+
+export type Productl = {
+  currency: string
+  id: number
+  image: string
+  name: string
+  price: number
+}
+
+export type Profile = {
+  email: string
+  role: string
+  username: string
+}
+
+export type Readiness = {
+  database?: string
+  expected_schema_version?: number
+  schema_version?: number
+  status: "ok" | "unavailable"
+}
+
+export type RefundCreated = {
+  message: string
+  order_status: "partially_refunded" | "refunded"
+  refund: OrderRefund
+  refunded_amount: number
+}
+
+export type RefundLine = {
+  item_id: number
+  quantity: number
+}
+
+export type RefundRequest = {
+  amount?: number
+  items?: RefundLine[]
+  reason?: string
+  restock?: boolean
+}
+
+export type RegistrationRequest = {
+  email: string
+  password: string
+  role: string
+  username: string
+}
+
+export type ResetPasswordRequest = {
+  password: string
+  token: string
+}
+
+export type ShippingAddress = {
+  city: string
+  country: string
+  full_name: string
+  line1: string
+  line2: string
+  phone: string
+  postal_code: string
+  region: string
+}
+
+export type ShippingMethod = {
+  active: boolean
+  created_at: string
+  id: number
+  name: string
+  provider: string
+  rates: ShippingRate[]
+}
+
+export type ShippingMethodInput = {
+  name: string
+  provider?: string
+  rates?: ShippingRate[]
+}
+
+export type ShippingQuote = {
+  method_id: number
+  name: string
+  price: number
+}
+
+export type ShippingRate = {
+  country: string
+  free_above: number
+  max_weight: number
+  min_weight: number
+  per_kg: number
+  price: number
+  region: string
+}
+
+export type StockEventData = {
+  name: string
+  product_id: number
+  stock: number
+}
+
+export type TaxAmount = {
+  amount: number
+  name: string
+  rate: number
+  taxable: number
+}
+
+export type TaxRate = {
+  country: string
+  created_at: string
+  id: number
+  name: string
+  rate: number
+  region: string
+  tax_class: string
+}
+
+export type TaxRateInput = {
+  country?: string
+  name: string
+  rate: number
+  region?: string
+  tax_class?: string
+}
+
+export type Token = {
+  token: string
+}
+
+export type UpdateStatus = {
+  id: number
+  status: string
+}
+
+export type WebhookDelivery = {
+  attempts: number
+  created_at: string
+  delivered_at: string | null
+  event_id: string
+  event_type: string
+  id: number
+  last_error: string
+  last_status_code: number | null
+  next_attempt_at: string
+  payload: WebhookEvent
+  status: "pending" | "succeeded" | "failed"
+  subscription_id: number
+}
+
+export type WebhookEvent = {
+  created_at: string
+  data: unknown
+  id: string
+  type: string
+}
+
+export type WebhookSubscription = {
+  active: boolean
+  created_at: string
+  events: ("order.created" | "order.status_changed" | "product.stock_low")[]
+  id: number
+  secret?: string
+  url: string
+}
+
+export type WebhookSubscriptionInput = {
+  events: ("order.created" | "order.status_changed" | "product.stock_low")[]
+  secret?: string
+  url: string
+}
+
+export const client = {
+  /** Current user's address book */
+  listAddresses: () =>
+    fetchJSON<Address[]>("/api/v1/addresses/", { method: "GET", auth: true }),
+  /** Add an address */
+  createAddress: (body: AddressInput) =>
+    fetchJSON<Address>("/api/v1/addresses/", { method: "POST", auth: true, body }),
+  /** Edit an address */
+  updateAddress: (id: number, body: AddressInput) =>
+    fetchJSON<Address>(`/api/v1/addresses/${id}`, { method: "PUT", auth: true, body }),
+  /** Delete an address */
+  deleteAddress: (id: number) =>
+    fetchJSON<Message>(`/api/v1/addresses/${id}`, { method: "DELETE", auth: true }),
+  /** Make an address the default */
+  setDefaultAddress: (id: number) =>
+    fetchJSON<Address>(`/api/v1/addresses/${id}/default`, { method: "POST", auth: true }),
+  /** Current user's cart */
+  getCart: () =>
+    fetchJSON<DCart[]>("/api/v1/cart/", { method: "GET", auth: true }),
+  /** Add products to the cart */
+  addToCart: (body: Cart[]) =>
+    fetchJSON<Message>("/api/v1/cart/add", { method: "POST", auth: true, body }),
+  /** Empty the cart */
+  clearCart: () =>
+    fetchJSON<Message>("/api/v1/cart/clear", { method: "DELETE", auth: true }),
+  /** Apply a discount code to the cart */
+  applyCoupon: (body: CouponCode) =>
+    fetchJSON<CartSummary>("/api/v1/cart/coupon", { method: "POST", auth: true, body }),
+  /** Remove the cart's discount code */
+  removeCoupon: () =>
+    fetchJSON<CartSummary>("/api/v1/cart/coupon", { method: "DELETE", auth: true }),
+  /** Remove a cart line */
+  removeFromCart: (body: IDRequest) =>
+    fetchJSON<Message>("/api/v1/cart/remove", { method: "POST", auth: true, body }),
+  /** Cart with current prices, totals and change flags */
+  getCartSummary: () =>
+    fetchJSON<CartSummary>("/api/v1/cart/summary", { method: "GET", auth: true }),
+  /** Set the quantity of a cart line */
+  updateCartLine: (id: number, body: CartQuantity) =>
+    fetchJSON<DCart[]>(`/api/v1/cart/${id}`, { method: "PATCH", auth: true, body }),
+  /** Discount codes (admin) */
+  listCoupons: () =>
+    fetchJSON<Coupon[]>("/api/v1/coupons/", { method: "GET", auth: true }),
+  /** Create a discount code (admin) */
+  createCoupon: (body: CouponInput) =>
+    fetchJSON<Coupon>("/api/v1/coupons/", { method: "POST", auth: true, body }),
+  /** Deactivate a discount code (admin) */
+  deleteCoupon: (id: number) =>
+    fetchJSON<Message>(`/api/v1/coupons/${id}`, { method: "DELETE", auth: true }),
+  /** Currencies besides the shop's that products can be priced and bought in */
+  listExchangeRates: () =>
+    fetchJSON<ExchangeRate[]>("/api/v1/exchange-rates", { method: "GET" }),
+  /** Set an exchange rate (admin) */
+  setExchangeRate: (currency: string, body: ExchangeRateInput) =>
+    fetchJSON<ExchangeRate>(`/api/v1/exchange-rates/${currency}`, { method: "PUT", auth: true, body }),
+  /** Stop selling in a currency (admin) */
+  deleteExchangeRate: (currency: string) =>
+    fetchJSON<Message>(`/api/v1/exchange-rates/${currency}`, { method: "DELETE", auth: true }),
+  /** Exchange credentials for a JWT */
+  login: (body: LoginRequest) =>
+    fetchJSON<Token>("/api/v1/login", { method: "POST", body }),
+  /** Current user's orders */
+  listOrders: () =>
+    fetchJSON<OrderDisplay[]>("/api/v1/orders/", { method: "GET", auth: true }),
+  /** Place an order from the cart and open a payment */
+  createOrder: (body: Order) =>
+    fetchJSON<OrderCreated>("/api/v1/orders/", { method: "POST", auth: true, body }),
+  /** All orders (admin) */
+  listAllOrders: () =>
+    fetchJSON<OrderforA[]>("/api/v1/orders/getall", { method: "GET", auth: true }),
+  /** Change an order's status (admin) */
+  updateOrderStatus: (body: UpdateStatus) =>
+    fetchJSON<Message>("/api/v1/orders/update", { method: "POST", auth: true, body }),
+  /** One of the current user's orders */
+  getOrder: (id: number) =>
+    fetchJSON<OrderDisplay>(`/api/v1/orders/${id}`, { method: "GET", auth: true }),
+  /** Lines of an order */
+  listOrderItems: (id: number) =>
+    fetchJSON<OrderItem[]>(`/api/v1/orders/${id}/items`, { method: "GET", auth: true }),
+  /** Payments recorded for an order */
+  listOrderPayments: (id: number) =>
+    fetchJSON<Payment[]>(`/api/v1/orders/${id}/payments`, { method: "GET", auth: true }),
+  /** Refunds issued for an order */
+  listOrderRefunds: (id: number) =>
+    fetchJSON<OrderRefund[]>(`/api/v1/orders/${id}/refunds`, { method: "GET", auth: true }),
+  /** Refund part or all of a paid order (admin) */
+  refundOrder: (id: number, body: RefundRequest) =>
+    fetchJSON<RefundCreated>(`/api/v1/orders/${id}/refunds`, { method: "POST", auth: true, body }),
+  /** Email a password reset link */
+  forgotPassword: (body: ForgotPasswordRequest) =>
+    fetchJSON<Message>("/api/v1/password/forgot", { method: "POST", body }),
+  /** Set a new password with a reset token */
+  resetPassword: (body: ResetPasswordRequest) =>
+    fetchJSON<Message>("/api/v1/password/reset", { method: "POST", body }),
+  /** Complete a payment on the fake gateway (admin, development only) */
+  confirmFakePayment: (intent: string, body: FakeConfirm) =>
+    fetchJSON<Message>(`/api/v1/payments/fake/${intent}/confirm`, { method: "POST", auth: true, body }),
+  /** Payment provider callback */
+  paymentWebhook: (body: PaymentEvent) =>
+    fetchJSON<Message>("/api/v1/payments/webhook", { method: "POST", body }),
+  /** List the catalog */
+  listProducts: () =>
+    fetchJSON<Productl[]>("/api/v1/products", { method: "GET" }),
+  /** Create products (admin) */
+  createProducts: (body: Product[]) =>
+    fetchJSON<Message>("/api/v1/products", { method: "POST", auth: true, body }),
+  /** List archived products (admin) */
+  listArchivedProducts: () =>
+    fetchJSON<ArchivedProduct[]>("/api/v1/products/archived", { method: "GET", auth: true }),
+  /** Download the catalog (admin) */
+  exportProducts: () =>
+    fetchJSON<ProductImportRow[]>("/api/v1/products/export", { method: "GET", auth: true }),
+  /** Create and update products in bulk (admin) */
+  importProducts: (body: ProductImportRow[]) =>
+    fetchJSON<ImportReport>("/api/v1/products/import", { method: "POST", auth: true, body }),
+  /** Get a product */
+  getProduct: (id: number) =>
+    fetchJSON<Product>(`/api/v1/products/${id}`, { method: "GET" }),
+  /** Update a product (admin) */
+  updateProduct: (id: number, body: Product) =>
+    fetchJSON<Message>(`/api/v1/products/${id}`, { method: "PUT", auth: true, body }),
+  /** Archive a product (admin) */
+  deleteProduct: (id: number) =>
+    fetchJSON<Message>(`/api/v1/products/${id}`, { method: "DELETE", auth: true }),
+  /** List a product's images */
+  listProductImages: (id: number) =>
+    fetchJSON<ProductImage[]>(`/api/v1/products/${id}/images`, { method: "GET" }),
+  /** Upload product images (admin) */
+  uploadProductImages: (id: number, body: FormData) =>
+    fetchJSON<ProductImage[]>(`/api/v1/products/${id}/images`, { method: "POST", auth: true, body }),
+  /** Reorder a product's images (admin) */
+  reorderProductImages: (id: number, body: ImageOrder) =>
+    fetchJSON<ProductImage[]>(`/api/v1/products/${id}/images/order`, { method: "PUT", auth: true, body }),
+  /** Delete a product image (admin) */
+  deleteProductImage: (id: number, imageID: number) =>
+    fetchJSON<Message>(`/api/v1/products/${id}/images/${imageID}`, { method: "DELETE", auth: true }),
+  /** Prices set for a product in other currencies (admin) */
+  listProductPrices: (id: number) =>
+    fetchJSON<ProductPrice[]>(`/api/v1/products/${id}/prices`, { method: "GET", auth: true }),
+  /** Set a product's price in a currency instead of converting it (admin) */
+  setProductPrice: (id: number, currency: string, body: ProductPriceInput) =>
+    fetchJSON<ProductPrice>(`/api/v1/products/${id}/prices/${currency}`, { method: "PUT", auth: true, body }),
+  /** Go back to converting a product's shop price (admin) */
+  deleteProductPrice: (id: number, currency: string) =>
+    fetchJSON<Message>(`/api/v1/products/${id}/prices/${currency}`, { method: "DELETE", auth: true }),
+  /** Put an archived product back in the catalog (admin) */
+  restoreProduct: (id: number) =>
+    fetchJSON<Message>(`/api/v1/products/${id}/restore`, { method: "POST", auth: true }),
+  /** Current user's profile */
+  getProfile: () =>
+    fetchJSON<Profile>("/api/v1/profile", { method: "GET", auth: true }),
+  /** Which emails the current user gets */
+  getNotificationPreferences: () =>
+    fetchJSON<NotificationPreferences>("/api/v1/profile/notifications", { method: "GET", auth: true }),
+  /** Choose which emails the current user gets */
+  updateNotificationPreferences: (body: NotificationPreferences) =>
+    fetchJSON<NotificationPreferences>("/api/v1/profile/notifications", { method: "PUT", auth: true, body }),
+  /** Register a new user */
+  register: (body: RegistrationRequest) =>
+    fetchJSON<Message>("/api/v1/registration", { method: "POST", body }),
+  /** Shipping methods (admin) */
+  listShippingMethods: () =>
+    fetchJSON<ShippingMethod[]>("/api/v1/shipping/methods", { method: "GET", auth: true }),
+  /** Create a shipping method (admin) */
+  createShippingMethod: (body: ShippingMethodInput) =>
+    fetchJSON<ShippingMethod>("/api/v1/shipping/methods", { method: "POST", auth: true, body }),
+  /** Replace a shipping method and its rates (admin) */
+  updateShippingMethod: (id: number, body: ShippingMethodInput) =>
+    fetchJSON<ShippingMethod>(`/api/v1/shipping/methods/${id}`, { method: "PUT", auth: true, body }),
+  /** Deactivate a shipping method (admin) */
+  deleteShippingMethod: (id: number) =>
+    fetchJSON<Message>(`/api/v1/shipping/methods/${id}`, { method: "DELETE", auth: true }),
+  /** Price the active shipping methods for the cart */
+  quoteShipping: () =>
+    fetchJSON<ShippingQuote[]>("/api/v1/shipping/quote", { method: "GET", auth: true }),
+  /** Tax rates (admin) */
+  listTaxRates: () =>
+    fetchJSON<TaxRate[]>("/api/v1/tax/rates/", { method: "GET", auth: true }),
+  /** Create a tax rate (admin) */
+  createTaxRate: (body: TaxRateInput) =>
+    fetchJSON<TaxRate>("/api/v1/tax/rates/", { method: "POST", auth: true, body }),
+  /** Delete a tax rate (admin) */
+  deleteTaxRate: (id: number) =>
+    fetchJSON<Message>(`/api/v1/tax/rates/${id}`, { method: "DELETE", auth: true }),
+  /** Webhook subscriptions (admin) */
+  listWebhooks: () =>
+    fetchJSON<WebhookSubscription[]>("/api/v1/webhooks/", { method: "GET", auth: true }),
+  /** Subscribe a URL to events (admin) */
+  createWebhook: (body: WebhookSubscriptionInput) =>
+    fetchJSON<WebhookSubscription>("/api/v1/webhooks/", { method: "POST", auth: true, body }),
+  /** Remove a subscription and its deliveries (admin) */
+  deleteWebhook: (id: number) =>
+    fetchJSON<Message>(`/api/v1/webhooks/${id}`, { method: "DELETE", auth: true }),
+  /** Latest 100 deliveries to a subscription (admin) */
+  listWebhookDeliveries: (id: number) =>
+    fetchJSON<WebhookDelivery[]>(`/api/v1/webhooks/${id}/deliveries`, { method: "GET", auth: true }),
+}
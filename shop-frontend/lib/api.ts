@@ -2,6 +2,7 @@ const TOKEN_COOKIE = "auth_token"
 const LEGACY_TOKEN_KEY = "auth_token"
 const BASE_KEY = "api_base_url"
 const DEFAULT_BASE = "https://shop-4dv1.onrender.com"
+const API_PREFIX = "/api/v1"
 
 function sanitizeBaseUrl(input: string | null | undefined): string {
   let url = (input || "").trim()
@@ -20,6 +21,13 @@ function joinUrl(base: string, path: string): string {
   return b + p
 }
 
+// Paths are written relative to the API version; already versioned paths
+// (e.g. from the generated client) are left alone.
+function apiPath(path: string): string {
+  if (/^https?:\/\//i.test(path) || path.startsWith("/api/")) return path
+  return API_PREFIX + (path.startsWith("/") ? path : "/" + path)
+}
+
 // Cookie helpers
 function getCookie(name: string): string | null {
   if (typeof document === "undefined") return null
@@ -79,6 +87,13 @@ export function getBaseUrl(): string {
   }
 }
 
+// assetUrl resolves a URL the API returned for an uploaded file; locally
+// stored files come back relative to the API host.
+export function assetUrl(url: string): string {
+  if (!url || !url.startsWith("/media/")) return url
+  return joinUrl(getBaseUrl(), url)
+}
+
 export function setBaseUrl(url: string) {
   if (typeof window === "undefined") return
   try {
@@ -89,7 +104,7 @@ export function setBaseUrl(url: string) {
 }
 
 type FetchOpts = {
-  method?: "GET" | "POST" | "PUT" | "DELETE"
+  method?: "GET" | "POST" | "PUT" | "PATCH" | "DELETE"
   auth?: boolean
   body?: any
   headers?: Record<string, string>
@@ -98,12 +113,17 @@ type FetchOpts = {
 export async function fetchJSON<T = any>(
   path: string,
   opts: FetchOpts = {},
-): Promise<{ data?: T; error?: string; status: number }> {
+): Promise<{ data?: T; error?: string; errorBody?: any; status: number }> {
   const base = getBaseUrl()
-  const url = joinUrl(base, path)
+  const url = joinUrl(base, apiPath(path))
 
+  // FormData and file bodies (uploads, imports) are sent as they are; fetch
+  // sets the multipart Content-Type with its boundary, and a file's comes
+  // from its type unless given in opts.headers.
+  const isForm = typeof FormData !== "undefined" && opts.body instanceof FormData
+  const isFile = typeof Blob !== "undefined" && opts.body instanceof Blob
   const headers: Record<string, string> = {
-    "Content-Type": "application/json",
+    ...(isForm || isFile ? {} : { "Content-Type": "application/json" }),
     ...(opts.headers || {}),
   }
   if (opts.auth) {
@@ -115,7 +135,7 @@ export async function fetchJSON<T = any>(
     const res = await fetch(url, {
       method: opts.method || "GET",
       headers,
-      body: opts.body !== undefined ? JSON.stringify(opts.body) : undefined,
+      body: isForm || isFile ? opts.body : opts.body !== undefined ? JSON.stringify(opts.body) : undefined,
       credentials: "omit",
     })
 
@@ -124,9 +144,11 @@ export async function fetchJSON<T = any>(
 
     if (!res.ok) {
       let message = res.statusText
+      let errorBody: any
       try {
         if (isJSON) {
           const data = await res.json()
+          errorBody = data
           message = typeof data === "string" ? data : data?.message || JSON.stringify(data)
         } else {
           message = await res.text()
@@ -134,7 +156,7 @@ export async function fetchJSON<T = any>(
       } catch {
         // ignore
       }
-      return { error: message || `HTTP ${status}`, status }
+      return { error: message || `HTTP ${status}`, errorBody, status }
     }
 
     const data = (isJSON ? await res.json() : await res.text()) as T
@@ -144,3 +166,91 @@ export async function fetchJSON<T = any>(
     return { error: msg, status: 0 }
   }
 }
+
+// downloadFile saves a response as filename, for exports that need the
+// Authorization header and so can't be plain links.
+export async function downloadFile(path: string, filename: string, opts: { auth?: boolean } = {}): Promise<string | null> {
+  const headers: Record<string, string> = {}
+  if (opts.auth) {
+    const token = getToken()
+    if (token) headers["Authorization"] = `Bearer ${token}`
+  }
+  try {
+    const res = await fetch(joinUrl(getBaseUrl(), apiPath(path)), { headers, credentials: "omit" })
+    if (!res.ok) return (await res.text()) || `HTTP ${res.status}`
+    const url = URL.createObjectURL(await res.blob())
+    const a = document.createElement("a")
+    a.href = url
+    a.download = filename
+    a.click()
+    URL.revokeObjectURL(url)
+    return null
+  } catch (err: any) {
+    return typeof err?.message === "string" ? err.message : "Network error"
+  }
+}
+
+// streamEvents reads a Server-Sent Events endpoint. EventSource can't send
+// the Authorization header, so the stream is read with fetch instead. It
+// reconnects after the stream ends until the returned function is called.
+export function streamEvents(
+  path: string,
+  onEvent: (event: string, data: any) => void,
+  opts: { auth?: boolean } = {},
+): () => void {
+  const controller = new AbortController()
+  let retry = 3000
+
+  async function connect() {
+    const headers: Record<string, string> = { Accept: "text/event-stream" }
+    if (opts.auth) {
+      const token = getToken()
+      if (token) headers["Authorization"] = `Bearer ${token}`
+    }
+    const res = await fetch(joinUrl(getBaseUrl(), apiPath(path)), {
+      headers,
+      signal: controller.signal,
+      credentials: "omit",
+    })
+    if (!res.ok || !res.body) throw new Error(`HTTP ${res.status}`)
+    const reader = res.body.pipeThrough(new TextDecoderStream()).getReader()
+    let buffer = ""
+    for (;;) {
+      const { value, done } = await reader.read()
+      if (done) return
+      buffer += value
+      let end: number
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        const block = buffer.slice(0, end)
+        buffer = buffer.slice(end + 2)
+        let event = "message"
+        const data: string[] = []
+        for (const line of block.split("\n")) {
+          if (line.startsWith("event:")) event = line.slice(6).trim()
+          else if (line.startsWith("data:")) data.push(line.slice(5).trim())
+          else if (line.startsWith("retry:")) retry = Number.parseInt(line.slice(6)) || retry
+        }
+        if (data.length === 0) continue
+        try {
+          onEvent(event, JSON.parse(data.join("\n")))
+        } catch {
+          onEvent(event, data.join("\n"))
+        }
+      }
+    }
+  }
+
+  ;(async () => {
+    while (!controller.signal.aborted) {
+      try {
+        await connect()
+      } catch {
+        // reconnect below
+      }
+      if (controller.signal.aborted) break
+      await new Promise((resolve) => setTimeout(resolve, retry))
+    }
+  })()
+
+  return () => controller.abort()
+}
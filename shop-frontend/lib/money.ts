@@ -0,0 +1,54 @@
+// Amounts from the API are integers in minor units (kopecks for RUB).
+
+// The currency catalog prices are in; set NEXT_PUBLIC_SHOP_CURRENCY to the
+// backend's SHOP_CURRENCY.
+const SHOP_CURRENCY = (process.env.NEXT_PUBLIC_SHOP_CURRENCY || "RUB").toUpperCase()
+
+function minorDigits(currency: string) {
+  try {
+    return new Intl.NumberFormat("ru-RU", { style: "currency", currency }).resolvedOptions().maximumFractionDigits ?? 2
+  } catch {
+    return 2
+  }
+}
+
+export function fromMinor(amount: number, currency = SHOP_CURRENCY) {
+  return amount / 10 ** minorDigits(currency)
+}
+
+export function toMinor(value: number, currency = SHOP_CURRENCY) {
+  return Math.round(value * 10 ** minorDigits(currency))
+}
+
+export function formatMoney(amount: number, currency: string = SHOP_CURRENCY) {
+  const c = currency || SHOP_CURRENCY
+  try {
+    return new Intl.NumberFormat("ru-RU", { style: "currency", currency: c }).format(fromMinor(amount, c))
+  } catch {
+    return `${fromMinor(amount, c)} ${c}`
+  }
+}
+
+// The currency the customer picked for the storefront; prices are fetched
+// in it and orders are paid in it.
+const CURRENCY_KEY = "currency"
+
+export function getCurrency(): string {
+  if (typeof window === "undefined") return SHOP_CURRENCY
+  try {
+    return localStorage.getItem(CURRENCY_KEY) || SHOP_CURRENCY
+  } catch {
+    return SHOP_CURRENCY
+  }
+}
+
+export function setCurrency(currency: string) {
+  try {
+    if (currency === SHOP_CURRENCY) localStorage.removeItem(CURRENCY_KEY)
+    else localStorage.setItem(CURRENCY_KEY, currency)
+  } catch {
+    // ignore
+  }
+}
+
+export { SHOP_CURRENCY }